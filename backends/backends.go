@@ -15,13 +15,20 @@ var (
 	queueMutex         = sync.Mutex{}
 	queue              = make([]util.Reload, 0)
 	consecutive_errors = 0
+	retry              *time.Timer
 )
 
-func GetFrontends(config *util.Config, timeout time.Duration) (map[string]*util.Frontend, error) {
+func GetFrontends(config *util.Config, frontendCache *kubernetes.FrontendCache, timeout time.Duration) (map[string]*util.Frontend, error) {
 	resChan := make(chan map[string]*util.Frontend, 1)
 	errChan := make(chan error, 1)
 	go func() {
-		frontends, err := kubernetes.UpdateFrontends(config)
+		var frontends map[string]*util.Frontend
+		var err error
+		if frontendCache != nil {
+			frontends, err = frontendCache.UpdateFrontends()
+		} else {
+			frontends, err = kubernetes.ListFrontends(config)
+		}
 		if err != nil {
 			errChan <- err
 		} else {
@@ -40,6 +47,14 @@ func GetFrontends(config *util.Config, timeout time.Duration) (map[string]*util.
 }
 
 func BackendManager(config *util.Config, updateChan chan util.Reload) (err error) {
+	var frontendCache *kubernetes.FrontendCache
+	if !config.DisableWatch {
+		frontendCache, err = kubernetes.NewFrontendCache(config)
+		if err != nil {
+			return err
+		}
+	}
+
 	go func() {
 		for {
 			select {
@@ -57,13 +72,16 @@ func BackendManager(config *util.Config, updateChan chan util.Reload) (err error
 		}
 	}()
 
-	// watch changes in kubernetes api and trigger update
-	if !config.DisableWatch {
-		go kubernetes.WatchBackends(config, updateChan)
+	// watch changes in kubernetes api and trigger update, frontends are then built from the informer caches
+	if frontendCache != nil {
+		go frontendCache.Watch(updateChan)
 	} else {
 		log.Info("API watch has been disabled by config flag, reloading changes with fixed interval only",
 			zap.Int("interval", config.ReloadEvery),
 		)
+		if config.GatewayControllerName != "" {
+			log.Warn("Gateway API routes are only handled with the API watch enabled, ignoring HTTPRoutes")
+		}
 	}
 
 	trigger(util.NewReload("initial"))
@@ -74,30 +92,61 @@ func BackendManager(config *util.Config, updateChan chan util.Reload) (err error
 			zap.String("reason", update.Reason),
 			zap.String("event", "reload"),
 		)
-		frontends, err := GetFrontends(config, 5*time.Second)
+		frontends, err := GetFrontends(config, frontendCache, 5*time.Second)
 
 		if err != nil {
+			// keep serving the last known good frontends, and retry with exponential backoff
+			consecutive_errors += 1
+			backoff := retryBackoff(config, consecutive_errors)
 			log.Error(err.Error(),
 				zap.String("event", "updateError"),
 				zap.Int("consecutiveErrors", consecutive_errors),
+				zap.String("backoff", backoff.String()),
 			)
+			config.Counters.ReloadErrors.Inc()
+			config.SetUpdateFailure(err, consecutive_errors)
 
-			consecutive_errors += 1
-			trigger(util.NewReload("retry"))
+			// the retry is scheduled rather than waited for, so reloads requested meanwhile are not held up
+			if retry != nil {
+				retry.Stop()
+			}
+			retry = time.AfterFunc(backoff, func() {
+				trigger(util.NewReload("retry"))
+			})
+			return
 		}
 
+		if retry != nil {
+			retry.Stop()
+			retry = nil
+		}
 		consecutive_errors = 0
+		config.ClearUpdateFailure()
 
-		config.Frontends = frontends
+		table := config.PublishFrontends(frontends)
+		if config.HealthChecker != nil {
+			config.HealthChecker.Sync(table)
+		}
 		config.Counters.Reloads.Inc()
-		config.LastUpdate = time.Now()
-		config.Counters.LastUpdate.Set(float64(config.LastUpdate.Unix()))
-		config.HasBeenUpdated = true
+		config.Counters.LastUpdate.Set(float64(table.Built.Unix()))
 	})
 
 	return
 }
 
+// retryBackoff doubles the wait for every consecutive error, starting at reload-rollup and capped at reload-every
+func retryBackoff(config *util.Config, consecutiveErrors int) time.Duration {
+	backoff := time.Duration(config.ReloadRollup) * time.Second
+	limit := time.Duration(config.ReloadEvery) * time.Second
+	for i := 1; i < consecutiveErrors && backoff < limit; i++ {
+		backoff *= 2
+	}
+	if backoff > limit {
+		backoff = limit
+	}
+	return backoff
+}
+
 func trigger(reload util.Reload) {
 	queueMutex.Lock()
 	defer queueMutex.Unlock()
@@ -13,6 +13,7 @@ import (
 	"math"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,11 +22,13 @@ var log = logging.GetInstance()
 type CertLookup interface {
 	CertKeys() []string
 	Lookup(hostName string) *tls.Certificate
+	ClientAuth(hostName string) *util.ClientAuth
 }
 
 type CertHandler struct {
 	config                  *util.Config
-	certs                   map[string]*tls.Certificate
+	certs                   atomic.Pointer[map[string]*tls.Certificate]
+	clientAuth              atomic.Pointer[map[string]*util.ClientAuth]
 	queueMutex              sync.Mutex
 	queue                   []util.Reload
 	certValidity            *prometheus.GaugeVec
@@ -65,27 +68,59 @@ func New(config *util.Config, certUpdateChan chan util.Reload) (CertLookup, erro
 	}
 }
 
+// loadCerts returns the currently published certificates, the map must not be modified
+func (ch *CertHandler) loadCerts() map[string]*tls.Certificate {
+	if certs := ch.certs.Load(); certs != nil {
+		return *certs
+	}
+	return nil
+}
+
 func (ch *CertHandler) CertKeys() []string {
-	keys := make([]string, len(ch.certs))
-	for n, _ := range ch.certs {
+	certs := ch.loadCerts()
+	keys := make([]string, 0, len(certs))
+	for n := range certs {
 		keys = append(keys, n)
 	}
 	return keys
 }
 
 func (ch *CertHandler) Lookup(hostName string) (cert *tls.Certificate) {
-	if cert, _ = ch.certs[hostName]; cert == nil && ch.config.WildcardCertPrefix != "" {
+	return lookup(ch.loadCerts(), hostName, ch.config.WildcardCertPrefix)
+}
+
+// ClientAuth returns the client auth of a host, nil when clients are not asked for a certificate. Like certificates,
+// the client auth of a wildcard certificate applies to all hosts it covers
+func (ch *CertHandler) ClientAuth(hostName string) *util.ClientAuth {
+	var clientAuth map[string]*util.ClientAuth
+	if loaded := ch.clientAuth.Load(); loaded != nil {
+		clientAuth = *loaded
+	}
+	if auth := lookup(clientAuth, hostName, ch.config.WildcardCertPrefix); auth != nil && auth.Mode != util.CLIENT_AUTH_OFF {
+		return auth
+	}
+	return nil
+}
+
+// lookup returns the entry of a host, falling back to the wildcard entry of its parent domain
+func lookup[T any](entries map[string]*T, hostName string, wildcardPrefix string) (entry *T) {
+	if entry, _ = entries[hostName]; entry == nil && wildcardPrefix != "" {
 		parts := strings.Split(hostName, ".")[1:]
-		cert = ch.certs[fmt.Sprintf("%s.%s", ch.config.WildcardCertPrefix, strings.Join(parts, "."))]
+		entry = entries[fmt.Sprintf("%s.%s", wildcardPrefix, strings.Join(parts, "."))]
 	}
 	return
 }
 
-func (ch *CertHandler) GetCerts() (map[string]*tls.Certificate, error) {
+// GetCerts returns the certificates of the hosts, along with the client auth of the hosts verifying client certificates
+func (ch *CertHandler) GetCerts() (map[string]*tls.Certificate, map[string]*util.ClientAuth, error) {
 	if ch.reconcileMethod == RECONCILE_METHOD_KUBERNETES {
 		return kubernetes.GetCerts(ch.config, ch.config.CertNamespace)
 	} else {
-		return localfs.GetCerts(ch.config)
+		certs, err := localfs.GetCerts(ch.config)
+		if err != nil {
+			return nil, nil, err
+		}
+		return certs, localfs.GetClientAuth(ch.config), nil
 	}
 }
 
@@ -107,7 +142,7 @@ func (ch *CertHandler) reconcileCerts(certUpdateChan chan util.Reload) error {
 			zap.String("reason", reload.Reason),
 			zap.String("event", "reload-certs"),
 		)
-		certs, err := ch.GetCerts()
+		certs, clientAuth, err := ch.GetCerts()
 		if err != nil {
 			log.Error("Failed to reload certificates",
 				zap.String("error", err.Error()),
@@ -117,7 +152,8 @@ func (ch *CertHandler) reconcileCerts(certUpdateChan chan util.Reload) error {
 			ch.trigger(util.NewReload("retry"))
 			return
 		}
-		ch.certs = certs
+		ch.certs.Store(&certs)
+		ch.clientAuth.Store(&clientAuth)
 		ch.checkValidity(certs)
 	})
 
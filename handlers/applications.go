@@ -17,7 +17,7 @@ func CreateListApplicationsHandler(config *util.Config) func(http.ResponseWriter
 			port = strings.SplitN(r.Host, ":", 2)[1]
 		}
 
-		for domain, frontend := range config.Frontends {
+		for domain, frontend := range config.RoutingTable().Frontends {
 			if port != "80" {
 				domain = domain + ":" + port
 			}
@@ -56,7 +56,7 @@ func CreateListApplicationsHandler(config *util.Config) func(http.ResponseWriter
 
 func CreateListApplicationsHandlerJson(config *util.Config) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		json, err := json.Marshal(config.Frontends)
+		json, err := json.Marshal(config.RoutingTable().Frontends)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -0,0 +1,25 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/dbcdk/shelob/util"
+	"net/http"
+)
+
+func CreateBackendHealthHandler(config *util.Config) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := make([]util.BackendHealth, 0)
+		if config.HealthChecker != nil {
+			status = config.HealthChecker.Status()
+		}
+
+		json, err := json.Marshal(status)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(json)
+	}
+}
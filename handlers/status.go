@@ -8,22 +8,36 @@ import (
 )
 
 func CreateShelobStatus(config *util.Config) util.ShelobStatus {
-	timeSinceUpdate := time.Now().Sub(config.LastUpdate)
+	return createShelobStatus(config, time.Now())
+}
+
+// createShelobStatus returns the status of shelob as seen at the given time
+func createShelobStatus(config *util.Config, now time.Time) util.ShelobStatus {
+	// the last update is the time the routing table was published, no table has been published before the first update
+	table := config.RoutingTable()
+	timeSinceUpdate := now.Sub(table.Built)
 	upperLimit := time.Duration(config.AcceptableUpdateLag) * time.Second
-	stale := !config.HasBeenUpdated || (config.AcceptableUpdateLag != 0 && timeSinceUpdate > upperLimit)
+	stale := table.Version == 0 || (config.AcceptableUpdateLag != 0 && timeSinceUpdate > upperLimit)
 
 	ok := true
 	ok = ok && !config.State.ShutdownInProgress
 	ok = ok && !stale
 
-	return util.ShelobStatus{
-		Name:       config.InstanceName,
-		Ok:         ok,
-		Up:         !config.State.ShutdownInProgress,
-		Stale:      stale,
-		LastUpdate: config.LastUpdate,
-		UpdateLag:  timeSinceUpdate.Seconds(),
+	status := util.ShelobStatus{
+		Name:           config.InstanceName,
+		Ok:             ok,
+		Up:             !config.State.ShutdownInProgress,
+		Stale:          stale,
+		LastUpdate:     table.Built,
+		UpdateLag:      timeSinceUpdate.Seconds(),
+		RoutingVersion: table.Version,
 	}
+	if failure := config.UpdateFailure(); failure != nil {
+		status.ConsecutiveErrors = failure.ConsecutiveErrors
+		status.LastError = failure.Error
+	}
+
+	return status
 }
 
 func CreateStatusHandler(config *util.Config) func(http.ResponseWriter, *http.Request) {
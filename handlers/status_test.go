@@ -1,55 +1,83 @@
 package handlers
 
 import (
+	"errors"
 	"github.com/dbcdk/shelob/util"
 	"testing"
 	"time"
 )
 
-func createConfig(name string, lastUpdate time.Time, acceptableUpdateLag int, shutdownInProgress bool, hasBeenUpdated bool) *util.Config {
-	return &util.Config{
+func createConfig(name string, acceptableUpdateLag int, shutdownInProgress bool, hasBeenUpdated bool) *util.Config {
+	config := &util.Config{
 		InstanceName:        name,
-		LastUpdate:          lastUpdate,
 		AcceptableUpdateLag: acceptableUpdateLag,
 		State:               util.State{ShutdownInProgress: shutdownInProgress},
-		HasBeenUpdated:      hasBeenUpdated,
 	}
+	if hasBeenUpdated {
+		config.PublishFrontends(map[string]*util.Frontend{})
+	}
+	return config
+}
+
+// statusAfter returns the status of shelob the given time after its routing table was published
+func statusAfter(config *util.Config, sinceUpdate time.Duration) util.ShelobStatus {
+	return createShelobStatus(config, config.RoutingTable().Built.Add(sinceUpdate))
 }
 
 func TestCreateShelobStatus(t *testing.T) {
-	if !CreateShelobStatus(createConfig("testing", time.Now().Add(-1*time.Hour), 0, false, true)).Ok {
+	if !statusAfter(createConfig("testing", 0, false, true), time.Hour).Ok {
 		t.Error("Expected status=ok")
 	}
 
-	if !CreateShelobStatus(createConfig("testing", time.Now().Add(-1*time.Second), 5, false, true)).Ok {
+	if !statusAfter(createConfig("testing", 5, false, true), time.Second).Ok {
 		t.Error("Expected status=ok")
 	}
 
-	if CreateShelobStatus(createConfig("testing", time.Now().Add(-1*time.Hour), 10, false, true)).Ok {
+	if statusAfter(createConfig("testing", 10, false, true), time.Hour).Ok {
 		t.Error("Expected status=fail")
 	}
 
-	if CreateShelobStatus(createConfig("testing", time.Now().Add(-1*time.Hour), 0, true, true)).Ok {
+	if statusAfter(createConfig("testing", 0, true, true), time.Hour).Ok {
 		t.Error("Expected status=fail")
 	}
 
-	if CreateShelobStatus(createConfig("testing", time.Now().Add(-1*time.Second), 5, true, true)).Ok {
+	if statusAfter(createConfig("testing", 5, true, true), time.Second).Ok {
 		t.Error("Expected status=fail")
 	}
 
-	if CreateShelobStatus(createConfig("testing", time.Now().Add(-1*time.Hour), 0, false, false)).Ok {
+	if statusAfter(createConfig("testing", 0, false, false), time.Hour).Ok {
 		t.Error("Expected status=fail")
 	}
 
-	if CreateShelobStatus(createConfig("testing", time.Now().Add(-1*time.Second), 5, false, false)).Ok {
+	if statusAfter(createConfig("testing", 5, false, false), time.Second).Ok {
 		t.Error("Expected status=fail")
 	}
 
-	if CreateShelobStatus(createConfig("testing", time.Now().Add(-1*time.Hour), 0, true, false)).Ok {
+	if statusAfter(createConfig("testing", 0, true, false), time.Hour).Ok {
 		t.Error("Expected status=fail")
 	}
 
-	if CreateShelobStatus(createConfig("testing", time.Now().Add(-1*time.Second), 5, true, false)).Ok {
+	if statusAfter(createConfig("testing", 5, true, false), time.Second).Ok {
 		t.Error("Expected status=fail")
 	}
+
+	config := createConfig("testing", 5, false, true)
+	if status := CreateShelobStatus(config); !status.Ok || !status.LastUpdate.Equal(config.RoutingTable().Built) {
+		t.Errorf("Expected last update to be the time the routing table was published, got %+v", status)
+	}
+}
+
+func TestCreateShelobStatusUpdateFailure(t *testing.T) {
+	config := createConfig("testing", 0, false, true)
+	config.SetUpdateFailure(errors.New("timeout waiting for Kubernetes"), 3)
+
+	status := CreateShelobStatus(config)
+	if status.ConsecutiveErrors != 3 || status.LastError != "timeout waiting for Kubernetes" {
+		t.Errorf("Expected update failure in status, got %+v", status)
+	}
+
+	config.ClearUpdateFailure()
+	if status := CreateShelobStatus(config); status.ConsecutiveErrors != 0 || status.LastError != "" {
+		t.Errorf("Expected no update failure in status, got %+v", status)
+	}
 }
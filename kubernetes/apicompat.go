@@ -5,23 +5,23 @@ import (
 )
 
 type IngressCompat struct {
-	v1      *networkingv1.Ingress
+	v1 *networkingv1.Ingress
 }
 
 type IngressRuleCompat struct {
-	v1      *networkingv1.IngressRule
+	v1 *networkingv1.IngressRule
 }
 
 type HTTPIngressRuleValueCompat struct {
-	v1      *networkingv1.HTTPIngressRuleValue
+	v1 *networkingv1.HTTPIngressRuleValue
 }
 
 type HTTPIngressPathCompat struct {
-	v1      *networkingv1.HTTPIngressPath
+	v1 *networkingv1.HTTPIngressPath
 }
 
 type IngressBackendCompat struct {
-	v1      *networkingv1.IngressBackend
+	v1 *networkingv1.IngressBackend
 }
 
 func (i IngressCompat) getRules() []IngressRuleCompat {
@@ -50,6 +50,13 @@ func (i IngressCompat) Namespace() string {
 	return ""
 }
 
+func (i IngressCompat) IngressClassName() string {
+	if i.v1 != nil && i.v1.Spec.IngressClassName != nil {
+		return *i.v1.Spec.IngressClassName
+	}
+	return ""
+}
+
 func (r IngressRuleCompat) Host() string {
 	if r.v1 != nil {
 		return r.v1.Host
@@ -97,6 +104,13 @@ func (p HTTPIngressPathCompat) Path() string {
 	return ""
 }
 
+func (p HTTPIngressPathCompat) PathType() string {
+	if p.v1 != nil && p.v1.PathType != nil {
+		return string(*p.v1.PathType)
+	}
+	return ""
+}
+
 func (b IngressBackendCompat) ServiceName() string {
 	if b.v1 != nil && b.v1.Service != nil {
 		return b.v1.Service.Name
@@ -111,6 +125,13 @@ func (b IngressBackendCompat) ServicePort() int {
 	return 0
 }
 
+func (b IngressBackendCompat) ServicePortName() string {
+	if b.v1 != nil && b.v1.Service != nil {
+		return b.v1.Service.Port.Name
+	}
+	return ""
+}
+
 func (p HTTPIngressPathCompat) Backend() *IngressBackendCompat {
 	if p.v1 != nil {
 		return &IngressBackendCompat{
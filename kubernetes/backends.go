@@ -2,18 +2,29 @@ package kubernetes
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math"
+	"net"
+	"net/http"
 	"net/url"
+	"regexp"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/dbcdk/shelob/util"
-	"github.com/vulcand/oxy/forward"
 	"go.uber.org/zap"
 	apicorev1 "k8s.io/api/core/v1"
+	apidiscoveryv1 "k8s.io/api/discovery/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	machinerymetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	clientcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	clientdiscoveryv1 "k8s.io/client-go/kubernetes/typed/discovery/v1"
 	clientnetworkingv1 "k8s.io/client-go/kubernetes/typed/networking/v1"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/oidc"
 )
@@ -24,16 +35,65 @@ const (
 	RESPONSE_CODE_ANNOTATION     = "shelob.response.code"
 	RESPONSE_TEXT_ANNOTATION     = "shelob.response.text"
 	PLAIN_HTTP_POLICY_ANNOTATION = "shelob.plain.http.policy"
+	CANARY_SERVICES_ANNOTATION   = "shelob.canary.services"
+	ROUTING_RULES_ANNOTATION     = "shelob.routing.rules"
+	AFFINITY_ANNOTATION          = "shelob.affinity"
+	AFFINITY_COOKIE_ANNOTATION   = "shelob.affinity.cookie.name"
+	AFFINITY_TTL_ANNOTATION      = "shelob.affinity.cookie.ttl"
+	AFFINITY_FALLBACK_ANNOTATION = "shelob.affinity.fallback"
+	DEFAULT_AFFINITY_COOKIE      = "shelob-affinity"
+	BALANCER_ANNOTATION          = "shelob.balancer"
+	BALANCER_HASH_KEY_ANNOTATION = "shelob.balancer.hash.key"
+	HEALTH_PATH_ANNOTATION       = "shelob.health.path"
+	HEALTH_INTERVAL_ANNOTATION   = "shelob.health.interval"
+	HEALTH_TIMEOUT_ANNOTATION    = "shelob.health.timeout"
+	HEALTH_HEALTHY_ANNOTATION    = "shelob.health.healthy.threshold"
+	HEALTH_UNHEALTHY_ANNOTATION  = "shelob.health.unhealthy.threshold"
+	OUTLIER_ERRORS_ANNOTATION    = "shelob.outlier.consecutive.errors"
+	OUTLIER_EJECTION_ANNOTATION  = "shelob.outlier.ejection.time"
+	OUTLIER_PERCENT_ANNOTATION   = "shelob.outlier.max.ejection.percent"
+	RETRY_ATTEMPTS_ANNOTATION    = "shelob.retry.attempts"
+	RETRY_ON_ANNOTATION          = "shelob.retry.on"
+	RETRY_METHODS_ANNOTATION     = "shelob.retry.methods"
+	RETRY_BUDGET_ANNOTATION      = "shelob.retry.budget"
+	BREAKER_ERRORS_ANNOTATION    = "shelob.breaker.error.percent"
+	BREAKER_LATENCY_ANNOTATION   = "shelob.breaker.latency"
+	BREAKER_REQUESTS_ANNOTATION  = "shelob.breaker.min.requests"
+	BREAKER_WINDOW_ANNOTATION    = "shelob.breaker.window"
+	BREAKER_OPEN_ANNOTATION      = "shelob.breaker.open.time"
+	BREAKER_PROBES_ANNOTATION    = "shelob.breaker.probes"
+	BREAKER_REDIRECT_ANNOTATION  = "shelob.breaker.fallback.url"
+	BREAKER_CODE_ANNOTATION      = "shelob.breaker.fallback.code"
+	BREAKER_TEXT_ANNOTATION      = "shelob.breaker.fallback.text"
+	TIMEOUT_CONNECT_ANNOTATION   = "shelob.timeout.connect"
+	TIMEOUT_HEADER_ANNOTATION    = "shelob.timeout.response.header"
+	TIMEOUT_IDLE_ANNOTATION      = "shelob.timeout.idle"
+	TIMEOUT_TOTAL_ANNOTATION     = "shelob.timeout.total"
+	RATE_LIMIT_ANNOTATION        = "shelob.ratelimit.rps"
+	RATE_LIMIT_BURST_ANNOTATION  = "shelob.ratelimit.burst"
+	RATE_LIMIT_KEY_ANNOTATION    = "shelob.ratelimit.key"
+	BACKEND_PROTOCOL_ANNOTATION  = "shelob.backend.protocol"
+	BACKEND_CA_ANNOTATION        = "shelob.backend.ca"
+	BACKEND_SNI_ANNOTATION       = "shelob.backend.server.name"
+	BACKEND_CERT_ANNOTATION      = "shelob.backend.client.cert"
+	TLS_PASSTHROUGH_ANNOTATION   = "shelob.tls.passthrough"
+	INGRESS_CLASS_ANNOTATION     = "kubernetes.io/ingress.class"
 )
 
-func UpdateFrontends(config *util.Config) (map[string]*util.Frontend, error) {
+// ListFrontends builds all frontends from full LISTs against the kubernetes api, used when the watch-api is disabled
+func ListFrontends(config *util.Config) (map[string]*util.Frontend, error) {
 
 	clients, err := GetKubeClient(config.Kubeconfig)
 	if err != nil {
 		return nil, err
 	}
 
-	v1ingresses, err := getIngressesv1(clients.NetworkingV1().Ingresses(""))
+	isDefaultClass, err := isDefaultIngressClass(clients.NetworkingV1().IngressClasses(), config.IngressClass)
+	if err != nil {
+		return nil, err
+	}
+
+	v1ingresses, err := getIngressesv1(clients.NetworkingV1().Ingresses(""), config.IngressClass, isDefaultClass)
 	if err != nil {
 		return nil, err
 	}
@@ -48,58 +108,381 @@ func UpdateFrontends(config *util.Config) (map[string]*util.Frontend, error) {
 		return nil, err
 	}
 
-	endpoints, err := getEndpoints(clients.CoreV1().Endpoints(""))
+	endpoints, err := getEndpoints(clients.DiscoveryV1().EndpointSlices(""))
 	if err != nil {
 		return nil, err
 	}
 
-	return mergeFrontends(config.Forwarder, ingresses, services, endpoints), nil
+	var source tlsSource
+	if config.BackendTLSSources {
+		source = clientTLSSource{clients.CoreV1()}
+	}
+
+	return mergeFrontends(config, config.RoutingTable().Frontends, ingresses, services, endpoints, source), nil
 }
 
-func mergeFrontends(forwarder *forward.Forwarder, ingresses map[HostMatch]Ingress, services map[PortMatch]Service, endpoints map[Object][]Endpoint) map[string]*util.Frontend {
+// mergeFrontends builds the frontends of the given ingresses. Routes found in the previous frontends with the same
+// balancing keep their balancer, which is updated in place when the frontends are published so in-flight counters,
+// latencies and order survive reloads.
+// The CA bundles and client certificates of https backends are read from source, which is nil when disabled
+func mergeFrontends(config *util.Config, previous map[string]*util.Frontend, ingresses map[HostMatch]Ingress, services map[PortMatch]Service, endpoints map[Object][]Endpoint, source tlsSource) map[string]*util.Frontend {
+	// several ingresses may contribute paths to the same host, iterate in a stable order so conflicts resolve the same way every reload
+	keys := make([]HostMatch, 0, len(ingresses))
+	for n := range ingresses {
+		keys = append(keys, n)
+	}
+	sort.Slice(keys, func(a, b int) bool {
+		if keys[a].Object.Namespace != keys[b].Object.Namespace {
+			return keys[a].Object.Namespace < keys[b].Object.Namespace
+		}
+		if keys[a].Object.Name != keys[b].Object.Name {
+			return keys[a].Object.Name < keys[b].Object.Name
+		}
+		return keys[a].Kind < keys[b].Kind
+	})
+
 	frontends := make(map[string]*util.Frontend)
-	for n, i := range ingresses {
+	for _, n := range keys {
+		i := ingresses[n]
+		frontend, exists := frontends[n.HostName]
 		if i.Intercept != nil {
+			if exists && len(frontend.Routes) > 0 {
+				log.Warn("Intercept of ingress overrides the paths of other ingresses for host",
+					zap.String("name", n.Object.Name),
+					zap.String("namespace", n.Object.Namespace),
+					zap.String("host", n.HostName),
+				)
+			}
 			frontends[n.HostName] = &util.Frontend{
 				Action:          i.Intercept.Action,
 				PlainHTTPPolicy: i.PlainHTTPPolicy,
 				Intercept:       i.Intercept,
 				Backends:        []util.Backend{},
-				RR:              nil,
+				Routes:          []*util.Route{},
+				RateLimiter:     rateLimiter(previous[n.HostName], i.RateLimit),
 			}
-		} else {
-			backends := toBackendList(i.Scheme, services[PortMatch{Object: n.Object, Port: i.Port}], endpoints[n.Object])
-			frontends[n.HostName] = &util.Frontend{
-				Action:          util.BACKEND_ACTION_PROXY_RR,
+			continue
+		}
+		if !exists {
+			var action uint16 = util.BACKEND_ACTION_PROXY_RR
+			if i.Passthrough {
+				action = util.BACKEND_ACTION_PASSTHROUGH
+			}
+			frontend = &util.Frontend{
+				Action:          action,
 				PlainHTTPPolicy: i.PlainHTTPPolicy,
 				Intercept:       nil,
-				Backends:        backends,
-				RR:              util.CreateRR(forwarder, backends),
+				Backends:        []util.Backend{},
+				Routes:          []*util.Route{},
+				RateLimiter:     rateLimiter(previous[n.HostName], i.RateLimit),
+			}
+			frontends[n.HostName] = frontend
+		} else if frontend.Intercept != nil {
+			log.Warn("Ignoring paths of ingress for intercepted host",
+				zap.String("name", n.Object.Name),
+				zap.String("namespace", n.Object.Namespace),
+				zap.String("host", n.HostName),
+			)
+			continue
+		} else if !sameRateLimit(frontend.RateLimiter, i.RateLimit) {
+			// the rate limit applies to the whole host, the ingresses sharing a host cannot each have their own
+			log.Warn("Ignoring rate limit of ingress, the host is limited by the first of its ingresses",
+				zap.String("name", n.Object.Name),
+				zap.String("namespace", n.Object.Namespace),
+				zap.String("host", n.HostName),
+			)
+		}
+
+		backendTLS := resolveBackendTLS(config, source, n, i.BackendTLS)
+		for _, p := range i.Paths {
+			if hasRoute(frontend, p) {
+				log.Warn("Ignoring duplicate ingress path for host",
+					zap.String("name", n.Object.Name),
+					zap.String("namespace", n.Object.Namespace),
+					zap.String("host", n.HostName),
+					zap.String("path", p.Path),
+				)
+				continue
+			}
+			split := make([][]util.Backend, 0, len(p.Services))
+			for _, ref := range p.Services {
+				service := Object{Name: ref.Name, Namespace: n.Object.Namespace}
+				split = append(split, toBackendList(i.Scheme, services[PortMatch{Object: service, Port: ref.Port, Name: ref.PortName}], endpoints[service]))
+			}
+			balancing := i.Balancing
+			if len(p.Services) > 1 {
+				weighBackends(split, p.Services)
+				if balancing.Algorithm == util.BALANCER_ROUND_ROBIN {
+					// the oxy round robin serves the lowest weights at the end of its cycle only
+					balancing.Algorithm = util.BALANCER_WEIGHTED_ROUND_ROBIN
+				}
+			}
+			backends := slices.Concat(split...)
+			route := &util.Route{
+				Path:             p.Path,
+				PathType:         p.PathType,
+				Matches:          p.Matches,
+				Backends:         backends,
+				Affinity:         i.Affinity,
+				Balancing:        balancing,
+				OutlierDetection: i.OutlierDetection,
+				Retry:            i.Retry,
+				CircuitBreaker:   i.CircuitBreaker,
+				Timeouts:         i.Timeouts,
+				Protocol:         i.Protocol,
+				TLS:              backendTLS,
+			}
+			if config.HealthChecker != nil {
+				route.HealthCheck = i.HealthCheck
+			}
+			if prev := previousRoute(previous[n.HostName], p); prev != nil && prev.Balancing == route.Balancing && prev.Protocol == route.Protocol && sameAffinity(prev.Affinity, route.Affinity) &&
+				sameHealthCheck(prev.HealthCheck, route.HealthCheck) && sameOutlierDetection(prev.OutlierDetection, route.OutlierDetection) &&
+				sameRetryPolicy(prev.Retry, route.Retry) && sameCircuitBreaker(prev.CircuitBreaker, route.CircuitBreaker) && prev.TLS.Equal(route.TLS) {
+				// the balancer refers to the tls config of the previous route, and is updated when the route is published
+				route.TLS = prev.TLS
+				route.KeepBalancer(prev)
+			} else {
+				sticky, err := route.StickySession(config.AffinityKey)
+				if err != nil {
+					log.Warn("Ignoring affinity of ingress path",
+						zap.String("name", n.Object.Name),
+						zap.String("namespace", n.Object.Namespace),
+						zap.String("host", n.HostName),
+						zap.String("error", err.Error()),
+					)
+					route.Affinity = nil
+				}
+				route.Sticky = sticky
+				route.SetBalancer(createBalancer(config, n.HostName, route, backends))
 			}
+			frontend.Routes = append(frontend.Routes, route)
+			frontend.Backends = append(frontend.Backends, backends...)
 		}
 	}
 
+	for _, frontend := range frontends {
+		util.SortRoutes(frontend.Routes)
+	}
+
 	return frontends
 }
 
+// createBalancer creates the balancer of a route, guarded by health checks and outlier detection and wrapped by the
+// retry policy and circuit breaker when enabled
+func createBalancer(config *util.Config, host string, route *util.Route, backends []util.Backend) util.Balancer {
+	var next http.Handler = config.Forwarder
+	if route.Protocol != util.BACKEND_PROTOCOL_HTTP1 {
+		next = util.WithProtocol(next, route.Protocol)
+	}
+	if route.TLS != nil {
+		next = util.WithBackendTLS(next, route.TLS)
+	}
+	var detector *util.OutlierDetector
+	if route.OutlierDetection != nil {
+		detector = util.NewOutlierDetector(*route.OutlierDetection, host, &config.Counters)
+		next = detector.Observe(next)
+	}
+
+	balancer := util.CreateBalancer(next, route.Balancing, backends, route.Sticky)
+	if route.HealthCheck != nil || detector != nil {
+		balancer = util.GuardBalancer(balancer, route, config.HealthChecker, detector)
+	}
+	if route.Retry != nil {
+		balancer = util.RetryBalancer(balancer, *route.Retry, host, &config.Counters)
+	}
+	if route.CircuitBreaker != nil {
+		balancer = util.BreakBalancer(balancer, route, host, &config.Counters)
+	}
+	return balancer
+}
+
+// rateLimiter returns the rate limiter of the previous frontend when its limit is unchanged, so the buckets of clients
+// survive reloads
+func rateLimiter(previous *util.Frontend, limit *util.RateLimit) *util.RateLimiter {
+	if limit == nil {
+		return nil
+	}
+	if previous != nil && previous.RateLimiter != nil && previous.RateLimiter.Limit() == *limit {
+		return previous.RateLimiter
+	}
+	return util.NewRateLimiter(*limit)
+}
+
+func sameRateLimit(limiter *util.RateLimiter, limit *util.RateLimit) bool {
+	if limiter == nil || limit == nil {
+		return limiter == nil && limit == nil
+	}
+	return limiter.Limit() == *limit
+}
+
+func hasRoute(frontend *util.Frontend, path IngressPath) bool {
+	return previousRoute(frontend, path) != nil
+}
+
+// previousRoute returns the route of the frontend with the same path and request matches
+func previousRoute(frontend *util.Frontend, path IngressPath) *util.Route {
+	if frontend == nil {
+		return nil
+	}
+	for _, r := range frontend.Routes {
+		if r.Path == path.Path && r.PathType == path.PathType && sameMatches(r.Matches, path.Matches) {
+			return r
+		}
+	}
+	return nil
+}
+
+func sameAffinity(a *util.Affinity, b *util.Affinity) bool {
+	return a == b || (a != nil && b != nil && *a == *b)
+}
+
+func sameHealthCheck(a *util.HealthCheck, b *util.HealthCheck) bool {
+	return a == b || (a != nil && b != nil && *a == *b)
+}
+
+func sameRetryPolicy(a *util.RetryPolicy, b *util.RetryPolicy) bool {
+	return a == b || (a != nil && b != nil && a.Attempts == b.Attempts && a.ConnectFailure == b.ConnectFailure &&
+		a.ServerErrors == b.ServerErrors && slices.Equal(a.StatusCodes, b.StatusCodes) && a.AllMethods == b.AllMethods &&
+		a.Budget == b.Budget)
+}
+
+func sameCircuitBreaker(a *util.CircuitBreaker, b *util.CircuitBreaker) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	x, y := *a, *b
+	x.Fallback, y.Fallback = nil, nil
+	return x == y && sameIntercept(a.Fallback, b.Fallback)
+}
+
+func sameIntercept(a *util.Intercept, b *util.Intercept) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Code == b.Code && a.ResponseText == b.ResponseText && a.Action == b.Action &&
+		(a.Url == b.Url || (a.Url != nil && b.Url != nil && a.Url.String() == b.Url.String()))
+}
+
+func sameOutlierDetection(a *util.OutlierDetection, b *util.OutlierDetection) bool {
+	return a == b || (a != nil && b != nil && *a == *b)
+}
+
+func sameMatches(a []util.RequestMatch, b []util.RequestMatch) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for n := range a {
+		if a[n].Source != b[n].Source || a[n].Name != b[n].Name || a[n].Value != b[n].Value || (a[n].Regexp == nil) != (b[n].Regexp == nil) {
+			return false
+		}
+	}
+	return true
+}
+
+// weighBackends spreads the weight of each service evenly over its endpoints, so each service receives its share of
+// the traffic regardless of the number of endpoints. The endpoint weights are exact, and reduced by their greatest
+// common divisor to keep them small
+func weighBackends(split [][]util.Backend, refs []ServiceRef) {
+	multiple := 1
+	for _, backends := range split {
+		if len(backends) > 0 {
+			multiple = multiple / gcd(multiple, len(backends)) * len(backends)
+		}
+	}
+
+	divisor := 0
+	for n, backends := range split {
+		for m := range backends {
+			backends[m].Weight = refs[n].Weight * multiple / len(backends)
+			divisor = gcd(divisor, backends[m].Weight)
+		}
+	}
+	for _, backends := range split {
+		for m := range backends {
+			backends[m].Weight /= divisor
+		}
+	}
+}
+
+func gcd(a int, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
 func toBackendList(scheme string, service Service, endpoints []Endpoint) []util.Backend {
-	backends := make([]util.Backend, 0)
+	matching := make([]Endpoint, 0)
 	for _, e := range endpoints {
-		if e.Port == service.TargetPort {
-			backends = append(backends, util.Backend{
-				Url: &url.URL{
-					Scheme: scheme,
-					Host:   e.Address + ":" + strconv.FormatInt(int64(e.Port), 10),
-				},
-			})
+		// named target ports are resolved per pod, endpoints carry the resolved port under the name of the service port
+		if (service.TargetPortName != "" && e.PortName == service.Name) || (service.TargetPortName == "" && e.Port == service.TargetPort) {
+			matching = append(matching, e)
+		}
+	}
+	family := ipFamily(service, matching)
+
+	ready := make([]Endpoint, 0)
+	terminating := make([]Endpoint, 0)
+	seen := make(map[string]bool)
+	for _, e := range matching {
+		// a dual-stack service has a slice per address family, only one family is used so every pod is a single backend
+		if e.IPFamily != family {
+			continue
+		}
+		// an endpoint may briefly be listed in more than one slice while it moves between them
+		key := e.Pod
+		if key == "" {
+			key = net.JoinHostPort(e.Address, strconv.FormatInt(int64(e.Port), 10))
 		}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		if e.Ready {
+			ready = append(ready, e)
+		} else if e.Serving && e.Terminating {
+			terminating = append(terminating, e)
+		}
+	}
+
+	// like kube-proxy, fall back to endpoints that are still serving while terminating when no endpoint is ready
+	selected := ready
+	if len(selected) == 0 {
+		selected = terminating
+	}
+
+	backends := make([]util.Backend, 0)
+	for _, e := range selected {
+		backends = append(backends, util.Backend{
+			Url: &url.URL{
+				Scheme: scheme,
+				Host:   net.JoinHostPort(e.Address, strconv.FormatInt(int64(e.Port), 10)),
+			},
+		})
 	}
 
 	return backends
 }
 
+// ipFamily returns the address family of the endpoints of a service to use, the preferred family of the service unless
+// it has no endpoints of that family. IPv4 is preferred otherwise, so the choice does not depend on the order of slices
+func ipFamily(service Service, endpoints []Endpoint) string {
+	family := ""
+	for _, e := range endpoints {
+		if e.IPFamily == service.IPFamily {
+			return e.IPFamily
+		}
+		if family == "" || e.IPFamily < family {
+			family = e.IPFamily
+		}
+	}
+	return family
+}
+
 func getServices(client clientcorev1.ServiceInterface) (map[PortMatch]Service, error) {
-	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 	services, err := client.List(ctx, machinerymetav1.ListOptions{})
 	if err != nil {
 		return nil, err
@@ -117,25 +500,35 @@ func getServices(client clientcorev1.ServiceInterface) (map[PortMatch]Service, e
 
 func mapService(service apicorev1.Service) map[PortMatch]Service {
 	out := make(map[PortMatch]Service)
+	object := Object{
+		Name:      service.Name,
+		Namespace: service.Namespace,
+	}
 	for _, s := range service.Spec.Ports {
 		var sourcePort, targetPort uint16
+		var targetPortName string
 		sourcePort, _ = i32toPort(s.Port)
-		if _, err := i32toPort(s.TargetPort.IntVal); err == nil {
+		if s.TargetPort.Type == intstr.String && s.TargetPort.StrVal != "" {
+			targetPortName = s.TargetPort.StrVal
+		} else if _, err := i32toPort(s.TargetPort.IntVal); err == nil {
 			targetPort, _ = i32toPort(s.TargetPort.IntVal)
 		} else {
 			targetPort = sourcePort
 		}
 
-		if sourcePort > 0 && targetPort > 0 {
-			out[PortMatch{
-				Object: Object{
-					Name:      service.Name,
-					Namespace: service.Namespace,
-				},
-				Port: sourcePort,
-			}] = Service{
-				Port:       uint16(s.Port),
-				TargetPort: targetPort,
+		if sourcePort > 0 && (targetPort > 0 || targetPortName != "") {
+			mapped := Service{
+				Name:           s.Name,
+				Port:           sourcePort,
+				TargetPort:     targetPort,
+				TargetPortName: targetPortName,
+			}
+			if len(service.Spec.IPFamilies) > 0 {
+				mapped.IPFamily = string(service.Spec.IPFamilies[0])
+			}
+			out[PortMatch{Object: object, Port: sourcePort}] = mapped
+			if s.Name != "" {
+				out[PortMatch{Object: object, Name: s.Name}] = mapped
 			}
 		}
 	}
@@ -143,23 +536,65 @@ func mapService(service apicorev1.Service) map[PortMatch]Service {
 	return out
 }
 
-func getEndpoints(client clientcorev1.EndpointsInterface) (map[Object][]Endpoint, error) {
-	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
-	endpoints, err := client.List(ctx, machinerymetav1.ListOptions{})
+func getEndpoints(client clientdiscoveryv1.EndpointSliceInterface) (map[Object][]Endpoint, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	slices, err := client.List(ctx, machinerymetav1.ListOptions{
+		LabelSelector: apidiscoveryv1.LabelServiceName,
+	})
 	if err != nil {
 		return nil, err
 	}
 
+	// a service may be backed by several slices, e.g. one per address family or when exceeding the slice size limit
 	out := make(map[Object][]Endpoint)
-	for _, e := range endpoints.Items {
-		out[Object{Name: e.Name, Namespace: e.Namespace}] = mapEndpoint(e)
+	for _, e := range slices.Items {
+		service := Object{Name: e.Labels[apidiscoveryv1.LabelServiceName], Namespace: e.Namespace}
+		out[service] = append(out[service], mapEndpointSlice(e)...)
 	}
 
 	return out, nil
 }
 
-func getIngressesv1(client clientnetworkingv1.IngressInterface) (map[HostMatch]Ingress, error) {
-	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+func isDefaultIngressClass(client clientnetworkingv1.IngressClassInterface, className string) (bool, error) {
+	if className == "" {
+		return false, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	class, err := client.Get(ctx, className, machinerymetav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		log.Warn("IngressClass not found, only ingresses explicitly referring to it will be handled",
+			zap.String("ingressClass", className))
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return class.Annotations[networkingv1.AnnotationIsDefaultIngressClass] == "true", nil
+}
+
+// ownsIngress decides whether an ingress belongs to the given class, ingresses without a class belong to the default class.
+// An empty class name owns every ingress
+func ownsIngress(in IngressCompat, className string, isDefaultClass bool) bool {
+	if className == "" {
+		return true
+	}
+
+	if class := in.IngressClassName(); class != "" {
+		return class == className
+	}
+	if class, present := in.getOptionalAnnotation(INGRESS_CLASS_ANNOTATION); present {
+		return class == className
+	}
+
+	return isDefaultClass
+}
+
+func getIngressesv1(client clientnetworkingv1.IngressInterface, className string, isDefaultClass bool) (map[HostMatch]Ingress, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 	ingresses, err := client.List(ctx, machinerymetav1.ListOptions{})
 	if err != nil {
 		return nil, err
@@ -168,32 +603,65 @@ func getIngressesv1(client clientnetworkingv1.IngressInterface) (map[HostMatch]I
 	out := make(map[HostMatch]Ingress)
 	for _, i := range ingresses.Items {
 		in := IngressCompat{
-			v1:      &i,
+			v1: &i,
+		}
+		if !ownsIngress(in, className, isDefaultClass) {
+			log.Debug("Ignoring ingress of foreign IngressClass",
+				zap.String("name", in.Name()),
+				zap.String("namespace", in.Namespace()))
+			continue
 		}
-		for host, backend := range mapIngress(in) {
+		for host, ingress := range mapIngress(in) {
 			out[HostMatch{
-				Object:   Object{Name: backend.Name, Namespace: i.Namespace},
+				Kind:     KIND_INGRESS,
+				Object:   Object{Name: i.Name, Namespace: i.Namespace},
 				HostName: host,
-			}] = backend
+			}] = ingress
 		}
 	}
 
 	return out, nil
 }
 
-func mapEndpoint(in apicorev1.Endpoints) []Endpoint {
+func mapEndpointSlice(in apidiscoveryv1.EndpointSlice) []Endpoint {
 	out := make([]Endpoint, 0)
-	for _, s := range in.Subsets {
-		for _, p := range s.Ports {
-			if p.Protocol == apicorev1.ProtocolTCP {
-				if _, err := i32toPort(p.Port); err == nil {
-					for _, a := range s.Addresses {
-						out = append(out, Endpoint{
-							Address: a.IP,
-							Port:    uint16(p.Port),
-						})
-					}
-				}
+	if in.AddressType != apidiscoveryv1.AddressTypeIPv4 && in.AddressType != apidiscoveryv1.AddressTypeIPv6 {
+		return out
+	}
+
+	for _, p := range in.Ports {
+		if p.Port == nil || (p.Protocol != nil && *p.Protocol != apicorev1.ProtocolTCP) {
+			continue
+		}
+		port, err := i32toPort(*p.Port)
+		if err != nil {
+			continue
+		}
+		var portName string
+		if p.Name != nil {
+			portName = *p.Name
+		}
+
+		for _, e := range in.Endpoints {
+			// a nil condition means unknown, which consumers should interpret as ready/serving
+			ready := e.Conditions.Ready == nil || *e.Conditions.Ready
+			serving := e.Conditions.Serving == nil || *e.Conditions.Serving
+			terminating := e.Conditions.Terminating != nil && *e.Conditions.Terminating
+			var pod string
+			if e.TargetRef != nil && e.TargetRef.Kind == "Pod" {
+				pod = e.TargetRef.Name
+			}
+			for _, a := range e.Addresses {
+				out = append(out, Endpoint{
+					Address:     a,
+					Port:        port,
+					PortName:    portName,
+					IPFamily:    string(in.AddressType),
+					Pod:         pod,
+					Ready:       ready,
+					Serving:     serving,
+					Terminating: terminating,
+				})
 			}
 		}
 	}
@@ -203,34 +671,81 @@ func mapEndpoint(in apicorev1.Endpoints) []Endpoint {
 
 func mapIngress(in IngressCompat) map[string]Ingress {
 	out := make(map[string]Ingress)
+	intercept := mapIntercept(in)
+	canaries := mapCanaries(in)
+	rules := mapRoutingRules(in)
+	affinity := mapAffinity(in)
+	balancing := mapBalancing(in)
+	healthCheck := mapHealthCheck(in)
+	outlierDetection := mapOutlierDetection(in)
+	retry := mapRetryPolicy(in)
+	breaker := mapCircuitBreaker(in)
+	timeouts := mapTimeouts(in)
+	rateLimit := mapRateLimit(in)
+	scheme, protocol := mapBackendProtocol(in)
+	backendTLS := mapBackendTLS(in, scheme)
+	// tls connections of passthrough hosts are spliced to their backends without terminating tls, paths and routing rules
+	// are ignored but canary weights are honoured
+	passthrough := in.getAnnotation(TLS_PASSTHROUGH_ANNOTATION) == "true"
 
 	for _, r := range in.getRules() {
-		//find suitable path target (we only support / for now)
-		var backend *Ingress
-		if r.Http() != nil {
+		if r.Host() == "" {
+			log.Debug("Ignoring ingress rule with no hostname",
+				zap.String("name", in.Name()),
+				zap.String("namespace", in.Namespace()))
+			continue
+		}
+
+		// the same host may be listed in several rules of one ingress
+		ingress, exists := out[r.Host()]
+		if !exists {
+			ingress = Ingress{
+				Scheme:           scheme,
+				Protocol:         protocol,
+				BackendTLS:       backendTLS,
+				Passthrough:      passthrough,
+				Intercept:        intercept,
+				PlainHTTPPolicy:  mapPlainHTTPPolicy(in),
+				Affinity:         affinity,
+				Balancing:        balancing,
+				HealthCheck:      healthCheck,
+				OutlierDetection: outlierDetection,
+				Retry:            retry,
+				CircuitBreaker:   breaker,
+				Timeouts:         timeouts,
+				RateLimit:        rateLimit,
+				Paths:            []IngressPath{},
+			}
+		}
+
+		if intercept == nil && r.Http() != nil {
 			for _, p := range r.Http().Paths() {
-				if p.Backend() != nil && (p.Path() == "" || p.Path() == "/") {
-					backend = mapBackend(in, *p.Backend())
+				if path := mapBackend(in, p); path != nil {
+					ingress.Paths = append(ingress.Paths, withRoutingRules(*path, rules)...)
+					path.Services = withCanaries(path.Services[0], canaries)
+					ingress.Paths = append(ingress.Paths, *path)
 				}
 			}
 		}
 
-		intercept := mapIntercept(in)
-		if r.Host() != "" && intercept != nil {
-			out[r.Host()] = Ingress{
-				Scheme:          "http",
-				Name:            r.Host(),
-				Port:            80,
-				Intercept:       intercept,
-				PlainHTTPPolicy: mapPlainHTTPPolicy(in),
-			}
-		} else if r.Host() != "" && backend != nil {
-			out[r.Host()] = *backend
-		} else {
-			log.Debug("Ignoring ingress rule with no hostname, suitable backend, catch-all path or rule for /",
+		if intercept == nil && len(ingress.Paths) == 0 {
+			log.Debug("Ignoring ingress rule with no suitable backend",
 				zap.String("name", in.Name()),
 				zap.String("namespace", in.Namespace()),
 				zap.String("host", r.Host()))
+			continue
+		}
+		out[r.Host()] = ingress
+	}
+
+	if passthrough {
+		for host, ingress := range out {
+			if len(rules) > 0 || len(ingress.Paths) > 1 || (len(ingress.Paths) == 1 && ingress.Paths[0].Path != "/") {
+				log.Warn("Ignoring paths and routing rules of passthrough ingress, connections are spliced to the backends of a single path",
+					zap.String("name", in.Name()),
+					zap.String("namespace", in.Namespace()),
+					zap.String("host", host))
+			}
 		}
 	}
 
@@ -251,6 +766,368 @@ func mapPlainHTTPPolicy(in IngressCompat) uint16 {
 	}
 }
 
+// mapAffinity enables sticky sessions when the affinity annotation is set to 'cookie'. The TTL of the cookie is given
+// in seconds (0=session cookie), and the fallback is either 'rebalance' (default) or 'reject'
+func mapAffinity(in IngressCompat) *util.Affinity {
+	if in.getAnnotation(AFFINITY_ANNOTATION) != "cookie" {
+		return nil
+	}
+
+	affinity := &util.Affinity{
+		CookieName: DEFAULT_AFFINITY_COOKIE,
+		Fallback:   util.AFFINITY_FALLBACK_REBALANCE,
+	}
+	if name, present := in.getOptionalAnnotation(AFFINITY_COOKIE_ANNOTATION); present && name != "" {
+		affinity.CookieName = name
+	}
+	if _ttl, present := in.getOptionalAnnotation(AFFINITY_TTL_ANNOTATION); present {
+		ttl, err := strconv.ParseInt(_ttl, 10, 32)
+		if err == nil && ttl >= 0 {
+			affinity.TTL = time.Duration(ttl) * time.Second
+		} else {
+			log.Warn("Ignoring invalid affinity cookie TTL",
+				zap.String("name", in.Name()),
+				zap.String("namespace", in.Namespace()),
+				zap.String("ttl", _ttl))
+		}
+	}
+	if in.getAnnotation(AFFINITY_FALLBACK_ANNOTATION) == "reject" {
+		affinity.Fallback = util.AFFINITY_FALLBACK_REJECT
+	}
+
+	return affinity
+}
+
+// mapBalancing selects the balancer of an ingress, one of 'round-robin' (default), 'least-request', 'peak-ewma' or
+// 'hash'. Consistent hashing uses the key given as 'ip' (default), 'path', 'header:<name>' or 'cookie:<name>'
+func mapBalancing(in IngressCompat) util.Balancing {
+	balancing := util.Balancing{Algorithm: util.BALANCER_ROUND_ROBIN}
+
+	switch _algorithm := in.getAnnotation(BALANCER_ANNOTATION); _algorithm {
+	case "", "round-robin":
+	case "least-request":
+		balancing.Algorithm = util.BALANCER_LEAST_REQUEST
+	case "peak-ewma":
+		balancing.Algorithm = util.BALANCER_PEAK_EWMA
+	case "hash":
+		balancing.Algorithm = util.BALANCER_HASH
+	default:
+		log.Warn("Ignoring unknown balancer, using round robin",
+			zap.String("name", in.Name()),
+			zap.String("namespace", in.Namespace()),
+			zap.String("balancer", _algorithm))
+	}
+
+	if balancing.Algorithm == util.BALANCER_HASH {
+		source, name, _ := strings.Cut(in.getAnnotation(BALANCER_HASH_KEY_ANNOTATION), ":")
+		switch {
+		case source == "" || source == "ip":
+			balancing.HashKey = util.HASH_KEY_CLIENT_IP
+		case source == "path":
+			balancing.HashKey = util.HASH_KEY_PATH
+		case source == "header" && name != "":
+			balancing.HashKey, balancing.HashKeyName = util.HASH_KEY_HEADER, name
+		case source == "cookie" && name != "":
+			balancing.HashKey, balancing.HashKeyName = util.HASH_KEY_COOKIE, name
+		default:
+			log.Warn("Ignoring invalid hash key, hashing on client ip",
+				zap.String("name", in.Name()),
+				zap.String("namespace", in.Namespace()),
+				zap.String("key", in.getAnnotation(BALANCER_HASH_KEY_ANNOTATION)))
+		}
+	}
+
+	return balancing
+}
+
+// mapHealthCheck enables active health checks of the backends when a path is given. Interval and timeout are given in
+// seconds
+func mapHealthCheck(in IngressCompat) *util.HealthCheck {
+	path, present := in.getOptionalAnnotation(HEALTH_PATH_ANNOTATION)
+	if !present || path == "" {
+		return nil
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	return &util.HealthCheck{
+		Path:               path,
+		Interval:           time.Duration(mapPositiveInt(in, HEALTH_INTERVAL_ANNOTATION, 10)) * time.Second,
+		Timeout:            time.Duration(mapPositiveInt(in, HEALTH_TIMEOUT_ANNOTATION, 2)) * time.Second,
+		HealthyThreshold:   mapPositiveInt(in, HEALTH_HEALTHY_ANNOTATION, 2),
+		UnhealthyThreshold: mapPositiveInt(in, HEALTH_UNHEALTHY_ANNOTATION, 3),
+	}
+}
+
+// mapOutlierDetection enables passive outlier detection when the number of consecutive errors is given. The ejection
+// time is given in seconds
+func mapOutlierDetection(in IngressCompat) *util.OutlierDetection {
+	if _, present := in.getOptionalAnnotation(OUTLIER_ERRORS_ANNOTATION); !present {
+		return nil
+	}
+
+	maxEjectionPercent := mapPositiveInt(in, OUTLIER_PERCENT_ANNOTATION, 50)
+	if maxEjectionPercent > 100 {
+		maxEjectionPercent = 100
+	}
+	return &util.OutlierDetection{
+		ConsecutiveErrors:  mapPositiveInt(in, OUTLIER_ERRORS_ANNOTATION, 5),
+		EjectionTime:       time.Duration(mapPositiveInt(in, OUTLIER_EJECTION_ANNOTATION, 30)) * time.Second,
+		MaxEjectionPercent: maxEjectionPercent,
+	}
+}
+
+// mapRetryPolicy enables retries when the number of attempts is given. Requests are retried on the comma separated
+// conditions connect-failure, 5xx or a status code, and only for idempotent methods unless the methods are "all". The
+// budget is the percentage of requests which may be retried
+func mapRetryPolicy(in IngressCompat) *util.RetryPolicy {
+	if _, present := in.getOptionalAnnotation(RETRY_ATTEMPTS_ANNOTATION); !present {
+		return nil
+	}
+
+	policy := &util.RetryPolicy{
+		Attempts: mapPositiveInt(in, RETRY_ATTEMPTS_ANNOTATION, 1),
+		Budget:   mapPositiveInt(in, RETRY_BUDGET_ANNOTATION, 20),
+	}
+
+	on, present := in.getOptionalAnnotation(RETRY_ON_ANNOTATION)
+	if !present {
+		on = "connect-failure"
+	}
+	for _, condition := range strings.Split(on, ",") {
+		switch condition = strings.TrimSpace(condition); condition {
+		case "":
+		case "connect-failure":
+			policy.ConnectFailure = true
+		case "5xx":
+			policy.ServerErrors = true
+		default:
+			code, err := strconv.ParseInt(condition, 10, 16)
+			if err != nil || code < 100 || code > 599 {
+				log.Warn("Ignoring invalid retry condition",
+					zap.String("name", in.Name()),
+					zap.String("namespace", in.Namespace()),
+					zap.String("condition", condition))
+				continue
+			}
+			policy.StatusCodes = append(policy.StatusCodes, int(code))
+		}
+	}
+
+	switch methods := in.getAnnotation(RETRY_METHODS_ANNOTATION); methods {
+	case "", "idempotent":
+	case "all":
+		policy.AllMethods = true
+	default:
+		log.Warn("Ignoring unknown retry methods, retrying idempotent methods only",
+			zap.String("name", in.Name()),
+			zap.String("namespace", in.Namespace()),
+			zap.String("methods", methods))
+	}
+
+	return policy
+}
+
+// mapCircuitBreaker enables a circuit breaker when an error percentage or a latency in milliseconds is given. Window
+// and open time are given in seconds. While open the breaker redirects to the fallback url, or responds with the
+// fallback code and text (503 by default)
+func mapCircuitBreaker(in IngressCompat) *util.CircuitBreaker {
+	_, errors := in.getOptionalAnnotation(BREAKER_ERRORS_ANNOTATION)
+	_, latency := in.getOptionalAnnotation(BREAKER_LATENCY_ANNOTATION)
+	if !errors && !latency {
+		return nil
+	}
+
+	breaker := &util.CircuitBreaker{
+		MinRequests: mapPositiveInt(in, BREAKER_REQUESTS_ANNOTATION, 20),
+		Window:      time.Duration(mapPositiveInt(in, BREAKER_WINDOW_ANNOTATION, 10)) * time.Second,
+		OpenTime:    time.Duration(mapPositiveInt(in, BREAKER_OPEN_ANNOTATION, 30)) * time.Second,
+		Probes:      mapPositiveInt(in, BREAKER_PROBES_ANNOTATION, 3),
+	}
+	if errors {
+		breaker.ErrorPercent = min(mapPositiveInt(in, BREAKER_ERRORS_ANNOTATION, 50), 100)
+	}
+	if latency {
+		breaker.Latency = time.Duration(mapPositiveInt(in, BREAKER_LATENCY_ANNOTATION, 1000)) * time.Millisecond
+	}
+
+	if _redirectUrl, redirect := in.getOptionalAnnotation(BREAKER_REDIRECT_ANNOTATION); redirect {
+		url, err := url.Parse(_redirectUrl)
+		if err != nil {
+			log.Warn("Ignoring invalid circuit breaker fallback url",
+				zap.String("name", in.Name()),
+				zap.String("namespace", in.Namespace()),
+				zap.String("url", _redirectUrl))
+		} else {
+			breaker.Fallback = &util.Intercept{
+				Url:    url,
+				Code:   http.StatusTemporaryRedirect,
+				Action: util.BACKEND_ACTION_REDIRECT,
+			}
+		}
+	} else if _text, text := in.getOptionalAnnotation(BREAKER_TEXT_ANNOTATION); text || in.getAnnotation(BREAKER_CODE_ANNOTATION) != "" {
+		code, err := strconv.ParseInt(in.getAnnotation(BREAKER_CODE_ANNOTATION), 10, 16)
+		if err != nil || code < 400 || code > 599 {
+			code = http.StatusServiceUnavailable
+		}
+		breaker.Fallback = &util.Intercept{
+			Code:         uint16(code),
+			ResponseText: _text,
+			Action:       util.BACKEND_ACTION_RESPOND,
+		}
+	}
+
+	return breaker
+}
+
+// mapBackendProtocol returns the scheme and protocol of the backends, which speak HTTP/1.1 in cleartext unless the
+// protocol is 'https' for HTTP/1.1 over TLS, 'h2c' or 'grpc' for HTTP/2 in cleartext or 'h2' or 'grpcs' for HTTP/2 over
+// TLS
+func mapBackendProtocol(in IngressCompat) (string, uint16) {
+	switch protocol := in.getAnnotation(BACKEND_PROTOCOL_ANNOTATION); protocol {
+	case "", "http":
+	case "https":
+		return "https", util.BACKEND_PROTOCOL_HTTP1
+	case "h2c", "grpc":
+		return "http", util.BACKEND_PROTOCOL_HTTP2
+	case "h2", "grpcs":
+		return "https", util.BACKEND_PROTOCOL_HTTP2
+	default:
+		log.Warn("Ignoring unknown backend protocol, using http",
+			zap.String("name", in.Name()),
+			zap.String("namespace", in.Namespace()),
+			zap.String("protocol", protocol))
+	}
+	return "http", util.BACKEND_PROTOCOL_HTTP1
+}
+
+// mapBackendTLS returns the server name, CA bundle and client certificate of https backends. The CA bundle is the
+// 'ca.crt' key of a 'secret/name' or 'configmap/name', and the client certificate the 'tls.crt' and 'tls.key' keys of
+// a secret, both in the namespace of the ingress
+func mapBackendTLS(in IngressCompat, scheme string) *BackendTLS {
+	serverName := in.getAnnotation(BACKEND_SNI_ANNOTATION)
+	ca := in.getAnnotation(BACKEND_CA_ANNOTATION)
+	cert := in.getAnnotation(BACKEND_CERT_ANNOTATION)
+	if serverName == "" && ca == "" && cert == "" {
+		return nil
+	}
+	if scheme != "https" {
+		log.Warn("Ignoring backend tls of ingress with cleartext backends",
+			zap.String("name", in.Name()),
+			zap.String("namespace", in.Namespace()))
+		return nil
+	}
+
+	out := &BackendTLS{ServerName: serverName}
+	if ca != "" {
+		kind, name, _ := strings.Cut(ca, "/")
+		switch strings.ToLower(kind) {
+		case "secret":
+			out.CA = Resource{Kind: KIND_SECRET, Object: Object{Name: name, Namespace: in.Namespace()}}
+		case "configmap":
+			out.CA = Resource{Kind: KIND_CONFIGMAP, Object: Object{Name: name, Namespace: in.Namespace()}}
+		}
+		if out.CA.Kind == "" || name == "" {
+			log.Warn("Ignoring invalid backend CA, expected secret/name or configmap/name",
+				zap.String("name", in.Name()),
+				zap.String("namespace", in.Namespace()),
+				zap.String("ca", ca))
+			out.CA = Resource{}
+		}
+	}
+	if cert != "" {
+		out.ClientCert = Object{Name: cert, Namespace: in.Namespace()}
+	}
+	return out
+}
+
+// mapRateLimit enables rate limiting when the requests per second are given. The burst defaults to one second worth of
+// requests, and requests are counted per client ip unless the key is 'global' or 'header:name'
+func mapRateLimit(in IngressCompat) *util.RateLimit {
+	_rate, present := in.getOptionalAnnotation(RATE_LIMIT_ANNOTATION)
+	if !present {
+		return nil
+	}
+	rate, err := strconv.ParseFloat(_rate, 64)
+	if err != nil || rate <= 0 || math.IsInf(rate, 0) {
+		log.Warn("Ignoring invalid rate limit",
+			zap.String("name", in.Name()),
+			zap.String("namespace", in.Namespace()),
+			zap.String("rate", _rate))
+		return nil
+	}
+
+	limit := &util.RateLimit{
+		Rate:  rate,
+		Burst: mapPositiveInt(in, RATE_LIMIT_BURST_ANNOTATION, int(math.Max(1, math.Ceil(rate)))),
+	}
+	source, name, _ := strings.Cut(in.getAnnotation(RATE_LIMIT_KEY_ANNOTATION), ":")
+	switch {
+	case source == "" || source == "ip":
+		limit.Key = util.RATE_LIMIT_KEY_CLIENT_IP
+	case source == "global":
+		limit.Key = util.RATE_LIMIT_KEY_GLOBAL
+	case source == "header" && name != "":
+		limit.Key, limit.KeyName = util.RATE_LIMIT_KEY_HEADER, name
+	default:
+		log.Warn("Ignoring invalid rate limit key, limiting per client ip",
+			zap.String("name", in.Name()),
+			zap.String("namespace", in.Namespace()),
+			zap.String("key", in.getAnnotation(RATE_LIMIT_KEY_ANNOTATION)))
+	}
+
+	return limit
+}
+
+// mapTimeouts parses the upstream timeouts of an ingress, given as durations like '500ms' or '2m', or as seconds
+func mapTimeouts(in IngressCompat) util.Timeouts {
+	return util.Timeouts{
+		Connect:        mapDuration(in, TIMEOUT_CONNECT_ANNOTATION),
+		ResponseHeader: mapDuration(in, TIMEOUT_HEADER_ANNOTATION),
+		Idle:           mapDuration(in, TIMEOUT_IDLE_ANNOTATION),
+		Total:          mapDuration(in, TIMEOUT_TOTAL_ANNOTATION),
+	}
+}
+
+func mapDuration(in IngressCompat, annotation string) time.Duration {
+	_value, present := in.getOptionalAnnotation(annotation)
+	if !present {
+		return 0
+	}
+	if seconds, err := strconv.ParseInt(_value, 10, 32); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	value, err := time.ParseDuration(_value)
+	if err != nil || value <= 0 {
+		log.Warn("Ignoring invalid duration annotation",
+			zap.String("name", in.Name()),
+			zap.String("namespace", in.Namespace()),
+			zap.String("annotation", annotation),
+			zap.String("value", _value))
+		return 0
+	}
+	return value
+}
+
+func mapPositiveInt(in IngressCompat, annotation string, defaultValue int) int {
+	_value, present := in.getOptionalAnnotation(annotation)
+	if !present {
+		return defaultValue
+	}
+	value, err := strconv.ParseInt(_value, 10, 32)
+	if err != nil || value <= 0 {
+		log.Warn("Ignoring invalid annotation, using default",
+			zap.String("name", in.Name()),
+			zap.String("namespace", in.Namespace()),
+			zap.String("annotation", annotation),
+			zap.String("value", _value),
+			zap.Int("default", defaultValue))
+		return defaultValue
+	}
+	return int(value)
+}
+
 func mapIntercept(in IngressCompat) (data *util.Intercept) {
 	data = nil
 
@@ -288,23 +1165,245 @@ func mapIntercept(in IngressCompat) (data *util.Intercept) {
 	return
 }
 
-func mapBackend(in IngressCompat, backend IngressBackendCompat) *Ingress {
+// mapCanaries parses the canary services of an ingress, given as a comma-separated list of 'name[:port]=weight' where
+// weight is the percentage of the traffic sent to the service, e.g. 'checkout-canary=5' or 'checkout-canary:http=5'
+func mapCanaries(in IngressCompat) []ServiceRef {
+	_canaries, present := in.getOptionalAnnotation(CANARY_SERVICES_ANNOTATION)
+	if !present {
+		return nil
+	}
+
+	out := make([]ServiceRef, 0)
+	total := 0
+	for _, c := range strings.Split(_canaries, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		service, _weight, found := strings.Cut(c, "=")
+		weight, err := strconv.Atoi(strings.TrimSpace(_weight))
+		if !found || err != nil || weight < 0 || weight > 100 {
+			log.Warn("Ignoring canary service with invalid weight",
+				zap.String("name", in.Name()),
+				zap.String("namespace", in.Namespace()),
+				zap.String("canary", c))
+			continue
+		}
+
+		ref, err := parseServiceRef(service)
+		if err != nil {
+			log.Warn("Ignoring canary service with invalid port",
+				zap.String("name", in.Name()),
+				zap.String("namespace", in.Namespace()),
+				zap.String("canary", c))
+			continue
+		}
+		if ref.Name == "" || weight == 0 {
+			continue
+		}
+		ref.Weight = weight
+		total += weight
+		out = append(out, ref)
+	}
+
+	if total > 100 {
+		log.Warn("Ignoring canary services with a total weight above 100",
+			zap.String("name", in.Name()),
+			zap.String("namespace", in.Namespace()),
+			zap.Int("weight", total))
+		return nil
+	}
+
+	return out
+}
+
+// parseServiceRef parses a service given as 'name[:port]', where port is either a number or a name
+func parseServiceRef(service string) (ServiceRef, error) {
+	ref := ServiceRef{Name: strings.TrimSpace(service)}
+	if name, _port, hasPort := strings.Cut(ref.Name, ":"); hasPort {
+		ref.Name = name
+		if port, err := strconv.Atoi(_port); err != nil {
+			ref.PortName = _port
+		} else if ref.Port, err = toPort(port); err != nil {
+			return ref, err
+		}
+	}
+	return ref, nil
+}
+
+// withCanaries adds the canary services to the service of a path, which receives the remaining share of the traffic.
+// Canaries without a port use the port of the path
+func withCanaries(service ServiceRef, canaries []ServiceRef) []ServiceRef {
+	if len(canaries) == 0 {
+		return []ServiceRef{service}
+	}
+
+	out := make([]ServiceRef, 0, len(canaries)+1)
+	remainder := 100
+	for _, c := range canaries {
+		if c.Port == 0 && c.PortName == "" {
+			c.Port, c.PortName = service.Port, service.PortName
+		}
+		remainder -= c.Weight
+		out = append(out, c)
+	}
+	if remainder > 0 {
+		service.Weight = remainder
+		out = append([]ServiceRef{service}, out...)
+	}
+
+	return out
+}
+
+// RoutingRule sends requests matching all of its conditions to another service than the one of the path
+type RoutingRule struct {
+	Matches []util.RequestMatch
+	Service ServiceRef
+}
+
+// mapRoutingRules parses the routing rules of an ingress, given as a list of '<conditions> => name[:port]' separated by
+// semicolons or newlines. Conditions are comma-separated and written as 'source:name=value', or 'source:name~regexp'
+// for a regular expression, with source being one of header, cookie or query. E.g.
+// 'header:X-Canary=always => app-preview; cookie:beta=1, query:version~^v[0-9]+$ => app-beta:http'
+func mapRoutingRules(in IngressCompat) []RoutingRule {
+	_rules, present := in.getOptionalAnnotation(ROUTING_RULES_ANNOTATION)
+	if !present {
+		return nil
+	}
+
+	out := make([]RoutingRule, 0)
+	for _, r := range strings.FieldsFunc(_rules, func(c rune) bool { return c == ';' || c == '\n' }) {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		rule, err := parseRoutingRule(r)
+		if err != nil {
+			log.Warn("Ignoring invalid routing rule",
+				zap.String("name", in.Name()),
+				zap.String("namespace", in.Namespace()),
+				zap.String("rule", r),
+				zap.String("error", err.Error()))
+			continue
+		}
+		out = append(out, rule)
+	}
+
+	return out
+}
+
+func parseRoutingRule(rule string) (RoutingRule, error) {
+	_conditions, _service, found := strings.Cut(rule, "=>")
+	if !found {
+		return RoutingRule{}, errors.New("missing '=>' between conditions and service")
+	}
+
+	service, err := parseServiceRef(_service)
+	if err != nil {
+		return RoutingRule{}, err
+	} else if service.Name == "" {
+		return RoutingRule{}, errors.New("missing service")
+	}
+
+	matches := make([]util.RequestMatch, 0)
+	for _, c := range strings.Split(_conditions, ",") {
+		_source, condition, found := strings.Cut(strings.TrimSpace(c), ":")
+		if !found {
+			return RoutingRule{}, fmt.Errorf("missing source of condition '%s'", c)
+		}
+
+		match := util.RequestMatch{}
+		switch _source {
+		case "header":
+			match.Source = util.MATCH_SOURCE_HEADER
+		case "cookie":
+			match.Source = util.MATCH_SOURCE_COOKIE
+		case "query":
+			match.Source = util.MATCH_SOURCE_QUERY
+		default:
+			return RoutingRule{}, fmt.Errorf("unknown source '%s'", _source)
+		}
+
+		n := strings.IndexAny(condition, "=~")
+		if n < 1 {
+			return RoutingRule{}, fmt.Errorf("invalid condition '%s'", c)
+		}
+		match.Name, match.Value = condition[:n], condition[n+1:]
+		if condition[n] == '~' {
+			if match.Regexp, err = regexp.Compile(match.Value); err != nil {
+				return RoutingRule{}, err
+			}
+		}
+		matches = append(matches, match)
+	}
+
+	return RoutingRule{Matches: matches, Service: service}, nil
+}
+
+// withRoutingRules returns a copy of the path for each routing rule, with the conditions and service of the rule.
+// Services without a port use the port of the path
+func withRoutingRules(path IngressPath, rules []RoutingRule) []IngressPath {
+	out := make([]IngressPath, 0, len(rules))
+	for _, r := range rules {
+		service := r.Service
+		if service.Port == 0 && service.PortName == "" {
+			service.Port, service.PortName = path.Services[0].Port, path.Services[0].PortName
+		}
+		out = append(out, IngressPath{
+			Path:     path.Path,
+			PathType: path.PathType,
+			Matches:  r.Matches,
+			Services: []ServiceRef{service},
+		})
+	}
+	return out
+}
+
+func mapBackend(in IngressCompat, path HTTPIngressPathCompat) *IngressPath {
 
 	namespace := in.Namespace()
 
+	backend := path.Backend()
+	if backend == nil || backend.ServiceName() == "" {
+		return nil
+	}
+
+	// the ingress refers to the service port either by number or by name
 	port := backend.ServicePort()
-	if _, err := toPort(port); err != nil {
-		log.Warn("Dropping ingress backend with invalid port (hint: port names not supported)",
+	portName := backend.ServicePortName()
+	if _, err := toPort(port); err != nil && portName == "" {
+		log.Warn("Dropping ingress backend with invalid port",
 			zap.String("name", backend.ServiceName()),
 			zap.String("namespace", namespace))
 
 		return nil
+	} else if err != nil {
+		port = 0
+	}
+
+	p := path.Path()
+	if p == "" {
+		p = "/"
+	}
+	return &IngressPath{
+		Path:     p,
+		PathType: mapPathType(path.PathType()),
+		Services: []ServiceRef{{
+			Name:     backend.ServiceName(),
+			Port:     uint16(port),
+			PortName: portName,
+		}},
 	}
-	return &Ingress{
-		Name:            backend.ServiceName(),
-		Port:            uint16(port),
-		Scheme:          "http",
-		PlainHTTPPolicy: mapPlainHTTPPolicy(in),
+}
+
+func mapPathType(pathType string) uint16 {
+	switch pathType {
+	case string(networkingv1.PathTypeExact):
+		return util.PATH_TYPE_EXACT
+	case string(networkingv1.PathTypePrefix):
+		return util.PATH_TYPE_PREFIX
+	default:
+		return util.PATH_TYPE_IMPLEMENTATION_SPECIFIC
 	}
 }
 
@@ -0,0 +1,655 @@
+package kubernetes
+
+import (
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dbcdk/shelob/util"
+
+	apicorev1 "k8s.io/api/core/v1"
+	apidiscoveryv1 "k8s.io/api/discovery/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	machinerymetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func createService(name string, ports ...apicorev1.ServicePort) apicorev1.Service {
+	return apicorev1.Service{
+		ObjectMeta: machinerymetav1.ObjectMeta{Name: name, Namespace: "testing"},
+		Spec:       apicorev1.ServiceSpec{Ports: ports},
+	}
+}
+
+func TestNamedPorts(t *testing.T) {
+	services := mapService(createService("app",
+		apicorev1.ServicePort{Name: "http", Port: 80, TargetPort: intstr.FromString("web")},
+		apicorev1.ServicePort{Name: "metrics", Port: 9090, TargetPort: intstr.FromInt32(9091)},
+	))
+	endpoints := []Endpoint{
+		{Address: "10.0.0.1", Port: 8080, PortName: "http", Ready: true},
+		{Address: "10.0.0.2", Port: 8081, PortName: "http", Ready: true},
+		{Address: "10.0.0.1", Port: 9091, PortName: "metrics", Ready: true},
+	}
+	object := Object{Name: "app", Namespace: "testing"}
+
+	byName, ok := services[PortMatch{Object: object, Name: "http"}]
+	if !ok {
+		t.Fatal("Expected service port to be resolvable by name")
+	}
+	if byNumber := services[PortMatch{Object: object, Port: 80}]; byNumber != byName {
+		t.Error("Expected service port to be resolvable by number")
+	}
+
+	backends := toBackendList("http", byName, endpoints)
+	if len(backends) != 2 || backends[0].Url.Host != "10.0.0.1:8080" || backends[1].Url.Host != "10.0.0.2:8081" {
+		t.Errorf("Expected named target port to resolve against endpoint port names, got %v", backends)
+	}
+
+	backends = toBackendList("http", services[PortMatch{Object: object, Name: "metrics"}], endpoints)
+	if len(backends) != 1 || backends[0].Url.Host != "10.0.0.1:9091" {
+		t.Errorf("Expected numeric target port to resolve against endpoint port numbers, got %v", backends)
+	}
+}
+
+func TestEndpointSliceConditions(t *testing.T) {
+	ready, notReady, yes := true, false, true
+	port, name := int32(8080), "http"
+	slice := apidiscoveryv1.EndpointSlice{
+		AddressType: apidiscoveryv1.AddressTypeIPv6,
+		Ports:       []apidiscoveryv1.EndpointPort{{Name: &name, Port: &port}},
+		Endpoints: []apidiscoveryv1.Endpoint{
+			{Addresses: []string{"fd00::1"}, Conditions: apidiscoveryv1.EndpointConditions{Ready: &ready}},
+			{Addresses: []string{"fd00::2"}, Conditions: apidiscoveryv1.EndpointConditions{Ready: &notReady, Serving: &yes, Terminating: &yes}},
+			{Addresses: []string{"fd00::3"}, Conditions: apidiscoveryv1.EndpointConditions{Ready: &notReady}},
+		},
+	}
+	service := Service{Name: "http", Port: 80, TargetPort: 8080}
+
+	endpoints := mapEndpointSlice(slice)
+	backends := toBackendList("http", service, append(endpoints, endpoints...))
+	if len(backends) != 1 || backends[0].Url.Host != "[fd00::1]:8080" {
+		t.Errorf("Expected only the ready endpoint, got %v", backends)
+	}
+
+	backends = toBackendList("http", service, endpoints[1:])
+	if len(backends) != 1 || backends[0].Url.Host != "[fd00::2]:8080" {
+		t.Errorf("Expected fallback to the serving terminating endpoint, got %v", backends)
+	}
+
+	slice.AddressType = apidiscoveryv1.AddressTypeFQDN
+	if endpoints := mapEndpointSlice(slice); len(endpoints) != 0 {
+		t.Errorf("Expected FQDN slices to be ignored, got %v", endpoints)
+	}
+}
+
+func TestDualStackEndpoints(t *testing.T) {
+	port := int32(8080)
+	createSlice := func(addressType apidiscoveryv1.AddressType, addresses ...string) apidiscoveryv1.EndpointSlice {
+		slice := apidiscoveryv1.EndpointSlice{AddressType: addressType, Ports: []apidiscoveryv1.EndpointPort{{Port: &port}}}
+		for i, a := range addresses {
+			slice.Endpoints = append(slice.Endpoints, apidiscoveryv1.Endpoint{
+				Addresses: []string{a},
+				TargetRef: &apicorev1.ObjectReference{Kind: "Pod", Name: fmt.Sprintf("app-%d", i)},
+			})
+		}
+		return slice
+	}
+	v4 := mapEndpointSlice(createSlice(apidiscoveryv1.AddressTypeIPv4, "10.0.0.1", "10.0.0.2"))
+	v6 := mapEndpointSlice(createSlice(apidiscoveryv1.AddressTypeIPv6, "fd00::1", "fd00::2"))
+
+	service := createService("app", apicorev1.ServicePort{Port: 80, TargetPort: intstr.FromInt32(8080)})
+	service.Spec.IPFamilies = []apicorev1.IPFamily{apicorev1.IPv6Protocol, apicorev1.IPv4Protocol}
+	mapped := mapService(service)[PortMatch{Object: Object{Name: "app", Namespace: "testing"}, Port: 80}]
+
+	backends := toBackendList("http", mapped, append(v4, v6...))
+	if len(backends) != 2 || backends[0].Url.Host != "[fd00::1]:8080" || backends[1].Url.Host != "[fd00::2]:8080" {
+		t.Errorf("Expected one backend per pod of the preferred family, got %v", backends)
+	}
+
+	backends = toBackendList("http", mapped, v4)
+	if len(backends) != 2 || backends[0].Url.Host != "10.0.0.1:8080" {
+		t.Errorf("Expected fallback to the other family, got %v", backends)
+	}
+
+	mapped.IPFamily = ""
+	backends = toBackendList("http", mapped, append(v6, v4...))
+	if len(backends) != 2 || backends[0].Url.Host != "10.0.0.1:8080" {
+		t.Errorf("Expected IPv4 without a preferred family, got %v", backends)
+	}
+
+	// the same pod listed in two slices of a family while moving between them is a single backend
+	moved := mapEndpointSlice(createSlice(apidiscoveryv1.AddressTypeIPv4, "10.0.0.3"))
+	backends = toBackendList("http", mapped, append(v4, moved...))
+	if len(backends) != 2 {
+		t.Errorf("Expected endpoints to be deduplicated by pod, got %v", backends)
+	}
+}
+
+func createIngress(className *string, annotations map[string]string) IngressCompat {
+	return IngressCompat{
+		v1: &networkingv1.Ingress{
+			ObjectMeta: machinerymetav1.ObjectMeta{Name: "app", Namespace: "testing", Annotations: annotations},
+			Spec:       networkingv1.IngressSpec{IngressClassName: className},
+		},
+	}
+}
+
+func TestOwnsIngress(t *testing.T) {
+	shelob, nginx := "shelob", "nginx"
+
+	if !ownsIngress(createIngress(&nginx, nil), "", false) {
+		t.Error("Expected every ingress to be owned when no class is configured")
+	}
+	if !ownsIngress(createIngress(&shelob, nil), "shelob", false) {
+		t.Error("Expected ingress with matching ingressClassName to be owned")
+	}
+	if ownsIngress(createIngress(&nginx, nil), "shelob", true) {
+		t.Error("Expected ingress with foreign ingressClassName not to be owned")
+	}
+	if !ownsIngress(createIngress(nil, map[string]string{INGRESS_CLASS_ANNOTATION: "shelob"}), "shelob", false) {
+		t.Error("Expected ingress with matching class annotation to be owned")
+	}
+	if ownsIngress(createIngress(nil, map[string]string{INGRESS_CLASS_ANNOTATION: "nginx"}), "shelob", true) {
+		t.Error("Expected ingress with foreign class annotation not to be owned")
+	}
+	if ownsIngress(createIngress(nil, nil), "shelob", false) {
+		t.Error("Expected ingress without class not to be owned by a non-default class")
+	}
+	if !ownsIngress(createIngress(nil, nil), "shelob", true) {
+		t.Error("Expected ingress without class to be owned by the default class")
+	}
+}
+
+func TestCanaryServices(t *testing.T) {
+	canaries := mapCanaries(createIngress(nil, map[string]string{CANARY_SERVICES_ANNOTATION: "app-canary=5, app-beta:http=10,app-broken=x"}))
+	expected := []ServiceRef{
+		{Name: "app", Port: 80, Weight: 85},
+		{Name: "app-canary", Port: 80, Weight: 5},
+		{Name: "app-beta", PortName: "http", Weight: 10},
+	}
+	if services := withCanaries(ServiceRef{Name: "app", Port: 80}, canaries); !reflect.DeepEqual(services, expected) {
+		t.Errorf("Expected canaries to take their share of the path, got %v", services)
+	}
+
+	if canaries := mapCanaries(createIngress(nil, map[string]string{CANARY_SERVICES_ANNOTATION: "a=60,b=50"})); canaries != nil {
+		t.Errorf("Expected canaries above a total weight of 100 to be ignored, got %v", canaries)
+	}
+
+	canaries = mapCanaries(createIngress(nil, map[string]string{CANARY_SERVICES_ANNOTATION: "app-v2=100"}))
+	if services := withCanaries(ServiceRef{Name: "app", Port: 80}, canaries); len(services) != 1 || services[0].Name != "app-v2" {
+		t.Errorf("Expected a canary taking all traffic to replace the service of the path, got %v", services)
+	}
+}
+
+func createIngressPath(path string, pathType networkingv1.PathType, service string) networkingv1.HTTPIngressPath {
+	return networkingv1.HTTPIngressPath{
+		Path:     path,
+		PathType: &pathType,
+		Backend: networkingv1.IngressBackend{
+			Service: &networkingv1.IngressServiceBackend{Name: service, Port: networkingv1.ServiceBackendPort{Number: 80}},
+		},
+	}
+}
+
+func TestPathRouting(t *testing.T) {
+	in := createIngress(nil, nil)
+	in.v1.Spec.Rules = []networkingv1.IngressRule{{
+		Host: "app.example.com",
+		IngressRuleValue: networkingv1.IngressRuleValue{HTTP: &networkingv1.HTTPIngressRuleValue{Paths: []networkingv1.HTTPIngressPath{
+			createIngressPath("/", networkingv1.PathTypePrefix, "web"),
+			createIngressPath("/api", networkingv1.PathTypePrefix, "api"),
+			createIngressPath("/api/health", networkingv1.PathTypeExact, "health"),
+		}}},
+	}}
+	ingress := mapIngress(in)["app.example.com"]
+	if len(ingress.Paths) != 3 || ingress.Paths[2].PathType != util.PATH_TYPE_EXACT {
+		t.Fatalf("Expected three paths of the ingress rule, got %v", ingress.Paths)
+	}
+
+	services := make(map[PortMatch]Service)
+	endpoints := make(map[Object][]Endpoint)
+	for n, name := range []string{"web", "api", "health"} {
+		object := Object{Name: name, Namespace: "testing"}
+		services[PortMatch{Object: object, Port: 80}] = Service{Port: 80, TargetPort: 8080}
+		endpoints[object] = []Endpoint{{Address: fmt.Sprintf("10.0.0.%d", n+1), Port: 8080, Ready: true}}
+	}
+	ingresses := map[HostMatch]Ingress{{Kind: KIND_INGRESS, Object: Object{Name: "app", Namespace: "testing"}, HostName: "app.example.com"}: ingress}
+	frontend := mergeFrontends(&util.Config{}, nil, ingresses, services, endpoints, nil)["app.example.com"]
+
+	tests := map[string]string{"/": "10.0.0.1:8080", "/apis": "10.0.0.1:8080", "/api": "10.0.0.2:8080", "/api/health/more": "10.0.0.2:8080", "/api/health": "10.0.0.3:8080"}
+	for path, expected := range tests {
+		route := frontend.MatchRoute(httptest.NewRequest("GET", "http://app.example.com"+path, nil))
+		if route == nil || len(route.Backends) != 1 || route.Backends[0].Url.Host != expected {
+			t.Errorf("Expected %s to be routed to %s, got %v", path, expected, route)
+		}
+	}
+
+	// an intercept takes over the host from the paths of other ingresses
+	ingresses[HostMatch{Kind: KIND_INGRESS, Object: Object{Name: "moved", Namespace: "testing"}, HostName: "app.example.com"}] = Ingress{
+		Intercept: &util.Intercept{Action: util.BACKEND_ACTION_RESPOND, Code: 410},
+	}
+	if frontend := mergeFrontends(&util.Config{}, nil, ingresses, services, endpoints, nil)["app.example.com"]; frontend.Intercept == nil || len(frontend.Routes) != 0 {
+		t.Errorf("Expected intercept to override the paths of the host, got %v", frontend)
+	}
+}
+
+func TestMergeFrontendsWeights(t *testing.T) {
+	stable, canary := Object{Name: "app", Namespace: "testing"}, Object{Name: "app-canary", Namespace: "testing"}
+	ingresses := map[HostMatch]Ingress{
+		{Kind: KIND_INGRESS, Object: stable, HostName: "app.example.com"}: {
+			Scheme: "http",
+			Paths: []IngressPath{{
+				Path:     "/",
+				PathType: util.PATH_TYPE_PREFIX,
+				Services: []ServiceRef{{Name: "app", Port: 80, Weight: 95}, {Name: "app-canary", Port: 80, Weight: 5}},
+			}},
+		},
+	}
+	services := map[PortMatch]Service{
+		{Object: stable, Port: 80}: {Port: 80, TargetPort: 8080},
+		{Object: canary, Port: 80}: {Port: 80, TargetPort: 8080},
+	}
+	endpoints := map[Object][]Endpoint{
+		stable: {{Address: "10.0.0.1", Port: 8080, Ready: true}, {Address: "10.0.0.2", Port: 8080, Ready: true}, {Address: "10.0.0.3", Port: 8080, Ready: true}},
+		canary: {{Address: "10.0.1.1", Port: 8080, Ready: true}},
+	}
+
+	route := mergeFrontends(&util.Config{}, nil, ingresses, services, endpoints, nil)["app.example.com"].Routes[0]
+	weights := make(map[string]int)
+	for _, b := range route.Backends {
+		weights[b.Url.Host] = b.Weight
+	}
+	expected := map[string]int{"10.0.0.1:8080": 19, "10.0.0.2:8080": 19, "10.0.0.3:8080": 19, "10.0.1.1:8080": 3}
+	if !reflect.DeepEqual(weights, expected) {
+		t.Errorf("Expected service weights to be spread over their endpoints, got %v", weights)
+	}
+
+	hits := make(map[string]int)
+	balancer := util.CreateBalancer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		hits[req.URL.Host]++
+	}), route.Balancing, route.Backends, nil)
+	for n := 0; n < 20; n++ {
+		balancer.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://app.example.com/", nil))
+	}
+	if hits["10.0.1.1:8080"] != 1 {
+		t.Errorf("Expected the canary to receive its share of the first requests, got %v", hits)
+	}
+	for n := 0; n < 980; n++ {
+		balancer.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://app.example.com/", nil))
+	}
+	if hits["10.0.1.1:8080"] != 50 {
+		t.Errorf("Expected the canary to receive 5%% of the requests, got %v", hits)
+	}
+}
+
+func TestRoutingRules(t *testing.T) {
+	rules := mapRoutingRules(createIngress(nil, map[string]string{ROUTING_RULES_ANNOTATION: "header:X-Canary=always => app-preview;\ncookie:beta=1, query:version~^v[0-9]+$ => app-beta:http; bogus:a=b => app-broken"}))
+	if len(rules) != 2 {
+		t.Fatalf("Expected two valid routing rules, got %v", rules)
+	}
+
+	paths := withRoutingRules(IngressPath{Path: "/api", PathType: util.PATH_TYPE_PREFIX, Services: []ServiceRef{{Name: "app", Port: 80}}}, rules)
+	if len(paths) != 2 || paths[0].Path != "/api" || !reflect.DeepEqual(paths[0].Services, []ServiceRef{{Name: "app-preview", Port: 80}}) {
+		t.Errorf("Expected rule without port to use the path and port of the ingress, got %v", paths)
+	}
+	if matches := paths[0].Matches; len(matches) != 1 || matches[0].Source != util.MATCH_SOURCE_HEADER || matches[0].Name != "X-Canary" || matches[0].Value != "always" {
+		t.Errorf("Expected header condition, got %v", matches)
+	}
+	if matches := paths[1].Matches; len(matches) != 2 || matches[0].Source != util.MATCH_SOURCE_COOKIE || matches[1].Source != util.MATCH_SOURCE_QUERY || matches[1].Regexp == nil {
+		t.Errorf("Expected cookie and query conditions, got %v", matches)
+	}
+	if service := paths[1].Services[0]; service.PortName != "http" {
+		t.Errorf("Expected rule with named port to keep it, got %v", service)
+	}
+}
+
+func TestAffinity(t *testing.T) {
+	if affinity := mapAffinity(createIngress(nil, nil)); affinity != nil {
+		t.Errorf("Expected no affinity without annotation, got %v", affinity)
+	}
+
+	affinity := mapAffinity(createIngress(nil, map[string]string{AFFINITY_ANNOTATION: "cookie"}))
+	if affinity == nil || affinity.CookieName != DEFAULT_AFFINITY_COOKIE || affinity.TTL != 0 || affinity.Fallback != util.AFFINITY_FALLBACK_REBALANCE {
+		t.Errorf("Expected default affinity, got %v", affinity)
+	}
+
+	affinity = mapAffinity(createIngress(nil, map[string]string{
+		AFFINITY_ANNOTATION:          "cookie",
+		AFFINITY_COOKIE_ANNOTATION:   "legacy",
+		AFFINITY_TTL_ANNOTATION:      "1800",
+		AFFINITY_FALLBACK_ANNOTATION: "reject",
+	}))
+	if affinity == nil || affinity.CookieName != "legacy" || affinity.TTL != 30*time.Minute || affinity.Fallback != util.AFFINITY_FALLBACK_REJECT {
+		t.Errorf("Expected configured affinity, got %v", affinity)
+	}
+}
+
+func TestBalancing(t *testing.T) {
+	cases := map[string]util.Balancing{
+		"":              {Algorithm: util.BALANCER_ROUND_ROBIN},
+		"least-request": {Algorithm: util.BALANCER_LEAST_REQUEST},
+		"peak-ewma":     {Algorithm: util.BALANCER_PEAK_EWMA},
+		"random":        {Algorithm: util.BALANCER_ROUND_ROBIN},
+	}
+	for annotation, expected := range cases {
+		if balancing := mapBalancing(createIngress(nil, map[string]string{BALANCER_ANNOTATION: annotation})); balancing != expected {
+			t.Errorf("Expected balancer '%s' to map to %v, got %v", annotation, expected, balancing)
+		}
+	}
+
+	keys := map[string]util.Balancing{
+		"":              {Algorithm: util.BALANCER_HASH, HashKey: util.HASH_KEY_CLIENT_IP},
+		"path":          {Algorithm: util.BALANCER_HASH, HashKey: util.HASH_KEY_PATH},
+		"header:X-User": {Algorithm: util.BALANCER_HASH, HashKey: util.HASH_KEY_HEADER, HashKeyName: "X-User"},
+		"cookie:":       {Algorithm: util.BALANCER_HASH, HashKey: util.HASH_KEY_CLIENT_IP},
+	}
+	for annotation, expected := range keys {
+		balancing := mapBalancing(createIngress(nil, map[string]string{BALANCER_ANNOTATION: "hash", BALANCER_HASH_KEY_ANNOTATION: annotation}))
+		if balancing != expected {
+			t.Errorf("Expected hash key '%s' to map to %v, got %v", annotation, expected, balancing)
+		}
+	}
+}
+
+func TestMergeFrontendsKeepsBalancers(t *testing.T) {
+	app := Object{Name: "app", Namespace: "testing"}
+	key := HostMatch{Kind: KIND_INGRESS, Object: app, HostName: "app.example.com"}
+	ingress := Ingress{
+		Scheme:    "http",
+		Paths:     []IngressPath{{Path: "/", PathType: util.PATH_TYPE_PREFIX, Services: []ServiceRef{{Name: "app", Port: 80}}}},
+		Balancing: util.Balancing{Algorithm: util.BALANCER_LEAST_REQUEST},
+	}
+	services := map[PortMatch]Service{{Object: app, Port: 80}: {Port: 80, TargetPort: 8080}}
+	endpoints := map[Object][]Endpoint{app: {{Address: "10.0.0.1", Port: 8080, Ready: true}}}
+
+	config := &util.Config{}
+	first := mergeFrontends(config, nil, map[HostMatch]Ingress{key: ingress}, services, endpoints, nil)
+	config.PublishFrontends(first)
+
+	endpoints[app] = append(endpoints[app], Endpoint{Address: "10.0.0.2", Port: 8080, Ready: true})
+	second := mergeFrontends(config, first, map[HostMatch]Ingress{key: ingress}, services, endpoints, nil)
+	balancer := second["app.example.com"].Routes[0].Balancer
+	if balancer != first["app.example.com"].Routes[0].Balancer {
+		t.Error("Expected balancer to be kept across merges")
+	}
+	if len(balancer.Servers()) != 1 {
+		t.Errorf("Expected kept balancer to be left alone until the frontends are published, got %v", balancer.Servers())
+	}
+
+	// the second frontends are never published, the third ones are built from them
+	endpoints[app] = []Endpoint{{Address: "10.0.0.3", Port: 8080, Ready: true}}
+	third := mergeFrontends(config, second, map[HostMatch]Ingress{key: ingress}, services, endpoints, nil)
+	config.PublishFrontends(third)
+	if servers := balancer.Servers(); len(servers) != 1 || servers[0].Host != "10.0.0.3:8080" {
+		t.Errorf("Expected kept balancer to be updated with the endpoints of the published frontends, got %v", servers)
+	}
+
+	ingress.Balancing = util.Balancing{Algorithm: util.BALANCER_PEAK_EWMA}
+	fourth := mergeFrontends(config, third, map[HostMatch]Ingress{key: ingress}, services, endpoints, nil)
+	if fourth["app.example.com"].Routes[0].Balancer == balancer {
+		t.Error("Expected balancer to be replaced when the balancing changes")
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	if check := mapHealthCheck(createIngress(nil, nil)); check != nil {
+		t.Errorf("Expected no health check without path, got %v", check)
+	}
+
+	check := mapHealthCheck(createIngress(nil, map[string]string{
+		HEALTH_PATH_ANNOTATION:      "healthz",
+		HEALTH_INTERVAL_ANNOTATION:  "5",
+		HEALTH_UNHEALTHY_ANNOTATION: "-1",
+	}))
+	expected := util.HealthCheck{Path: "/healthz", Interval: 5 * time.Second, Timeout: 2 * time.Second, HealthyThreshold: 2, UnhealthyThreshold: 3}
+	if check == nil || *check != expected {
+		t.Errorf("Expected health check %v, got %v", expected, check)
+	}
+}
+
+func TestOutlierDetection(t *testing.T) {
+	if detection := mapOutlierDetection(createIngress(nil, nil)); detection != nil {
+		t.Errorf("Expected no outlier detection without annotation, got %v", detection)
+	}
+
+	detection := mapOutlierDetection(createIngress(nil, map[string]string{
+		OUTLIER_ERRORS_ANNOTATION:  "3",
+		OUTLIER_PERCENT_ANNOTATION: "200",
+	}))
+	expected := util.OutlierDetection{ConsecutiveErrors: 3, EjectionTime: 30 * time.Second, MaxEjectionPercent: 100}
+	if detection == nil || *detection != expected {
+		t.Errorf("Expected outlier detection %v, got %v", expected, detection)
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	if policy := mapRetryPolicy(createIngress(nil, nil)); policy != nil {
+		t.Errorf("Expected no retry policy without annotation, got %v", policy)
+	}
+
+	policy := mapRetryPolicy(createIngress(nil, map[string]string{RETRY_ATTEMPTS_ANNOTATION: "2"}))
+	expected := util.RetryPolicy{Attempts: 2, ConnectFailure: true, Budget: 20}
+	if policy == nil || !sameRetryPolicy(policy, &expected) {
+		t.Errorf("Expected retry policy %v, got %v", expected, policy)
+	}
+
+	policy = mapRetryPolicy(createIngress(nil, map[string]string{
+		RETRY_ATTEMPTS_ANNOTATION: "1",
+		RETRY_ON_ANNOTATION:       "5xx, 429, bogus",
+		RETRY_METHODS_ANNOTATION:  "all",
+		RETRY_BUDGET_ANNOTATION:   "50",
+	}))
+	expected = util.RetryPolicy{Attempts: 1, ServerErrors: true, StatusCodes: []int{429}, AllMethods: true, Budget: 50}
+	if policy == nil || !sameRetryPolicy(policy, &expected) {
+		t.Errorf("Expected retry policy %v, got %v", expected, policy)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	if breaker := mapCircuitBreaker(createIngress(nil, nil)); breaker != nil {
+		t.Errorf("Expected no circuit breaker without annotation, got %v", breaker)
+	}
+
+	breaker := mapCircuitBreaker(createIngress(nil, map[string]string{
+		BREAKER_ERRORS_ANNOTATION:  "25",
+		BREAKER_LATENCY_ANNOTATION: "200",
+		BREAKER_CODE_ANNOTATION:    "502",
+		BREAKER_TEXT_ANNOTATION:    "Try again later",
+	}))
+	expected := util.CircuitBreaker{
+		ErrorPercent: 25,
+		Latency:      200 * time.Millisecond,
+		MinRequests:  20,
+		Window:       10 * time.Second,
+		OpenTime:     30 * time.Second,
+		Probes:       3,
+		Fallback:     &util.Intercept{Code: 502, ResponseText: "Try again later", Action: util.BACKEND_ACTION_RESPOND},
+	}
+	if !sameCircuitBreaker(breaker, &expected) {
+		t.Errorf("Expected circuit breaker %v, got %v", expected, breaker)
+	}
+
+	breaker = mapCircuitBreaker(createIngress(nil, map[string]string{
+		BREAKER_ERRORS_ANNOTATION:   "50",
+		BREAKER_REDIRECT_ANNOTATION: "https://status.example.com",
+	}))
+	if breaker == nil || breaker.Latency != 0 || breaker.Fallback == nil || breaker.Fallback.Action != util.BACKEND_ACTION_REDIRECT {
+		t.Errorf("Expected circuit breaker redirecting to fallback, got %v", breaker)
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	if timeouts := mapTimeouts(createIngress(nil, nil)); timeouts != (util.Timeouts{}) {
+		t.Errorf("Expected no timeouts without annotations, got %v", timeouts)
+	}
+
+	timeouts := mapTimeouts(createIngress(nil, map[string]string{
+		TIMEOUT_CONNECT_ANNOTATION: "250ms",
+		TIMEOUT_HEADER_ANNOTATION:  "5",
+		TIMEOUT_IDLE_ANNOTATION:    "2m",
+		TIMEOUT_TOTAL_ANNOTATION:   "bogus",
+	}))
+	expected := util.Timeouts{Connect: 250 * time.Millisecond, ResponseHeader: 5 * time.Second, Idle: 2 * time.Minute}
+	if timeouts != expected {
+		t.Errorf("Expected timeouts %v, got %v", expected, timeouts)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	if limit := mapRateLimit(createIngress(nil, nil)); limit != nil {
+		t.Errorf("Expected no rate limit without annotation, got %v", limit)
+	}
+
+	limit := mapRateLimit(createIngress(nil, map[string]string{RATE_LIMIT_ANNOTATION: "2.5"}))
+	expected := util.RateLimit{Rate: 2.5, Burst: 3, Key: util.RATE_LIMIT_KEY_CLIENT_IP}
+	if limit == nil || *limit != expected {
+		t.Errorf("Expected rate limit %v, got %v", expected, limit)
+	}
+
+	limit = mapRateLimit(createIngress(nil, map[string]string{
+		RATE_LIMIT_ANNOTATION:       "100",
+		RATE_LIMIT_BURST_ANNOTATION: "500",
+		RATE_LIMIT_KEY_ANNOTATION:   "header:X-Api-Key",
+	}))
+	expected = util.RateLimit{Rate: 100, Burst: 500, Key: util.RATE_LIMIT_KEY_HEADER, KeyName: "X-Api-Key"}
+	if limit == nil || *limit != expected {
+		t.Errorf("Expected rate limit %v, got %v", expected, limit)
+	}
+
+	previous := &util.Frontend{RateLimiter: util.NewRateLimiter(expected)}
+	if rateLimiter(previous, &expected) != previous.RateLimiter {
+		t.Error("Expected rate limiter to be kept when the limit is unchanged")
+	}
+	changed := util.RateLimit{Rate: 50, Burst: 500, Key: util.RATE_LIMIT_KEY_GLOBAL}
+	if limiter := rateLimiter(previous, &changed); limiter == previous.RateLimiter || limiter.Limit() != changed {
+		t.Error("Expected new rate limiter when the limit has changed")
+	}
+}
+
+func TestBackendProtocol(t *testing.T) {
+	tests := map[string]struct {
+		scheme   string
+		protocol uint16
+	}{
+		"":      {"http", util.BACKEND_PROTOCOL_HTTP1},
+		"http":  {"http", util.BACKEND_PROTOCOL_HTTP1},
+		"h2c":   {"http", util.BACKEND_PROTOCOL_HTTP2},
+		"https": {"https", util.BACKEND_PROTOCOL_HTTP1},
+		"h2":    {"https", util.BACKEND_PROTOCOL_HTTP2},
+		"grpc":  {"http", util.BACKEND_PROTOCOL_HTTP2},
+		"grpcs": {"https", util.BACKEND_PROTOCOL_HTTP2},
+		"bogus": {"http", util.BACKEND_PROTOCOL_HTTP1},
+	}
+	for annotation, expected := range tests {
+		scheme, protocol := mapBackendProtocol(createIngress(nil, map[string]string{BACKEND_PROTOCOL_ANNOTATION: annotation}))
+		if scheme != expected.scheme || protocol != expected.protocol {
+			t.Errorf("Expected %q to give %s %d, got %s %d", annotation, expected.scheme, expected.protocol, scheme, protocol)
+		}
+	}
+}
+
+type fakeTLSSource struct {
+	secrets    map[Object]*apicorev1.Secret
+	configMaps map[Object]*apicorev1.ConfigMap
+}
+
+func (s fakeTLSSource) getSecret(object Object) (*apicorev1.Secret, error) {
+	if secret, exists := s.secrets[object]; exists {
+		return secret, nil
+	}
+	return nil, errors.New("secret not found")
+}
+
+func (s fakeTLSSource) getConfigMap(object Object) (*apicorev1.ConfigMap, error) {
+	if configMap, exists := s.configMaps[object]; exists {
+		return configMap, nil
+	}
+	return nil, errors.New("config map not found")
+}
+
+func TestBackendTLS(t *testing.T) {
+	annotations := map[string]string{
+		BACKEND_CA_ANNOTATION:   "configmap/backend-ca",
+		BACKEND_SNI_ANNOTATION:  "app.testing.svc",
+		BACKEND_CERT_ANNOTATION: "backend-client",
+	}
+	if ref := mapBackendTLS(createIngress(nil, annotations), "http"); ref != nil {
+		t.Errorf("Expected backend tls of cleartext backends to be ignored, got %v", ref)
+	}
+	ref := mapBackendTLS(createIngress(nil, annotations), "https")
+	expected := BackendTLS{
+		ServerName: "app.testing.svc",
+		CA:         Resource{Kind: KIND_CONFIGMAP, Object: Object{Name: "backend-ca", Namespace: "testing"}},
+		ClientCert: Object{Name: "backend-client", Namespace: "testing"},
+	}
+	if ref == nil || *ref != expected {
+		t.Errorf("Expected backend tls %v, got %v", expected, ref)
+	}
+	if invalid := mapBackendTLS(createIngress(nil, map[string]string{BACKEND_CA_ANNOTATION: "backend-ca"}), "https"); invalid == nil || invalid.CA != (Resource{}) {
+		t.Errorf("Expected invalid CA reference to be ignored, got %v", invalid)
+	}
+
+	server := httptest.NewTLSServer(nil)
+	server.Close()
+	source := fakeTLSSource{configMaps: map[Object]*apicorev1.ConfigMap{
+		{Name: "backend-ca", Namespace: "testing"}: {Data: map[string]string{
+			CA_BUNDLE_KEY: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})),
+		}},
+	}}
+
+	app := Object{Name: "app", Namespace: "testing"}
+	key := HostMatch{Kind: KIND_INGRESS, Object: app, HostName: "app.example.com"}
+	ingress := Ingress{
+		Scheme:     "https",
+		BackendTLS: ref,
+		Paths:      []IngressPath{{Path: "/", PathType: util.PATH_TYPE_PREFIX, Services: []ServiceRef{{Name: "app", Port: 443}}}},
+	}
+	services := map[PortMatch]Service{{Object: app, Port: 443}: {Port: 443, TargetPort: 8443}}
+	endpoints := map[Object][]Endpoint{app: {{Address: "10.0.0.1", Port: 8443, Ready: true}}}
+
+	first := mergeFrontends(&util.Config{}, nil, map[HostMatch]Ingress{key: ingress}, services, endpoints, source)
+	route := first["app.example.com"].Routes[0]
+	if route.Backends[0].Url.Scheme != "https" {
+		t.Errorf("Expected https backend, got %s", route.Backends[0].Url)
+	}
+	// the missing client certificate is left out, the CA is still used
+	if route.TLS == nil || route.TLS.CA != "configmap/backend-ca" || route.TLS.Config().RootCAs == nil || len(route.TLS.Config().Certificates) != 0 {
+		t.Errorf("Expected backend tls with CA and without client certificate, got %v", route.TLS)
+	}
+
+	second := mergeFrontends(&util.Config{}, first, map[HostMatch]Ingress{key: ingress}, services, endpoints, source)
+	if second["app.example.com"].Routes[0].Balancer != route.Balancer || second["app.example.com"].Routes[0].TLS != route.TLS {
+		t.Error("Expected balancer and tls config to be kept while the CA is unchanged")
+	}
+
+	if third := mergeFrontends(&util.Config{}, second, map[HostMatch]Ingress{key: ingress}, services, endpoints, nil); third["app.example.com"].Routes[0].Balancer == route.Balancer {
+		t.Error("Expected balancer to be replaced when the CA is no longer read")
+	}
+}
+
+func TestPassthrough(t *testing.T) {
+	app := Object{Name: "app", Namespace: "testing"}
+	ingresses := map[HostMatch]Ingress{
+		{Kind: KIND_INGRESS, Object: app, HostName: "app.example.com"}: {
+			Scheme:      "http",
+			Passthrough: true,
+			Paths:       []IngressPath{{Path: "/", PathType: util.PATH_TYPE_PREFIX, Services: []ServiceRef{{Name: "app", Port: 443}}}},
+		},
+	}
+	services := map[PortMatch]Service{{Object: app, Port: 443}: {Port: 443, TargetPort: 8443}}
+	endpoints := map[Object][]Endpoint{app: {{Address: "10.0.0.1", Port: 8443, Ready: true}}}
+
+	frontend := mergeFrontends(&util.Config{}, nil, ingresses, services, endpoints, nil)["app.example.com"]
+	if frontend == nil || frontend.Action != util.BACKEND_ACTION_PASSTHROUGH {
+		t.Fatalf("Expected passthrough frontend, got %v", frontend)
+	}
+	if servers := frontend.Routes[0].Balancer.Servers(); len(servers) != 1 || servers[0].Host != "10.0.0.1:8443" {
+		t.Errorf("Expected passthrough backends to come from the endpoints, got %v", servers)
+	}
+}
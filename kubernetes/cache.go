@@ -0,0 +1,448 @@
+package kubernetes
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/dbcdk/shelob/util"
+	"go.uber.org/zap"
+	apicorev1 "k8s.io/api/core/v1"
+	apidiscoveryv1 "k8s.io/api/discovery/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	listerscorev1 "k8s.io/client-go/listers/core/v1"
+	listersdiscoveryv1 "k8s.io/client-go/listers/discovery/v1"
+	listersnetworkingv1 "k8s.io/client-go/listers/networking/v1"
+	"k8s.io/client-go/tools/cache"
+	gatewayv1 "sigs.k8s.io/gateway-api/apis/v1"
+	gatewayclientset "sigs.k8s.io/gateway-api/pkg/client/clientset/versioned"
+	gatewayinformers "sigs.k8s.io/gateway-api/pkg/client/informers/externalversions"
+	listersgatewayv1 "sigs.k8s.io/gateway-api/pkg/client/listers/apis/v1"
+)
+
+// FrontendCache builds frontends from the shared informer caches and keeps track of which ingresses, routes and services
+// changed since the last update, so only the hosts touched by a change are recomputed
+type FrontendCache struct {
+	config              *util.Config
+	informerFactory     informers.SharedInformerFactory
+	ingressLister       listersnetworkingv1.IngressLister
+	ingressClassLister  listersnetworkingv1.IngressClassLister
+	serviceLister       listerscorev1.ServiceLister
+	endpointSliceLister listersdiscoveryv1.EndpointSliceLister
+	secretLister        listerscorev1.SecretLister
+	configMapLister     listerscorev1.ConfigMapLister
+	synced              []cache.InformerSynced
+
+	statusWriter           *routeStatusWriter
+	gatewayInformerFactory gatewayinformers.SharedInformerFactory
+	gatewayClassLister     listersgatewayv1.GatewayClassLister
+	gatewayLister          listersgatewayv1.GatewayLister
+	httpRouteLister        listersgatewayv1.HTTPRouteLister
+
+	dirtyMutex     sync.Mutex
+	dirtyResources map[Resource]bool
+	dirtyServices  map[Object]bool
+	dirtySources   map[Resource]bool
+	dirtyAll       bool
+
+	updateMutex sync.Mutex
+	resources   map[Resource]map[string]Ingress
+	frontends   map[string]*util.Frontend
+}
+
+func NewFrontendCache(config *util.Config) (*FrontendCache, error) {
+	informerFactory, err := GetInformerFactory(config.Kubeconfig, apicorev1.NamespaceAll)
+	if err != nil {
+		return nil, err
+	}
+
+	var gatewayClient gatewayclientset.Interface
+	if config.GatewayControllerName != "" {
+		gatewayClient, err = GetGatewayClient(config.Kubeconfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return newFrontendCache(config, informerFactory, gatewayClient), nil
+}
+
+func newFrontendCache(config *util.Config, informerFactory informers.SharedInformerFactory, gatewayClient gatewayclientset.Interface) *FrontendCache {
+	fc := &FrontendCache{
+		config:              config,
+		informerFactory:     informerFactory,
+		ingressLister:       informerFactory.Networking().V1().Ingresses().Lister(),
+		serviceLister:       informerFactory.Core().V1().Services().Lister(),
+		endpointSliceLister: informerFactory.Discovery().V1().EndpointSlices().Lister(),
+		dirtyResources:      make(map[Resource]bool),
+		dirtyServices:       make(map[Object]bool),
+		dirtySources:        make(map[Resource]bool),
+		dirtyAll:            true,
+		resources:           make(map[Resource]map[string]Ingress),
+	}
+	fc.synced = []cache.InformerSynced{
+		informerFactory.Networking().V1().Ingresses().Informer().HasSynced,
+		informerFactory.Core().V1().Services().Informer().HasSynced,
+		informerFactory.Discovery().V1().EndpointSlices().Informer().HasSynced,
+	}
+	// only watch IngressClasses when filtering on one, to not require access to them otherwise
+	if config.IngressClass != "" {
+		fc.ingressClassLister = informerFactory.Networking().V1().IngressClasses().Lister()
+		fc.synced = append(fc.synced, informerFactory.Networking().V1().IngressClasses().Informer().HasSynced)
+	}
+	// secrets and config maps of backend tls are only watched when enabled, watching them requires access to all of them
+	if config.BackendTLSSources {
+		fc.secretLister = informerFactory.Core().V1().Secrets().Lister()
+		fc.configMapLister = informerFactory.Core().V1().ConfigMaps().Lister()
+		fc.synced = append(fc.synced,
+			informerFactory.Core().V1().Secrets().Informer().HasSynced,
+			informerFactory.Core().V1().ConfigMaps().Informer().HasSynced,
+		)
+	}
+	// likewise the gateway api is only watched when a controller name is configured
+	if gatewayClient != nil {
+		gatewayInformerFactory := GetGatewayInformerFactory(gatewayClient)
+		fc.statusWriter = newRouteStatusWriter(gatewayClient, config.GatewayControllerName)
+		fc.gatewayInformerFactory = gatewayInformerFactory
+		fc.gatewayClassLister = gatewayInformerFactory.Gateway().V1().GatewayClasses().Lister()
+		fc.gatewayLister = gatewayInformerFactory.Gateway().V1().Gateways().Lister()
+		fc.httpRouteLister = gatewayInformerFactory.Gateway().V1().HTTPRoutes().Lister()
+		fc.synced = append(fc.synced,
+			gatewayInformerFactory.Gateway().V1().GatewayClasses().Informer().HasSynced,
+			gatewayInformerFactory.Gateway().V1().Gateways().Informer().HasSynced,
+			gatewayInformerFactory.Gateway().V1().HTTPRoutes().Informer().HasSynced,
+		)
+	}
+
+	return fc
+}
+
+func (fc *FrontendCache) hasSynced() bool {
+	for _, synced := range fc.synced {
+		if !synced() {
+			return false
+		}
+	}
+	return true
+}
+
+func (fc *FrontendCache) markResource(resource Resource) {
+	fc.dirtyMutex.Lock()
+	defer fc.dirtyMutex.Unlock()
+	fc.dirtyResources[resource] = true
+}
+
+func (fc *FrontendCache) markService(object Object) {
+	fc.dirtyMutex.Lock()
+	defer fc.dirtyMutex.Unlock()
+	fc.dirtyServices[object] = true
+}
+
+func (fc *FrontendCache) markSource(source Resource) {
+	fc.dirtyMutex.Lock()
+	defer fc.dirtyMutex.Unlock()
+	fc.dirtySources[source] = true
+}
+
+func (fc *FrontendCache) markAll() {
+	fc.dirtyMutex.Lock()
+	defer fc.dirtyMutex.Unlock()
+	fc.dirtyAll = true
+}
+
+func (fc *FrontendCache) takeDirty() (resources map[Resource]bool, services map[Object]bool, sources map[Resource]bool, all bool) {
+	fc.dirtyMutex.Lock()
+	defer fc.dirtyMutex.Unlock()
+	resources, services, sources, all = fc.dirtyResources, fc.dirtyServices, fc.dirtySources, fc.dirtyAll
+	fc.dirtyResources = make(map[Resource]bool)
+	fc.dirtyServices = make(map[Object]bool)
+	fc.dirtySources = make(map[Resource]bool)
+	fc.dirtyAll = false
+	return
+}
+
+// UpdateFrontends returns the complete frontend map, recomputing only the hosts affected by changes since the last call.
+// The returned map is never modified afterwards, changes are applied to a copy
+func (fc *FrontendCache) UpdateFrontends() (map[string]*util.Frontend, error) {
+	fc.updateMutex.Lock()
+	defer fc.updateMutex.Unlock()
+
+	if !fc.hasSynced() {
+		return nil, errors.New("waiting for kubernetes informer caches to sync")
+	}
+
+	dirtyResources, dirtyServices, dirtySources, all := fc.takeDirty()
+	if fc.frontends == nil {
+		all = true
+	}
+
+	hosts := make(map[string]bool)
+	if all {
+		if err := fc.reloadResources(hosts); err != nil {
+			fc.markAll()
+			return nil, err
+		}
+	} else {
+		for resource := range dirtyResources {
+			fc.reloadResource(resource, hosts)
+		}
+		for object := range dirtyServices {
+			// routes report unresolved backends in their status, so they are remapped when a service they refer to changes
+			for _, resource := range fc.serviceHosts(object, hosts) {
+				if resource.Kind == KIND_HTTPROUTE {
+					fc.reloadResource(resource, hosts)
+				}
+			}
+		}
+		for source := range dirtySources {
+			fc.sourceHosts(source, hosts)
+		}
+	}
+
+	frontends := make(map[string]*util.Frontend, len(fc.frontends))
+	if !all {
+		for host, frontend := range fc.frontends {
+			frontends[host] = frontend
+		}
+	}
+	built := fc.buildFrontends(hosts)
+	for host := range hosts {
+		if frontend, exists := built[host]; exists {
+			frontends[host] = frontend
+		} else {
+			delete(frontends, host)
+		}
+	}
+
+	log.Debug("Recomputed frontends",
+		zap.Bool("full", all),
+		zap.Int("hosts", len(hosts)),
+		zap.Int("frontends", len(frontends)),
+	)
+
+	fc.frontends = frontends
+	return frontends, nil
+}
+
+func (fc *FrontendCache) isDefaultIngressClass() bool {
+	if fc.ingressClassLister == nil {
+		return false
+	}
+	class, err := fc.ingressClassLister.Get(fc.config.IngressClass)
+	if err != nil {
+		return false
+	}
+	return class.Annotations[networkingv1.AnnotationIsDefaultIngressClass] == "true"
+}
+
+func (fc *FrontendCache) mapIngress(ingress *networkingv1.Ingress, isDefaultClass bool) map[string]Ingress {
+	in := IngressCompat{
+		v1: ingress,
+	}
+	if !ownsIngress(in, fc.config.IngressClass, isDefaultClass) {
+		return nil
+	}
+	return mapIngress(in)
+}
+
+// reloadResources replaces all known ingresses and routes with the content of the cache, every host is marked as affected
+func (fc *FrontendCache) reloadResources(hosts map[string]bool) error {
+	ingresses, err := fc.ingressLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	resources := make(map[Resource]map[string]Ingress)
+	isDefaultClass := fc.isDefaultIngressClass()
+	for _, i := range ingresses {
+		if mapped := fc.mapIngress(i, isDefaultClass); len(mapped) > 0 {
+			resources[Resource{Kind: KIND_INGRESS, Object: Object{Name: i.Name, Namespace: i.Namespace}}] = mapped
+		}
+	}
+
+	if fc.httpRouteLister != nil {
+		routes, err := fc.httpRouteLister.List(labels.Everything())
+		if err != nil {
+			return err
+		}
+		gateways := fc.ownedGateways()
+		for _, r := range routes {
+			if mapped := fc.mapHTTPRoute(r, gateways); len(mapped) > 0 {
+				resources[Resource{Kind: KIND_HTTPROUTE, Object: Object{Name: r.Name, Namespace: r.Namespace}}] = mapped
+			}
+		}
+	}
+
+	fc.resources = resources
+	for _, mapped := range fc.resources {
+		for host := range mapped {
+			hosts[host] = true
+		}
+	}
+
+	return nil
+}
+
+// reloadResource refreshes a single ingress or route from the cache, hosts it served before and after the change are
+// marked as affected
+func (fc *FrontendCache) reloadResource(resource Resource, hosts map[string]bool) {
+	for host := range fc.resources[resource] {
+		hosts[host] = true
+	}
+	delete(fc.resources, resource)
+
+	var mapped map[string]Ingress
+	var err error
+	switch resource.Kind {
+	case KIND_INGRESS:
+		var ingress *networkingv1.Ingress
+		if ingress, err = fc.ingressLister.Ingresses(resource.Object.Namespace).Get(resource.Object.Name); err == nil {
+			mapped = fc.mapIngress(ingress, fc.isDefaultIngressClass())
+		}
+	case KIND_HTTPROUTE:
+		var route *gatewayv1.HTTPRoute
+		if route, err = fc.httpRouteLister.HTTPRoutes(resource.Object.Namespace).Get(resource.Object.Name); err == nil {
+			mapped = fc.mapHTTPRoute(route, fc.ownedGateways())
+		}
+	}
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			log.Warn("Failed to read object from cache",
+				zap.String("kind", resource.Kind),
+				zap.String("name", resource.Object.Name),
+				zap.String("namespace", resource.Object.Namespace),
+				zap.String("error", err.Error()),
+			)
+		}
+		return
+	}
+
+	if len(mapped) > 0 {
+		fc.resources[resource] = mapped
+		for host := range mapped {
+			hosts[host] = true
+		}
+	}
+}
+
+func (fc *FrontendCache) ownedGateways() map[Object]*gatewayv1.Gateway {
+	classes, err := fc.gatewayClassLister.List(labels.Everything())
+	if err != nil {
+		return nil
+	}
+	gateways, err := fc.gatewayLister.List(labels.Everything())
+	if err != nil {
+		return nil
+	}
+	return ownedGateways(fc.config.GatewayControllerName, classes, gateways)
+}
+
+// mapHTTPRoute maps a route from the cache and queues its status to be written back to the api when it changed
+func (fc *FrontendCache) mapHTTPRoute(route *gatewayv1.HTTPRoute, gateways map[Object]*gatewayv1.Gateway) map[string]Ingress {
+	mapped, statuses := mapHTTPRoute(route, gateways, func(service Object) bool {
+		_, err := fc.serviceLister.Services(service.Namespace).Get(service.Name)
+		return err == nil
+	})
+	fc.statusWriter.update(route, statuses)
+	return mapped
+}
+
+// serviceHosts marks every host with a path pointing at the given service as affected, and returns the ingresses and
+// routes referring to it
+func (fc *FrontendCache) serviceHosts(service Object, hosts map[string]bool) []Resource {
+	resources := make([]Resource, 0)
+	for resource, mapped := range fc.resources {
+		if resource.Object.Namespace != service.Namespace {
+			continue
+		}
+		refers := false
+		for host, ingress := range mapped {
+			for _, p := range ingress.Paths {
+				for _, ref := range p.Services {
+					if ref.Name == service.Name {
+						hosts[host] = true
+						refers = true
+					}
+				}
+			}
+		}
+		if refers {
+			resources = append(resources, resource)
+		}
+	}
+	return resources
+}
+
+// sourceHosts marks every host with https backends using the CA bundle or client certificate in the given secret or
+// config map as affected
+func (fc *FrontendCache) sourceHosts(source Resource, hosts map[string]bool) {
+	for _, mapped := range fc.resources {
+		for host, ingress := range mapped {
+			if ref := ingress.BackendTLS; ref != nil && (ref.CA == source || (source.Kind == KIND_SECRET && ref.ClientCert == source.Object)) {
+				hosts[host] = true
+			}
+		}
+	}
+}
+
+// buildFrontends merges the frontends of the given hosts, reading only the services and endpoints they refer to
+func (fc *FrontendCache) buildFrontends(hosts map[string]bool) map[string]*util.Frontend {
+	ingresses := make(map[HostMatch]Ingress)
+	services := make(map[PortMatch]Service)
+	endpoints := make(map[Object][]Endpoint)
+
+	for resource, mapped := range fc.resources {
+		for host, ingress := range mapped {
+			if !hosts[host] {
+				continue
+			}
+			ingresses[HostMatch{Kind: resource.Kind, Object: resource.Object, HostName: host}] = ingress
+
+			for _, p := range ingress.Paths {
+				for _, ref := range p.Services {
+					service := Object{Name: ref.Name, Namespace: resource.Object.Namespace}
+					if _, exists := endpoints[service]; exists {
+						continue
+					}
+					endpoints[service] = fc.serviceEndpoints(service)
+					if s, err := fc.serviceLister.Services(service.Namespace).Get(service.Name); err == nil {
+						for n, ss := range mapService(*s) {
+							services[n] = ss
+						}
+					}
+				}
+			}
+		}
+	}
+
+	var source tlsSource
+	if fc.secretLister != nil {
+		source = fc
+	}
+	return mergeFrontends(fc.config, fc.frontends, ingresses, services, endpoints, source)
+}
+
+func (fc *FrontendCache) serviceEndpoints(service Object) []Endpoint {
+	out := make([]Endpoint, 0)
+	slices, err := fc.endpointSliceLister.EndpointSlices(service.Namespace).List(labels.SelectorFromSet(labels.Set{
+		apidiscoveryv1.LabelServiceName: service.Name,
+	}))
+	if err != nil {
+		return out
+	}
+
+	for _, slice := range slices {
+		out = append(out, mapEndpointSlice(*slice)...)
+	}
+	return out
+}
+
+func (fc *FrontendCache) getSecret(object Object) (*apicorev1.Secret, error) {
+	return fc.secretLister.Secrets(object.Namespace).Get(object.Name)
+}
+
+func (fc *FrontendCache) getConfigMap(object Object) (*apicorev1.ConfigMap, error) {
+	return fc.configMapLister.ConfigMaps(object.Namespace).Get(object.Name)
+}
@@ -0,0 +1,173 @@
+package kubernetes
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dbcdk/shelob/util"
+	apicorev1 "k8s.io/api/core/v1"
+	apidiscoveryv1 "k8s.io/api/discovery/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	machinerymetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func createHostIngress(name string, host string, service string) *networkingv1.Ingress {
+	return &networkingv1.Ingress{
+		ObjectMeta: machinerymetav1.ObjectMeta{Name: name, Namespace: "testing"},
+		Spec: networkingv1.IngressSpec{
+			Rules: []networkingv1.IngressRule{{
+				Host: host,
+				IngressRuleValue: networkingv1.IngressRuleValue{HTTP: &networkingv1.HTTPIngressRuleValue{
+					Paths: []networkingv1.HTTPIngressPath{{
+						Path: "/",
+						Backend: networkingv1.IngressBackend{Service: &networkingv1.IngressServiceBackend{
+							Name: service,
+							Port: networkingv1.ServiceBackendPort{Number: 80},
+						}},
+					}},
+				}},
+			}},
+		},
+	}
+}
+
+func createEndpointSlice(service string, address string) *apidiscoveryv1.EndpointSlice {
+	port := int32(80)
+	return &apidiscoveryv1.EndpointSlice{
+		ObjectMeta: machinerymetav1.ObjectMeta{
+			Name:      service + "-abc",
+			Namespace: "testing",
+			Labels:    map[string]string{apidiscoveryv1.LabelServiceName: service},
+		},
+		AddressType: apidiscoveryv1.AddressTypeIPv4,
+		Ports:       []apidiscoveryv1.EndpointPort{{Port: &port}},
+		Endpoints:   []apidiscoveryv1.Endpoint{{Addresses: []string{address}}},
+	}
+}
+
+func TestFrontendCacheIncrementalUpdate(t *testing.T) {
+	port := apicorev1.ServicePort{Port: 80, TargetPort: intstr.FromInt32(80)}
+	a, b := createService("a", port), createService("b", port)
+	clients := fake.NewSimpleClientset(
+		createHostIngress("a", "a.example.com", "a"),
+		createHostIngress("b", "b.example.com", "b"),
+		&a, &b,
+		createEndpointSlice("a", "10.0.0.1"),
+		createEndpointSlice("b", "10.0.0.2"),
+	)
+	informerFactory := informers.NewSharedInformerFactory(clients, 0)
+	fc := newFrontendCache(&util.Config{}, informerFactory, nil)
+
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	informerFactory.Start(stopChan)
+	cache.WaitForCacheSync(stopChan, fc.synced...)
+
+	frontends, err := fc.UpdateFrontends()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frontends) != 2 || len(frontends["a.example.com"].Backends) != 1 || len(frontends["b.example.com"].Backends) != 1 {
+		t.Fatalf("Expected two frontends with one backend each, got %v", frontends)
+	}
+	untouched := frontends["b.example.com"]
+
+	updated := createEndpointSlice("a", "10.0.0.3")
+	updated.Endpoints = append(updated.Endpoints, apidiscoveryv1.Endpoint{Addresses: []string{"10.0.0.4"}})
+	if _, err := clients.DiscoveryV1().EndpointSlices("testing").Update(context.Background(), updated, machinerymetav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := clients.NetworkingV1().Ingresses("testing").Delete(context.Background(), "b", machinerymetav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		slice, _ := fc.endpointSliceLister.EndpointSlices("testing").Get("a-abc")
+		_, err := fc.ingressLister.Ingresses("testing").Get("b")
+		return slice != nil && len(slice.Endpoints) == 2 && err != nil
+	})
+	fc.markService(Object{Name: "a", Namespace: "testing"})
+	fc.markResource(Resource{Kind: KIND_INGRESS, Object: Object{Name: "b", Namespace: "testing"}})
+
+	next, err := fc.UpdateFrontends()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(next["a.example.com"].Backends) != 2 {
+		t.Errorf("Expected frontend of changed service to be recomputed, got %v", next["a.example.com"])
+	}
+	if _, exists := next["b.example.com"]; exists {
+		t.Error("Expected frontend of deleted ingress to be removed")
+	}
+	if frontends["b.example.com"] != untouched || len(frontends["a.example.com"].Backends) != 1 {
+		t.Error("Expected previously returned frontends to be left unmodified")
+	}
+
+	fc.markService(Object{Name: "unrelated", Namespace: "testing"})
+	last, err := fc.UpdateFrontends()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last["a.example.com"] != next["a.example.com"] {
+		t.Error("Expected frontend not affected by a change to be reused")
+	}
+}
+
+func TestFrontendCacheBackendTLS(t *testing.T) {
+	port := apicorev1.ServicePort{Port: 80, TargetPort: intstr.FromInt32(80)}
+	a := createService("a", port)
+	ingress := createHostIngress("a", "a.example.com", "a")
+	ingress.Annotations = map[string]string{BACKEND_PROTOCOL_ANNOTATION: "https", BACKEND_CA_ANNOTATION: "secret/backend-ca"}
+	secret := &apicorev1.Secret{ObjectMeta: machinerymetav1.ObjectMeta{Name: "backend-ca", Namespace: "testing"}}
+	clients := fake.NewSimpleClientset(ingress, &a, createEndpointSlice("a", "10.0.0.1"), secret)
+	informerFactory := informers.NewSharedInformerFactory(clients, 0)
+	fc := newFrontendCache(&util.Config{BackendTLSSources: true}, informerFactory, nil)
+
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	informerFactory.Start(stopChan)
+	cache.WaitForCacheSync(stopChan, fc.synced...)
+
+	frontends, err := fc.UpdateFrontends()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backendTLS := frontends["a.example.com"].Routes[0].TLS; backendTLS == nil || backendTLS.Config().RootCAs != nil {
+		t.Fatalf("Expected backend tls without the missing CA, got %v", backendTLS)
+	}
+
+	server := httptest.NewTLSServer(nil)
+	server.Close()
+	secret.Data = map[string][]byte{CA_BUNDLE_KEY: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})}
+	if _, err := clients.CoreV1().Secrets("testing").Update(context.Background(), secret, machinerymetav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		s, _ := fc.secretLister.Secrets("testing").Get("backend-ca")
+		return s != nil && len(s.Data) > 0
+	})
+	fc.markSource(Resource{Kind: KIND_SECRET, Object: Object{Name: "backend-ca", Namespace: "testing"}})
+
+	next, err := fc.UpdateFrontends()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backendTLS := next["a.example.com"].Routes[0].TLS; backendTLS == nil || backendTLS.Config().RootCAs == nil {
+		t.Errorf("Expected frontend to be recomputed with the CA of the changed secret, got %v", backendTLS)
+	}
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	for i := 0; i < 100 && !condition(); i++ {
+		<-time.After(10 * time.Millisecond)
+	}
+	if !condition() {
+		t.Fatal("Timed out waiting for condition")
+	}
+}
@@ -0,0 +1,555 @@
+package kubernetes
+
+import (
+	"context"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dbcdk/shelob/util"
+	"go.uber.org/zap"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	machinerymetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/retry"
+	gatewayv1 "sigs.k8s.io/gateway-api/apis/v1"
+	gatewayclientset "sigs.k8s.io/gateway-api/pkg/client/clientset/versioned"
+	gatewayinformers "sigs.k8s.io/gateway-api/pkg/client/informers/externalversions"
+)
+
+func GetGatewayClient(config *rest.Config) (*gatewayclientset.Clientset, error) {
+	clients, err := gatewayclientset.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return clients, nil
+}
+
+func GetGatewayInformerFactory(clients gatewayclientset.Interface) gatewayinformers.SharedInformerFactory {
+	return gatewayinformers.NewSharedInformerFactory(clients, 0)
+}
+
+// RouteStatus is the outcome of mapping an HTTPRoute for one of its parent gateways. A route is partially invalid when
+// rules or hostnames it is accepted with are left out, as they are not supported
+type RouteStatus struct {
+	ParentRef        gatewayv1.ParentReference
+	Accepted         bool
+	Reason           gatewayv1.RouteConditionReason
+	ResolvedRefs     bool
+	RefsReason       gatewayv1.RouteConditionReason
+	PartiallyInvalid bool
+}
+
+// ownedGateways returns the gateways of a class handled by the given controller
+func ownedGateways(controllerName string, classes []*gatewayv1.GatewayClass, gateways []*gatewayv1.Gateway) map[Object]*gatewayv1.Gateway {
+	ownedClasses := make(map[string]bool)
+	for _, c := range classes {
+		if string(c.Spec.ControllerName) == controllerName {
+			ownedClasses[c.Name] = true
+		}
+	}
+
+	out := make(map[Object]*gatewayv1.Gateway)
+	for _, g := range gateways {
+		if ownedClasses[string(g.Spec.GatewayClassName)] {
+			out[Object{Name: g.Name, Namespace: g.Namespace}] = g
+		}
+	}
+	return out
+}
+
+// mapHTTPRoute maps a route attached to one or more of the given gateways into the same per-host rules as an ingress,
+// along with the status of the route for each of these gateways
+func mapHTTPRoute(route *gatewayv1.HTTPRoute, gateways map[Object]*gatewayv1.Gateway, serviceExists func(Object) bool) (map[string]Ingress, []RouteStatus) {
+	out := make(map[string]Ingress)
+	statuses := make([]RouteStatus, 0)
+
+	paths, dropped, resolvedRefs, refsReason := mapHTTPRouteRules(route, serviceExists)
+
+	routeHostnames := make([]string, 0, len(route.Spec.Hostnames))
+	for _, h := range route.Spec.Hostnames {
+		routeHostnames = append(routeHostnames, string(h))
+	}
+
+	for _, parentRef := range route.Spec.ParentRefs {
+		if parentRef.Group != nil && string(*parentRef.Group) != gatewayv1.GroupName {
+			continue
+		}
+		if parentRef.Kind != nil && string(*parentRef.Kind) != "Gateway" {
+			continue
+		}
+		namespace := route.Namespace
+		if parentRef.Namespace != nil {
+			namespace = string(*parentRef.Namespace)
+		}
+		gateway, owned := gateways[Object{Name: string(parentRef.Name), Namespace: namespace}]
+		if !owned {
+			continue
+		}
+
+		status := RouteStatus{
+			ParentRef:    parentRef,
+			ResolvedRefs: resolvedRefs,
+			RefsReason:   refsReason,
+		}
+
+		allowed := false
+		plainHTTP := false
+		hostnames := make(map[string]bool)
+		for _, listener := range gateway.Spec.Listeners {
+			if parentRef.SectionName != nil && *parentRef.SectionName != listener.Name {
+				continue
+			}
+			if parentRef.Port != nil && *parentRef.Port != listener.Port {
+				continue
+			}
+			if !listenerAllowsRoute(listener, gateway.Namespace, route.Namespace) {
+				continue
+			}
+			allowed = true
+
+			var listenerHostname string
+			if listener.Hostname != nil {
+				listenerHostname = string(*listener.Hostname)
+			}
+			matched := intersectHostnames(routeHostnames, listenerHostname)
+			for _, h := range matched {
+				hostnames[h] = true
+			}
+			if len(matched) > 0 && listener.Protocol == gatewayv1.HTTPProtocolType {
+				plainHTTP = true
+			}
+		}
+
+		// wildcard hostnames are not supported by the frontends, the route is only served on its other hostnames
+		wildcards := false
+		for host := range hostnames {
+			if strings.HasPrefix(host, "*") {
+				log.Debug("Ignoring wildcard hostname of HTTPRoute",
+					zap.String("name", route.Name),
+					zap.String("namespace", route.Namespace),
+					zap.String("host", host))
+				delete(hostnames, host)
+				wildcards = true
+			}
+		}
+
+		switch {
+		case !allowed:
+			status.Reason = gatewayv1.RouteReasonNotAllowedByListeners
+		case len(hostnames) == 0 && !wildcards:
+			status.Reason = gatewayv1.RouteReasonNoMatchingListenerHostname
+		case len(hostnames) == 0 || (len(paths) == 0 && dropped):
+			status.Reason = gatewayv1.RouteReasonUnsupportedValue
+		default:
+			status.Accepted = true
+			status.Reason = gatewayv1.RouteReasonAccepted
+			status.PartiallyInvalid = dropped || wildcards
+		}
+		statuses = append(statuses, status)
+
+		if !status.Accepted {
+			continue
+		}
+
+		// routes attached to a plain http listener are served without redirecting to https
+		policy := uint16(util.PLAIN_HTTP_REDIRECT)
+		if plainHTTP {
+			policy = util.PLAIN_HTTP_ALLOW
+		}
+		for host := range hostnames {
+			if existing, exists := out[host]; exists && existing.PlainHTTPPolicy == util.PLAIN_HTTP_ALLOW {
+				policy = util.PLAIN_HTTP_ALLOW
+			}
+			out[host] = Ingress{
+				Scheme:          "http",
+				PlainHTTPPolicy: policy,
+				Paths:           paths,
+			}
+		}
+	}
+
+	return out, statuses
+}
+
+func listenerAllowsRoute(listener gatewayv1.Listener, gatewayNamespace string, routeNamespace string) bool {
+	if listener.Protocol != gatewayv1.HTTPProtocolType && listener.Protocol != gatewayv1.HTTPSProtocolType {
+		return false
+	}
+
+	if listener.AllowedRoutes != nil && len(listener.AllowedRoutes.Kinds) > 0 {
+		kindAllowed := false
+		for _, k := range listener.AllowedRoutes.Kinds {
+			if string(k.Kind) == KIND_HTTPROUTE && (k.Group == nil || string(*k.Group) == gatewayv1.GroupName) {
+				kindAllowed = true
+			}
+		}
+		if !kindAllowed {
+			return false
+		}
+	}
+
+	// namespace selectors are not supported, only Same (the default) and All
+	from := gatewayv1.NamespacesFromSame
+	if listener.AllowedRoutes != nil && listener.AllowedRoutes.Namespaces != nil && listener.AllowedRoutes.Namespaces.From != nil {
+		from = *listener.AllowedRoutes.Namespaces.From
+	}
+	switch from {
+	case gatewayv1.NamespacesFromAll:
+		return true
+	case gatewayv1.NamespacesFromSame:
+		return gatewayNamespace == routeNamespace
+	default:
+		return false
+	}
+}
+
+// intersectHostnames returns the hostnames of a route accepted by a listener, a wildcard on either side is narrowed to
+// the more specific hostname
+func intersectHostnames(routeHostnames []string, listenerHostname string) []string {
+	if listenerHostname == "" {
+		return routeHostnames
+	}
+	if len(routeHostnames) == 0 {
+		return []string{listenerHostname}
+	}
+
+	out := make([]string, 0)
+	for _, h := range routeHostnames {
+		switch {
+		case h == listenerHostname:
+			out = append(out, h)
+		case wildcardMatches(listenerHostname, h):
+			out = append(out, h)
+		case wildcardMatches(h, listenerHostname):
+			out = append(out, listenerHostname)
+		}
+	}
+	return out
+}
+
+func wildcardMatches(wildcard string, hostname string) bool {
+	if !strings.HasPrefix(wildcard, "*.") {
+		return false
+	}
+	suffix := wildcard[1:]
+	return strings.HasSuffix(hostname, suffix) && len(hostname) > len(suffix)
+}
+
+// mapHTTPRouteRules maps the rules of a route to paths, unsupported matches are left out rather than widened. Filters
+// are not supported either, rules with filters are left out rather than served without them. Whether anything was left
+// out is returned along with the paths
+func mapHTTPRouteRules(route *gatewayv1.HTTPRoute, serviceExists func(Object) bool) ([]IngressPath, bool, bool, gatewayv1.RouteConditionReason) {
+	paths := make([]IngressPath, 0)
+	dropped := false
+	resolvedRefs := true
+	refsReason := gatewayv1.RouteReasonResolvedRefs
+
+	for _, rule := range route.Spec.Rules {
+		if hasFilters(rule) {
+			log.Warn("Ignoring HTTPRoute rule with unsupported filters",
+				zap.String("name", route.Name),
+				zap.String("namespace", route.Namespace))
+			dropped = true
+			continue
+		}
+
+		services := make([]ServiceRef, 0)
+		for _, ref := range rule.BackendRefs {
+			if (ref.Group != nil && *ref.Group != "") || (ref.Kind != nil && *ref.Kind != "Service") {
+				resolvedRefs, refsReason = false, gatewayv1.RouteReasonInvalidKind
+				continue
+			}
+			if ref.Namespace != nil && string(*ref.Namespace) != route.Namespace {
+				// ReferenceGrants are not supported, so only backends in the namespace of the route are permitted
+				resolvedRefs, refsReason = false, gatewayv1.RouteReasonRefNotPermitted
+				continue
+			}
+			if ref.Port == nil || !serviceExists(Object{Name: string(ref.Name), Namespace: route.Namespace}) {
+				resolvedRefs, refsReason = false, gatewayv1.RouteReasonBackendNotFound
+			}
+
+			weight := 1
+			if ref.Weight != nil {
+				weight = int(*ref.Weight)
+			}
+			if weight == 0 || ref.Port == nil {
+				continue
+			}
+			services = append(services, ServiceRef{
+				Name:   string(ref.Name),
+				Port:   uint16(*ref.Port),
+				Weight: weight,
+			})
+		}
+
+		matches := rule.Matches
+		if len(matches) == 0 {
+			matches = []gatewayv1.HTTPRouteMatch{{}}
+		}
+		for _, m := range matches {
+			path, ok := mapHTTPRouteMatch(m)
+			if !ok {
+				log.Warn("Ignoring unsupported HTTPRoute match",
+					zap.String("name", route.Name),
+					zap.String("namespace", route.Namespace))
+				dropped = true
+				continue
+			}
+			path.Services = services
+			paths = append(paths, path)
+		}
+	}
+
+	return paths, dropped, resolvedRefs, refsReason
+}
+
+func hasFilters(rule gatewayv1.HTTPRouteRule) bool {
+	if len(rule.Filters) > 0 {
+		return true
+	}
+	for _, ref := range rule.BackendRefs {
+		if len(ref.Filters) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func mapHTTPRouteMatch(match gatewayv1.HTTPRouteMatch) (IngressPath, bool) {
+	path := IngressPath{
+		Path:     "/",
+		PathType: util.PATH_TYPE_PREFIX,
+		Matches:  make([]util.RequestMatch, 0),
+	}
+
+	if match.Method != nil {
+		return path, false
+	}
+
+	if match.Path != nil {
+		if match.Path.Value != nil {
+			path.Path = *match.Path.Value
+		}
+		if match.Path.Type != nil {
+			switch *match.Path.Type {
+			case gatewayv1.PathMatchExact:
+				path.PathType = util.PATH_TYPE_EXACT
+			case gatewayv1.PathMatchPathPrefix:
+				path.PathType = util.PATH_TYPE_PREFIX
+			default:
+				return path, false
+			}
+		}
+	}
+
+	for _, h := range match.Headers {
+		requestMatch := util.RequestMatch{
+			Source: util.MATCH_SOURCE_HEADER,
+			Name:   string(h.Name),
+			Value:  h.Value,
+		}
+		if h.Type != nil && *h.Type == gatewayv1.HeaderMatchRegularExpression {
+			expression, err := regexp.Compile(h.Value)
+			if err != nil {
+				return path, false
+			}
+			requestMatch.Regexp = expression
+		}
+		path.Matches = append(path.Matches, requestMatch)
+	}
+
+	for _, q := range match.QueryParams {
+		requestMatch := util.RequestMatch{
+			Source: util.MATCH_SOURCE_QUERY,
+			Name:   string(q.Name),
+			Value:  q.Value,
+		}
+		if q.Type != nil && *q.Type == gatewayv1.QueryParamMatchRegularExpression {
+			expression, err := regexp.Compile(q.Value)
+			if err != nil {
+				return path, false
+			}
+			requestMatch.Regexp = expression
+		}
+		path.Matches = append(path.Matches, requestMatch)
+	}
+
+	return path, true
+}
+
+// routeStatus merges the conditions computed for the parents owned by this controller into the status of the route,
+// leaving parents of other controllers untouched. Transition times are kept for conditions that did not change
+func routeStatus(route *gatewayv1.HTTPRoute, controllerName string, statuses []RouteStatus) gatewayv1.RouteStatus {
+	out := gatewayv1.RouteStatus{
+		Parents: make([]gatewayv1.RouteParentStatus, 0, len(route.Status.Parents)),
+	}
+	previous := make(map[string][]machinerymetav1.Condition)
+	for _, p := range route.Status.Parents {
+		if string(p.ControllerName) == controllerName {
+			previous[parentKey(p.ParentRef)] = p.Conditions
+		} else {
+			out.Parents = append(out.Parents, *p.DeepCopy())
+		}
+	}
+
+	for _, s := range statuses {
+		conditions := make([]machinerymetav1.Condition, 0)
+		for _, c := range previous[parentKey(s.ParentRef)] {
+			conditions = append(conditions, *c.DeepCopy())
+		}
+		meta.SetStatusCondition(&conditions, machinerymetav1.Condition{
+			Type:               string(gatewayv1.RouteConditionAccepted),
+			Status:             conditionStatus(s.Accepted),
+			Reason:             string(s.Reason),
+			ObservedGeneration: route.Generation,
+		})
+		meta.SetStatusCondition(&conditions, machinerymetav1.Condition{
+			Type:               string(gatewayv1.RouteConditionResolvedRefs),
+			Status:             conditionStatus(s.ResolvedRefs),
+			Reason:             string(s.RefsReason),
+			ObservedGeneration: route.Generation,
+		})
+		if s.PartiallyInvalid {
+			meta.SetStatusCondition(&conditions, machinerymetav1.Condition{
+				Type:               string(gatewayv1.RouteConditionPartiallyInvalid),
+				Status:             machinerymetav1.ConditionTrue,
+				Reason:             string(gatewayv1.RouteReasonUnsupportedValue),
+				Message:            "Rules with filters or unsupported matches and wildcard hostnames are not served",
+				ObservedGeneration: route.Generation,
+			})
+		} else {
+			meta.RemoveStatusCondition(&conditions, string(gatewayv1.RouteConditionPartiallyInvalid))
+		}
+		out.Parents = append(out.Parents, gatewayv1.RouteParentStatus{
+			ParentRef:      s.ParentRef,
+			ControllerName: gatewayv1.GatewayController(controllerName),
+			Conditions:     conditions,
+		})
+	}
+
+	return out
+}
+
+func parentKey(ref gatewayv1.ParentReference) string {
+	var namespace, section string
+	if ref.Namespace != nil {
+		namespace = string(*ref.Namespace)
+	}
+	if ref.SectionName != nil {
+		section = string(*ref.SectionName)
+	}
+	return namespace + "/" + string(ref.Name) + "/" + section
+}
+
+func conditionStatus(ok bool) machinerymetav1.ConditionStatus {
+	if ok {
+		return machinerymetav1.ConditionTrue
+	}
+	return machinerymetav1.ConditionFalse
+}
+
+// routeStatusWriter writes the status of routes back to the api from a single goroutine. Only the latest status of a
+// route is kept while its write is pending, so a burst of reloads results in at most one write per route
+type routeStatusWriter struct {
+	client         gatewayclientset.Interface
+	controllerName string
+
+	mutex   sync.Mutex
+	pending map[Object]pendingRouteStatus
+	notify  chan struct{}
+}
+
+type pendingRouteStatus struct {
+	generation int64
+	statuses   []RouteStatus
+}
+
+func newRouteStatusWriter(client gatewayclientset.Interface, controllerName string) *routeStatusWriter {
+	return &routeStatusWriter{
+		client:         client,
+		controllerName: controllerName,
+		pending:        make(map[Object]pendingRouteStatus),
+		notify:         make(chan struct{}, 1),
+	}
+}
+
+// update queues a write of the status of the route when it differs from the current one, to not trigger a new
+// informer event (and reload) for every reload
+func (w *routeStatusWriter) update(route *gatewayv1.HTTPRoute, statuses []RouteStatus) {
+	object := Object{Name: route.Name, Namespace: route.Namespace}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if !statusChanged(route, w.controllerName, statuses) {
+		delete(w.pending, object)
+		return
+	}
+	w.pending[object] = pendingRouteStatus{generation: route.Generation, statuses: statuses}
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+// run writes the queued statuses until stopped
+func (w *routeStatusWriter) run(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-w.notify:
+		}
+
+		w.mutex.Lock()
+		pending := w.pending
+		w.pending = make(map[Object]pendingRouteStatus)
+		w.mutex.Unlock()
+
+		for object, status := range pending {
+			if err := w.write(object, status); err != nil {
+				log.Warn("Failed to update HTTPRoute status",
+					zap.String("name", object.Name),
+					zap.String("namespace", object.Namespace),
+					zap.String("error", err.Error()),
+				)
+			}
+		}
+	}
+}
+
+// write merges the status into a freshly read route, retrying when the route changed in between. A status computed for
+// an older generation of the route is dropped, the new generation is mapped and written by a later reload
+func (w *routeStatusWriter) write(object Object, status pendingRouteStatus) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		routes := w.client.GatewayV1().HTTPRoutes(object.Namespace)
+		route, err := routes.Get(ctx, object.Name, machinerymetav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if route.Generation != status.generation || !statusChanged(route, w.controllerName, status.statuses) {
+			return nil
+		}
+
+		route.Status.RouteStatus = routeStatus(route, w.controllerName, status.statuses)
+		_, err = routes.UpdateStatus(ctx, route, machinerymetav1.UpdateOptions{})
+		return err
+	})
+}
+
+func statusChanged(route *gatewayv1.HTTPRoute, controllerName string, statuses []RouteStatus) bool {
+	status := routeStatus(route, controllerName, statuses)
+	if len(status.Parents) == 0 && len(route.Status.Parents) == 0 {
+		return false
+	}
+	return !reflect.DeepEqual(status, route.Status.RouteStatus)
+}
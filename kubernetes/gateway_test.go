@@ -0,0 +1,276 @@
+package kubernetes
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dbcdk/shelob/util"
+	"k8s.io/apimachinery/pkg/api/meta"
+	machinerymetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	gatewayv1 "sigs.k8s.io/gateway-api/apis/v1"
+	gatewayfake "sigs.k8s.io/gateway-api/pkg/client/clientset/versioned/fake"
+)
+
+func createGateway(name string, listeners ...gatewayv1.Listener) *gatewayv1.Gateway {
+	return &gatewayv1.Gateway{
+		ObjectMeta: machinerymetav1.ObjectMeta{Name: name, Namespace: "testing"},
+		Spec: gatewayv1.GatewaySpec{
+			GatewayClassName: "shelob",
+			Listeners:        listeners,
+		},
+	}
+}
+
+func createHTTPRoute(gateway string, hostnames []gatewayv1.Hostname, rules ...gatewayv1.HTTPRouteRule) *gatewayv1.HTTPRoute {
+	return &gatewayv1.HTTPRoute{
+		ObjectMeta: machinerymetav1.ObjectMeta{Name: "route", Namespace: "testing", Generation: 2},
+		Spec: gatewayv1.HTTPRouteSpec{
+			CommonRouteSpec: gatewayv1.CommonRouteSpec{
+				ParentRefs: []gatewayv1.ParentReference{{Name: gatewayv1.ObjectName(gateway)}},
+			},
+			Hostnames: hostnames,
+			Rules:     rules,
+		},
+	}
+}
+
+func createBackendRef(service string, weight int32) gatewayv1.HTTPBackendRef {
+	port := gatewayv1.PortNumber(80)
+	return gatewayv1.HTTPBackendRef{BackendRef: gatewayv1.BackendRef{
+		BackendObjectReference: gatewayv1.BackendObjectReference{Name: gatewayv1.ObjectName(service), Port: &port},
+		Weight:                 &weight,
+	}}
+}
+
+func TestOwnedGateways(t *testing.T) {
+	classes := []*gatewayv1.GatewayClass{
+		{ObjectMeta: machinerymetav1.ObjectMeta{Name: "shelob"}, Spec: gatewayv1.GatewayClassSpec{ControllerName: "dbc.dk/shelob"}},
+		{ObjectMeta: machinerymetav1.ObjectMeta{Name: "other"}, Spec: gatewayv1.GatewayClassSpec{ControllerName: "example.com/other"}},
+	}
+	other := createGateway("other")
+	other.Spec.GatewayClassName = "other"
+
+	gateways := ownedGateways("dbc.dk/shelob", classes, []*gatewayv1.Gateway{createGateway("gw"), other})
+	if len(gateways) != 1 || gateways[Object{Name: "gw", Namespace: "testing"}] == nil {
+		t.Errorf("Expected only the gateway of the owned class, got %v", gateways)
+	}
+}
+
+func TestMapHTTPRoute(t *testing.T) {
+	exact := gatewayv1.PathMatchExact
+	path := "/api"
+	listenerHost := gatewayv1.Hostname("*.example.com")
+	gateways := map[Object]*gatewayv1.Gateway{
+		{Name: "gw", Namespace: "testing"}: createGateway("gw",
+			gatewayv1.Listener{Name: "http", Protocol: gatewayv1.HTTPProtocolType, Port: 80, Hostname: &listenerHost},
+		),
+	}
+	route := createHTTPRoute("gw", []gatewayv1.Hostname{"a.example.com", "b.example.org"},
+		gatewayv1.HTTPRouteRule{
+			Matches: []gatewayv1.HTTPRouteMatch{{
+				Path:    &gatewayv1.HTTPPathMatch{Type: &exact, Value: &path},
+				Headers: []gatewayv1.HTTPHeaderMatch{{Name: "X-Canary", Value: "always"}},
+			}},
+			BackendRefs: []gatewayv1.HTTPBackendRef{createBackendRef("a", 90), createBackendRef("b", 10), createBackendRef("c", 0)},
+		},
+	)
+
+	ingresses, statuses := mapHTTPRoute(route, gateways, func(Object) bool { return true })
+
+	if len(ingresses) != 1 {
+		t.Fatalf("Expected only the hostname accepted by the listener, got %v", ingresses)
+	}
+	ingress := ingresses["a.example.com"]
+	if ingress.PlainHTTPPolicy != util.PLAIN_HTTP_ALLOW {
+		t.Errorf("Expected route of plain http listener to allow plain http, got %d", ingress.PlainHTTPPolicy)
+	}
+	expected := []IngressPath{{
+		Path:     "/api",
+		PathType: util.PATH_TYPE_EXACT,
+		Matches:  []util.RequestMatch{{Source: util.MATCH_SOURCE_HEADER, Name: "X-Canary", Value: "always"}},
+		Services: []ServiceRef{{Name: "a", Port: 80, Weight: 90}, {Name: "b", Port: 80, Weight: 10}},
+	}}
+	if !reflect.DeepEqual(ingress.Paths, expected) {
+		t.Errorf("Expected paths %v, got %v", expected, ingress.Paths)
+	}
+	if len(statuses) != 1 || !statuses[0].Accepted || !statuses[0].ResolvedRefs {
+		t.Errorf("Expected route to be accepted with resolved refs, got %v", statuses)
+	}
+
+	if ingresses, statuses := mapHTTPRoute(createHTTPRoute("unknown", nil), gateways, func(Object) bool { return true }); len(ingresses) != 0 || len(statuses) != 0 {
+		t.Error("Expected route of a gateway of another controller to be ignored")
+	}
+
+	_, statuses = mapHTTPRoute(route, gateways, func(Object) bool { return false })
+	if len(statuses) != 1 || statuses[0].ResolvedRefs || statuses[0].RefsReason != gatewayv1.RouteReasonBackendNotFound {
+		t.Errorf("Expected missing services to be reported as unresolved, got %v", statuses)
+	}
+}
+
+func TestMapHTTPRouteUnsupported(t *testing.T) {
+	gateways := map[Object]*gatewayv1.Gateway{
+		{Name: "gw", Namespace: "testing"}: createGateway("gw",
+			gatewayv1.Listener{Name: "http", Protocol: gatewayv1.HTTPProtocolType, Port: 80},
+		),
+	}
+	prefix := gatewayv1.PathMatchPathPrefix
+	path := "/old"
+	hostname := gatewayv1.PreciseHostname("b.example.com")
+	plain := gatewayv1.HTTPRouteRule{BackendRefs: []gatewayv1.HTTPBackendRef{createBackendRef("a", 1)}}
+	redirect := gatewayv1.HTTPRouteRule{
+		Matches: []gatewayv1.HTTPRouteMatch{{Path: &gatewayv1.HTTPPathMatch{Type: &prefix, Value: &path}}},
+		Filters: []gatewayv1.HTTPRouteFilter{{
+			Type:            gatewayv1.HTTPRouteFilterRequestRedirect,
+			RequestRedirect: &gatewayv1.HTTPRequestRedirectFilter{Hostname: &hostname},
+		}},
+	}
+	serviceExists := func(Object) bool { return true }
+
+	ingresses, statuses := mapHTTPRoute(createHTTPRoute("gw", []gatewayv1.Hostname{"a.example.com", "*.example.com"}, plain, redirect), gateways, serviceExists)
+	if len(ingresses) != 1 || len(ingresses["a.example.com"].Paths) != 1 || ingresses["a.example.com"].Paths[0].Path != "/" {
+		t.Errorf("Expected only the rule without filters to be served on the plain hostname, got %v", ingresses)
+	}
+	if len(statuses) != 1 || !statuses[0].Accepted || !statuses[0].PartiallyInvalid {
+		t.Errorf("Expected route to be accepted as partially invalid, got %v", statuses)
+	}
+
+	ingresses, statuses = mapHTTPRoute(createHTTPRoute("gw", []gatewayv1.Hostname{"a.example.com"}, redirect), gateways, serviceExists)
+	if len(ingresses) != 0 || len(statuses) != 1 || statuses[0].Accepted || statuses[0].Reason != gatewayv1.RouteReasonUnsupportedValue {
+		t.Errorf("Expected route with only filtered rules not to be accepted, got %v %v", ingresses, statuses)
+	}
+
+	ingresses, statuses = mapHTTPRoute(createHTTPRoute("gw", []gatewayv1.Hostname{"*.example.com"}, plain), gateways, serviceExists)
+	if len(ingresses) != 0 || len(statuses) != 1 || statuses[0].Accepted || statuses[0].Reason != gatewayv1.RouteReasonUnsupportedValue {
+		t.Errorf("Expected route with only wildcard hostnames not to be accepted, got %v %v", ingresses, statuses)
+	}
+}
+
+func TestIntersectHostnames(t *testing.T) {
+	cases := []struct {
+		route    []string
+		listener string
+		expected []string
+	}{
+		{[]string{"a.example.com"}, "", []string{"a.example.com"}},
+		{nil, "a.example.com", []string{"a.example.com"}},
+		{[]string{"a.example.com", "a.example.org"}, "*.example.com", []string{"a.example.com"}},
+		{[]string{"*.example.com"}, "a.example.com", []string{"a.example.com"}},
+		{[]string{"example.com"}, "*.example.com", []string{}},
+	}
+	for _, c := range cases {
+		if actual := intersectHostnames(c.route, c.listener); !reflect.DeepEqual(actual, c.expected) {
+			t.Errorf("Expected %v and '%s' to intersect as %v, got %v", c.route, c.listener, c.expected, actual)
+		}
+	}
+}
+
+func TestRouteStatus(t *testing.T) {
+	route := createHTTPRoute("gw", nil)
+	foreign := gatewayv1.RouteParentStatus{
+		ParentRef:      gatewayv1.ParentReference{Name: "foreign"},
+		ControllerName: "example.com/other",
+	}
+	route.Status.Parents = []gatewayv1.RouteParentStatus{foreign}
+
+	status := routeStatus(route, "dbc.dk/shelob", []RouteStatus{{
+		ParentRef:    route.Spec.ParentRefs[0],
+		Accepted:     true,
+		Reason:       gatewayv1.RouteReasonAccepted,
+		ResolvedRefs: false,
+		RefsReason:   gatewayv1.RouteReasonBackendNotFound,
+	}})
+
+	if len(status.Parents) != 2 || !reflect.DeepEqual(status.Parents[0], foreign) {
+		t.Fatalf("Expected status of other controllers to be kept, got %v", status.Parents)
+	}
+	conditions := status.Parents[1].Conditions
+	if !meta.IsStatusConditionTrue(conditions, string(gatewayv1.RouteConditionAccepted)) {
+		t.Errorf("Expected route to be accepted, got %v", conditions)
+	}
+	if c := meta.FindStatusCondition(conditions, string(gatewayv1.RouteConditionResolvedRefs)); c == nil || c.Status != machinerymetav1.ConditionFalse || c.ObservedGeneration != 2 {
+		t.Errorf("Expected unresolved refs for the observed generation, got %v", c)
+	}
+	if meta.FindStatusCondition(conditions, string(gatewayv1.RouteConditionPartiallyInvalid)) != nil {
+		t.Errorf("Expected fully supported route not to be partially invalid, got %v", conditions)
+	}
+
+	route.Status.RouteStatus = status
+	status = routeStatus(route, "dbc.dk/shelob", []RouteStatus{{
+		ParentRef:        route.Spec.ParentRefs[0],
+		Accepted:         true,
+		Reason:           gatewayv1.RouteReasonAccepted,
+		ResolvedRefs:     true,
+		RefsReason:       gatewayv1.RouteReasonResolvedRefs,
+		PartiallyInvalid: true,
+	}})
+	if c := meta.FindStatusCondition(status.Parents[1].Conditions, string(gatewayv1.RouteConditionPartiallyInvalid)); c == nil || c.Status != machinerymetav1.ConditionTrue || c.Reason != string(gatewayv1.RouteReasonUnsupportedValue) {
+		t.Errorf("Expected left out rules to be reported as partially invalid, got %v", c)
+	}
+}
+
+func TestRouteStatusWriter(t *testing.T) {
+	route := createHTTPRoute("gw", nil)
+	client := gatewayfake.NewSimpleClientset(route)
+	writer := newRouteStatusWriter(client, "dbc.dk/shelob")
+	statuses := []RouteStatus{{
+		ParentRef:    route.Spec.ParentRefs[0],
+		Accepted:     true,
+		Reason:       gatewayv1.RouteReasonAccepted,
+		ResolvedRefs: true,
+		RefsReason:   gatewayv1.RouteReasonResolvedRefs,
+	}}
+	statusWrites := func() int {
+		writes := 0
+		for _, action := range client.Actions() {
+			if action.GetVerb() == "update" && action.GetSubresource() == "status" {
+				writes++
+			}
+		}
+		return writes
+	}
+
+	// an unchanged status drops the pending write of the route
+	current := route.DeepCopy()
+	current.Status.RouteStatus = routeStatus(route, "dbc.dk/shelob", statuses)
+	writer.update(route, statuses)
+	writer.update(current, statuses)
+	if len(writer.pending) != 0 {
+		t.Errorf("Expected unchanged status not to be queued, got %v", writer.pending)
+	}
+	writer.update(route, statuses)
+	writer.update(route, statuses)
+	if len(writer.pending) != 1 {
+		t.Errorf("Expected changes of a route to be queued once, got %v", writer.pending)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go writer.run(stop)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for statusWrites() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	written, err := client.GatewayV1().HTTPRoutes("testing").Get(context.Background(), "route", machinerymetav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !meta.IsStatusConditionTrue(written.Status.Parents[0].Conditions, string(gatewayv1.RouteConditionAccepted)) {
+		t.Errorf("Expected status to be written, got %v", written.Status)
+	}
+
+	// the cached route is stale, the status already written to the api is not written again
+	if err := writer.write(Object{Name: "route", Namespace: "testing"}, pendingRouteStatus{generation: route.Generation, statuses: statuses}); err != nil {
+		t.Fatal(err)
+	}
+	// neither is the status of an older generation of the route
+	statuses[0].Accepted = false
+	if err := writer.write(Object{Name: "route", Namespace: "testing"}, pendingRouteStatus{generation: route.Generation - 1, statuses: statuses}); err != nil {
+		t.Fatal(err)
+	}
+	if writes := statusWrites(); writes != 1 {
+		t.Errorf("Expected queued statuses to be written once, got %d writes", writes)
+	}
+}
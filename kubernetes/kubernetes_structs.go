@@ -2,35 +2,98 @@ package kubernetes
 
 import "github.com/dbcdk/shelob/util"
 
+const (
+	KIND_INGRESS   = "Ingress"
+	KIND_HTTPROUTE = "HTTPRoute"
+	KIND_SECRET    = "Secret"
+	KIND_CONFIGMAP = "ConfigMap"
+)
+
 type Object struct {
 	Name      string
 	Namespace string
 }
 
+// Resource is an ingress or route contributing rules for one or more hosts
+type Resource struct {
+	Kind   string
+	Object Object
+}
+
+// HostMatch identifies the rules for a host contributed by one object, Kind tells ingresses and routes apart
 type HostMatch struct {
+	Kind     string
 	Object   Object
 	HostName string
 }
 
+// PortMatch identifies a service port either by number or by name, leaving the other field empty
 type PortMatch struct {
 	Object Object
 	Port   uint16
+	Name   string
 }
 
+// Endpoint is an address of a pod backing a service, IPFamily is the address type of its slice and Pod the name of
+// the pod it belongs to (empty if not backed by a pod)
 type Endpoint struct {
-	Address string
-	Port    uint16
+	Address     string
+	Port        uint16
+	PortName    string
+	IPFamily    string
+	Pod         string
+	Ready       bool
+	Serving     bool
+	Terminating bool
 }
 
 type Ingress struct {
-	Scheme          string
-	Name            string
-	Port            uint16
-	Intercept       *util.Intercept
-	PlainHTTPPolicy uint16
+	Scheme           string
+	Protocol         uint16
+	BackendTLS       *BackendTLS
+	Passthrough      bool
+	Intercept        *util.Intercept
+	PlainHTTPPolicy  uint16
+	Affinity         *util.Affinity
+	Balancing        util.Balancing
+	HealthCheck      *util.HealthCheck
+	OutlierDetection *util.OutlierDetection
+	Retry            *util.RetryPolicy
+	CircuitBreaker   *util.CircuitBreaker
+	Timeouts         util.Timeouts
+	RateLimit        *util.RateLimit
+	Paths            []IngressPath
+}
+
+// BackendTLS refers to the CA bundle in a secret or config map, and the client certificate in a secret, of the https
+// backends of an ingress. References left out have an empty name
+type BackendTLS struct {
+	ServerName string
+	CA         Resource
+	ClientCert Object
+}
+
+type IngressPath struct {
+	Path     string
+	PathType uint16
+	Matches  []util.RequestMatch
+	Services []ServiceRef
+}
+
+// ServiceRef points at a port of a service in the namespace of the ingress, Weight splits traffic between several
+// services of the same path (0=unweighted)
+type ServiceRef struct {
+	Name     string
+	Port     uint16
+	PortName string
+	Weight   int
 }
 
+// Service is a port of a service, IPFamily is the preferred address family of the service (empty if not set)
 type Service struct {
-	Port       uint16
-	TargetPort uint16
+	Name           string
+	Port           uint16
+	TargetPort     uint16
+	TargetPortName string
+	IPFamily       string
 }
@@ -3,40 +3,62 @@ package kubernetes
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/dbcdk/shelob/util"
 	"go.uber.org/zap"
+	apicorev1 "k8s.io/api/core/v1"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 )
 
 const SECRET_HOSTNAME_LABEL = "ingress.hostname"
 
-func GetCerts(config *util.Config, namespace string) (map[string]*tls.Certificate, error) {
+// certificate secrets may hold the CA bundle verifying client certificates of their host, and annotate the client auth
+// mode of the host (off, optional or required, default required)
+const (
+	CLIENT_CA_KEY          = "client-ca"
+	CLIENT_AUTH_ANNOTATION = "shelob.client.auth"
+)
+
+// key of the CA bundle in secrets and config maps referred to by the backend CA annotation
+const CA_BUNDLE_KEY = "ca.crt"
+
+// GetCerts returns the certificates of the hosts labelled on the certificate secrets, along with the client auth of
+// the hosts whose secrets hold a client CA bundle. Both are read from the same LIST, so they agree with each other
+func GetCerts(config *util.Config, namespace string) (map[string]*tls.Certificate, map[string]*util.ClientAuth, error) {
 
 	clients, err := GetKubeClient(config.Kubeconfig)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 	secrets, err := clients.CoreV1().Secrets(namespace).List(ctx, v1.ListOptions{
 		LabelSelector: SECRET_HOSTNAME_LABEL,
 	})
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
+	return mapCertSecrets(secrets.Items)
+}
+
+func mapCertSecrets(secrets []apicorev1.Secret) (map[string]*tls.Certificate, map[string]*util.ClientAuth, error) {
 	certs := make(map[string]*tls.Certificate)
-	for _, s := range secrets.Items {
+	clientAuth := make(map[string]*util.ClientAuth)
+	for _, s := range secrets {
 		certRaw, ok := s.Data["cert"]
 		if !ok {
-			return nil, fmt.Errorf("Public key part ('cert') missing")
+			return nil, nil, fmt.Errorf("Public key part ('cert') missing")
 		}
 		keyRaw, ok := s.Data["key"]
 		if !ok {
-			return nil, fmt.Errorf("Private key part ('key') missing")
+			return nil, nil, fmt.Errorf("Private key part ('key') missing")
 		}
 		cert, err := util.ParseX509(certRaw, keyRaw)
 		hostName := s.Labels[SECRET_HOSTNAME_LABEL]
@@ -49,7 +71,118 @@ func GetCerts(config *util.Config, namespace string) (map[string]*tls.Certificat
 			)
 		}
 		certs[hostName] = cert
+
+		ca, ok := s.Data[CLIENT_CA_KEY]
+		if !ok {
+			continue
+		}
+		auth, err := util.NewClientAuth(s.Annotations[CLIENT_AUTH_ANNOTATION], ca)
+		if err != nil {
+			log.Error("Failed to parse client auth, rejecting all client certificates",
+				zap.String("secretNamespace", s.Namespace),
+				zap.String("secretName", s.Name),
+				zap.String("hostname", hostName),
+				zap.String("error", err.Error()),
+			)
+		}
+		clientAuth[hostName] = auth
+	}
+
+	return certs, clientAuth, nil
+}
+
+// tlsSource reads the secrets and config maps holding the CA bundles and client certificates of https backends
+type tlsSource interface {
+	getSecret(object Object) (*apicorev1.Secret, error)
+	getConfigMap(object Object) (*apicorev1.ConfigMap, error)
+}
+
+// clientTLSSource reads secrets and config maps from the api, for frontends built from full LISTs
+type clientTLSSource struct {
+	client clientcorev1.CoreV1Interface
+}
+
+func (s clientTLSSource) getSecret(object Object) (*apicorev1.Secret, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return s.client.Secrets(object.Namespace).Get(ctx, object.Name, v1.GetOptions{})
+}
+
+func (s clientTLSSource) getConfigMap(object Object) (*apicorev1.ConfigMap, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return s.client.ConfigMaps(object.Namespace).Get(ctx, object.Name, v1.GetOptions{})
+}
+
+// resolveBackendTLS reads the CA bundle and client certificate of the https backends of an ingress. Parts which cannot
+// be read are left out, so backends are verified against the system roots rather than not at all
+func resolveBackendTLS(config *util.Config, source tlsSource, n HostMatch, ref *BackendTLS) *util.BackendTLS {
+	if ref == nil {
+		return nil
+	}
+	warn := func(message string, err error) {
+		log.Warn(message,
+			zap.String("name", n.Object.Name),
+			zap.String("namespace", n.Object.Namespace),
+			zap.String("host", n.HostName),
+			zap.String("error", err.Error()),
+		)
+	}
+	if source == nil && (ref.CA.Object.Name != "" || ref.ClientCert.Name != "") {
+		warn("Ignoring backend CA and client certificate of ingress", errors.New("reading backend tls sources is disabled"))
+		ref = &BackendTLS{ServerName: ref.ServerName}
+	}
+
+	var caName string
+	var ca []byte
+	if ref.CA.Object.Name != "" {
+		caName = strings.ToLower(ref.CA.Kind) + "/" + ref.CA.Object.Name
+		var err error
+		if ca, err = readCABundle(source, ref.CA); err != nil {
+			warn("Ignoring backend CA of ingress", err)
+		}
+	}
+
+	var certName string
+	var cert, key []byte
+	if ref.ClientCert.Name != "" {
+		certName = ref.ClientCert.Name
+		secret, err := source.getSecret(ref.ClientCert)
+		if err != nil {
+			warn("Ignoring backend client certificate of ingress", err)
+		} else {
+			cert, key = secret.Data[apicorev1.TLSCertKey], secret.Data[apicorev1.TLSPrivateKeyKey]
+		}
 	}
 
-	return certs, nil
+	backendTLS, err := util.NewBackendTLS(ref.ServerName, caName, ca, certName, cert, key, config.IgnoreSSLErrors)
+	if err != nil {
+		warn("Ignoring backend CA and client certificate of ingress", err)
+		backendTLS, _ = util.NewBackendTLS(ref.ServerName, "", nil, "", nil, nil, config.IgnoreSSLErrors)
+	}
+	return backendTLS
+}
+
+func readCABundle(source tlsSource, ref Resource) ([]byte, error) {
+	if ref.Kind == KIND_SECRET {
+		secret, err := source.getSecret(ref.Object)
+		if err != nil {
+			return nil, err
+		}
+		if ca, ok := secret.Data[CA_BUNDLE_KEY]; ok {
+			return ca, nil
+		}
+	} else {
+		configMap, err := source.getConfigMap(ref.Object)
+		if err != nil {
+			return nil, err
+		}
+		if ca, ok := configMap.Data[CA_BUNDLE_KEY]; ok {
+			return []byte(ca), nil
+		}
+		if ca, ok := configMap.BinaryData[CA_BUNDLE_KEY]; ok {
+			return ca, nil
+		}
+	}
+	return nil, fmt.Errorf("key '%s' missing", CA_BUNDLE_KEY)
 }
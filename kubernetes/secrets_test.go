@@ -0,0 +1,50 @@
+package kubernetes
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dbcdk/shelob/util"
+	apicorev1 "k8s.io/api/core/v1"
+	machinerymetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func createCertSecret(host string, annotations map[string]string, data map[string][]byte) apicorev1.Secret {
+	data["cert"], data["key"] = []byte{}, []byte{}
+	return apicorev1.Secret{
+		ObjectMeta: machinerymetav1.ObjectMeta{
+			Name:        host,
+			Namespace:   "certs",
+			Labels:      map[string]string{SECRET_HOSTNAME_LABEL: host},
+			Annotations: annotations,
+		},
+		Data: data,
+	}
+}
+
+func TestMapCertSecrets(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer server.Close()
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+
+	certs, clientAuth, err := mapCertSecrets([]apicorev1.Secret{
+		createCertSecret("a.example.com", map[string]string{CLIENT_AUTH_ANNOTATION: "optional"}, map[string][]byte{CLIENT_CA_KEY: ca}),
+		createCertSecret("b.example.com", nil, map[string][]byte{CLIENT_CA_KEY: []byte("invalid")}),
+		createCertSecret("c.example.com", nil, map[string][]byte{}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 3 {
+		t.Errorf("Expected a certificate entry of every host, got %v", certs)
+	}
+	if len(clientAuth) != 2 || clientAuth["a.example.com"].Mode != util.CLIENT_AUTH_OPTIONAL {
+		t.Errorf("Expected client auth of the hosts with a client CA, got %v", clientAuth)
+	}
+	if auth := clientAuth["b.example.com"]; auth == nil || auth.Mode != util.CLIENT_AUTH_REQUIRED || !auth.CAs.Equal(x509.NewCertPool()) {
+		t.Errorf("Expected host with an invalid client CA to fail closed, got %v", auth)
+	}
+}
@@ -6,73 +6,140 @@ import (
 	"github.com/dbcdk/shelob/util"
 	"go.uber.org/zap"
 	apicorev1 "k8s.io/api/core/v1"
+	apidiscoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/client-go/tools/cache"
 )
 
-func WatchBackends(config *util.Config, updateChan chan util.Reload) error {
+// Watch starts the informers backing the cache and records changed objects, each change triggers an update on updateChan
+func (fc *FrontendCache) Watch(updateChan chan util.Reload) error {
+	config := fc.config
 
-	addRemoveFunc := func(obj interface{}) {
+	notify := func(obj interface{}) {
 		log.Debug("Received kubernetes API event (backends)",
 			zap.String("object", fmt.Sprint(obj)),
 		)
 		updateChan <- util.NewReload("api-change-backends")
 	}
-	updateFunc := func(oldObj interface{}, newObj interface{}) {
-		addRemoveFunc(newObj)
+	resourceAddRemoveFunc := func(kind string) func(obj interface{}) {
+		return func(obj interface{}) {
+			if o, ok := objectOf(obj); ok {
+				fc.markResource(Resource{Kind: kind, Object: o})
+				notify(obj)
+			}
+		}
+	}
+	markAllAddRemoveFunc := func(obj interface{}) {
+		// changing the default class may change the owner of every ingress without a class, and changing a gateway
+		// or gateway class may change which routes are attached to it
+		fc.markAll()
+		notify(obj)
+	}
+	serviceAddRemoveFunc := func(obj interface{}) {
+		if o, ok := objectOf(obj); ok {
+			fc.markService(o)
+			notify(obj)
+		}
+	}
+	sourceAddRemoveFunc := func(kind string) func(obj interface{}) {
+		return func(obj interface{}) {
+			if o, ok := objectOf(obj); ok {
+				fc.markSource(Resource{Kind: kind, Object: o})
+				notify(obj)
+			}
+		}
 	}
 	endpointAddRemoveFunc := func(obj interface{}) {
-		ev, ok := obj.(*apicorev1.Endpoints)
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+		ev, ok := obj.(*apidiscoveryv1.EndpointSlice)
 		if ok {
+			service, hasService := ev.Labels[apidiscoveryv1.LabelServiceName]
+			if !hasService {
+				return
+			}
+			fc.markService(Object{Name: service, Namespace: ev.Namespace})
 			if _, ok := config.IgnoreNamespaces[ev.Namespace]; ok {
+				// the change is still recorded, and will be applied with the next update
 				log.Debug("Ignored kubernetes endpoint-API event",
 					zap.String("namespace", ev.Namespace),
 					zap.String("name", ev.Name),
 				)
 				return
 			}
-			addRemoveFunc(obj)
+			notify(obj)
 		}
 	}
-	endpointUpdateFunc := func(oldObj interface{}, newObj interface{}) {
-		endpointAddRemoveFunc(newObj)
-	}
 
 	stopChan := make(chan struct{})
-	informerFactory, err := GetInformerFactory(config.Kubeconfig, apicorev1.NamespaceAll)
-	if err != nil {
-		return err
+
+	ingressv1Informer := fc.informerFactory.Networking().V1().Ingresses().Informer()
+	ingressv1Informer.AddEventHandler(eventHandler(resourceAddRemoveFunc(KIND_INGRESS)))
+
+	if config.IngressClass != "" {
+		ingressClassInformer := fc.informerFactory.Networking().V1().IngressClasses().Informer()
+		ingressClassInformer.AddEventHandler(eventHandler(markAllAddRemoveFunc))
 	}
 
-	ingressv1Informer := informerFactory.Networking().V1().Ingresses().Informer()
-	ingressv1Informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc:    addRemoveFunc,
-		UpdateFunc: updateFunc,
-		DeleteFunc: addRemoveFunc,
-	})
-	go ingressv1Informer.Run(stopChan)
+	serviceInformer := fc.informerFactory.Core().V1().Services().Informer()
+	serviceInformer.AddEventHandler(eventHandler(serviceAddRemoveFunc))
 
-	serviceInformer := informerFactory.Core().V1().Services().Informer()
-	serviceInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc:    addRemoveFunc,
-		UpdateFunc: updateFunc,
-		DeleteFunc: addRemoveFunc,
-	})
-	go serviceInformer.Run(stopChan)
+	endpointInformer := fc.informerFactory.Discovery().V1().EndpointSlices().Informer()
+	endpointInformer.AddEventHandler(eventHandler(endpointAddRemoveFunc))
 
-	endpointInformer := informerFactory.Core().V1().Endpoints().Informer()
-	endpointInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc:    endpointAddRemoveFunc,
-		UpdateFunc: endpointUpdateFunc,
-		DeleteFunc: endpointAddRemoveFunc,
-	})
-	go endpointInformer.Run(stopChan)
+	if config.BackendTLSSources {
+		secretInformer := fc.informerFactory.Core().V1().Secrets().Informer()
+		secretInformer.AddEventHandler(eventHandler(sourceAddRemoveFunc(KIND_SECRET)))
+
+		configMapInformer := fc.informerFactory.Core().V1().ConfigMaps().Informer()
+		configMapInformer.AddEventHandler(eventHandler(sourceAddRemoveFunc(KIND_CONFIGMAP)))
+	}
+
+	fc.informerFactory.Start(stopChan)
+
+	if fc.gatewayInformerFactory != nil {
+		gatewayClassInformer := fc.gatewayInformerFactory.Gateway().V1().GatewayClasses().Informer()
+		gatewayClassInformer.AddEventHandler(eventHandler(markAllAddRemoveFunc))
+
+		gatewayInformer := fc.gatewayInformerFactory.Gateway().V1().Gateways().Informer()
+		gatewayInformer.AddEventHandler(eventHandler(markAllAddRemoveFunc))
+
+		httpRouteInformer := fc.gatewayInformerFactory.Gateway().V1().HTTPRoutes().Informer()
+		httpRouteInformer.AddEventHandler(eventHandler(resourceAddRemoveFunc(KIND_HTTPROUTE)))
+
+		fc.gatewayInformerFactory.Start(stopChan)
+		go fc.statusWriter.run(stopChan)
+	}
 
 	<-config.State.ShutdownChan
-	stopChan <- struct{}{}
+	close(stopChan)
 
 	return nil
 }
 
+func eventHandler(addRemoveFunc func(obj interface{})) cache.ResourceEventHandlerFuncs {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: addRemoveFunc,
+		UpdateFunc: func(oldObj interface{}, newObj interface{}) {
+			addRemoveFunc(newObj)
+		},
+		DeleteFunc: addRemoveFunc,
+	}
+}
+
+// objectOf returns name and namespace of an informer object, unwrapping tombstones of deleted objects
+func objectOf(obj interface{}) (Object, bool) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	o, err := meta.Accessor(obj)
+	if err != nil {
+		return Object{}, false
+	}
+	return Object{Name: o.GetName(), Namespace: o.GetNamespace()}, true
+}
+
 func WatchSecrets(config *util.Config, updateChan chan util.Reload) error {
 
 	addRemoveFunc := func(obj interface{}) {
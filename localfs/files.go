@@ -31,6 +31,32 @@ func GetCerts(config *util.Config) (map[string]*tls.Certificate, error) {
 	return certs, nil
 }
 
+// GetClientAuth returns the client auth of the hosts with a client CA file. A host whose CA file cannot be read or
+// parsed fails closed, rejecting every client certificate, without affecting the other hosts
+func GetClientAuth(config *util.Config) map[string]*util.ClientAuth {
+	clientAuth := make(map[string]*util.ClientAuth)
+	for name, file := range config.ClientCAFileMap {
+		ca, err := ioutil.ReadFile(file.Path)
+		if err != nil {
+			log.Error("Failed to read client CA file",
+				zap.String("hostname", name),
+				zap.String("file", file.Path),
+				zap.String("error", err.Error()),
+			)
+		}
+		auth, err := util.NewClientAuth(file.Mode, ca)
+		if err != nil {
+			log.Error("Failed to parse client auth, rejecting all client certificates",
+				zap.String("hostname", name),
+				zap.String("file", file.Path),
+				zap.String("error", err.Error()),
+			)
+		}
+		clientAuth[name] = auth
+	}
+	return clientAuth
+}
+
 func WatchSecrets(config *util.Config, updateChan chan util.Reload) error {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
@@ -77,5 +103,11 @@ func WatchSecrets(config *util.Config, updateChan chan util.Reload) error {
 			return err
 		}
 	}
+	for _, file := range config.ClientCAFileMap {
+		err = watcher.Add(file.Path)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
@@ -13,6 +13,7 @@ func CreateAdminMux(config *util.Config) *http.ServeMux {
 
 	mux.Handle("/", http.HandlerFunc(handlers.CreateListApplicationsHandler(config)))
 	mux.Handle("/api/applications", http.HandlerFunc(handlers.CreateListApplicationsHandlerJson(config)))
+	mux.Handle("/api/health", http.HandlerFunc(handlers.CreateBackendHealthHandler(config)))
 	mux.Handle("/metrics", promhttp.Handler())
 	mux.HandleFunc("/debug/pprof/", pprof.Index)
 	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
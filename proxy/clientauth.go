@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/dbcdk/shelob/certs"
+)
+
+// headers forwarding the verified client certificate of a request to the backend, they are removed from requests of
+// clients so backends can trust them
+const (
+	CLIENT_CERT_SUBJECT_HEADER     = "X-Client-Cert-Subject"
+	CLIENT_CERT_FINGERPRINT_HEADER = "X-Client-Cert-Fingerprint"
+)
+
+// misdirected tells if a request for a host with client auth was sent on a connection negotiated for another host, as
+// HTTP/2 clients do when the certificate of the connection covers both. The client certificate was not verified for
+// the host of the request then, if the client sent one at all
+func misdirected(req *http.Request, domain string, cl certs.CertLookup) bool {
+	if req.TLS == nil || cl == nil {
+		return false
+	}
+	return cl.ClientAuth(domain) != cl.ClientAuth(req.TLS.ServerName)
+}
+
+// forwardClientCert sets the subject and the sha256 fingerprint of the verified client certificate of a request
+func forwardClientCert(req *http.Request) {
+	req.Header.Del(CLIENT_CERT_SUBJECT_HEADER)
+	req.Header.Del(CLIENT_CERT_FINGERPRINT_HEADER)
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+		return
+	}
+	cert := req.TLS.PeerCertificates[0]
+	fingerprint := sha256.Sum256(cert.Raw)
+	req.Header.Set(CLIENT_CERT_SUBJECT_HEADER, cert.Subject.String())
+	req.Header.Set(CLIENT_CERT_FINGERPRINT_HEADER, hex.EncodeToString(fingerprint[:]))
+}
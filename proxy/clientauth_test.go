@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dbcdk/shelob/util"
+)
+
+type fakeCertLookup map[string]*util.ClientAuth
+
+func (l fakeCertLookup) CertKeys() []string                          { return nil }
+func (l fakeCertLookup) Lookup(hostName string) *tls.Certificate     { return nil }
+func (l fakeCertLookup) ClientAuth(hostName string) *util.ClientAuth { return l[hostName] }
+
+func TestClientAuth(t *testing.T) {
+	clientCert, clientKey := createKeyPair(t, "client")
+	auth, err := util.NewClientAuth("required", clientCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookup := fakeCertLookup{"mtls.example.com": auth}
+
+	serverCert, serverKey := createKeyPair(t, "server")
+	pair, err := tls.X509KeyPair(serverCert, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if misdirected(req, util.StripPortFromDomain(req.Host), lookup) {
+			w.WriteHeader(http.StatusMisdirectedRequest)
+			return
+		}
+		forwardClientCert(req)
+		w.Header().Set("X-Subject", req.Header.Get(CLIENT_CERT_SUBJECT_HEADER))
+		w.Header().Set("X-Fingerprint", req.Header.Get(CLIENT_CERT_FINGERPRINT_HEADER))
+	}))
+	server.TLS = withClientAuth(&tls.Config{Certificates: []tls.Certificate{pair}}, lookup)
+	server.StartTLS()
+	defer server.Close()
+
+	clientPair, err := tls.X509KeyPair(clientCert, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		serverName string
+		host       string
+		cert       bool
+		code       int
+		subject    string
+	}{
+		{"open host", "open.example.com", "open.example.com", false, http.StatusOK, ""},
+		{"missing certificate", "mtls.example.com", "mtls.example.com", false, 0, ""},
+		{"client certificate", "mtls.example.com", "mtls.example.com", true, http.StatusOK, "CN=client"},
+		{"misdirected", "open.example.com", "mtls.example.com", false, http.StatusMisdirectedRequest, ""},
+	}
+	for _, test := range tests {
+		config := &tls.Config{InsecureSkipVerify: true, ServerName: test.serverName}
+		if test.cert {
+			config.Certificates = []tls.Certificate{clientPair}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+		req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+		req.Host = test.host
+		req.Header.Set(CLIENT_CERT_SUBJECT_HEADER, "CN=spoofed")
+
+		res, err := client.Do(req)
+		if err != nil {
+			if test.code != 0 {
+				t.Errorf("Expected %s to give %d, got %v", test.name, test.code, err)
+			}
+			continue
+		}
+		res.Body.Close()
+		if res.StatusCode != test.code || res.Header.Get("X-Subject") != test.subject {
+			t.Errorf("Expected %s to give %d with subject %q, got %d with subject %q", test.name, test.code, test.subject, res.StatusCode, res.Header.Get("X-Subject"))
+		}
+		if test.cert && len(res.Header.Get("X-Fingerprint")) != 64 {
+			t.Errorf("Expected sha256 fingerprint of client certificate, got %q", res.Header.Get("X-Fingerprint"))
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+
+	"github.com/dbcdk/shelob/util"
+	"go.uber.org/zap"
+)
+
+// LimitListener wraps a listener, closing accepted connections right away when the listener or the client ip already
+// has the maximum number of connections open
+func LimitListener(listener net.Listener, name string, limits util.Limits, counters *util.Counters) net.Listener {
+	return &limitListener{
+		Listener: listener,
+		name:     name,
+		limits:   limits,
+		counters: counters,
+		clients:  make(map[string]int),
+	}
+}
+
+type limitListener struct {
+	net.Listener
+	name     string
+	limits   util.Limits
+	counters *util.Counters
+
+	mutex   sync.Mutex
+	open    int
+	clients map[string]int
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		client := clientIP(conn.RemoteAddr())
+		if reason := l.acquire(client); reason != "" {
+			l.counters.RejectedConns.WithLabelValues(l.name, reason).Inc()
+			log.Debug("Rejecting connection",
+				zap.String("event", "connectionRejected"),
+				zap.String("listener", l.name),
+				zap.String("client", client),
+				zap.String("reason", reason),
+			)
+			conn.Close()
+			continue
+		}
+
+		return &limitConn{Conn: conn, release: func() { l.release(client) }}, nil
+	}
+}
+
+// acquire counts a new connection of a client, or returns the reason it is rejected
+func (l *limitListener) acquire(client string) string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.limits.MaxConnections > 0 && l.open >= l.limits.MaxConnections {
+		return "listener_limit"
+	}
+	if l.limits.MaxConnectionsPerIP > 0 && l.clients[client] >= l.limits.MaxConnectionsPerIP {
+		return "client_limit"
+	}
+	l.open++
+	l.clients[client]++
+	l.counters.Connections.WithLabelValues(l.name).Inc()
+	return ""
+}
+
+func (l *limitListener) release(client string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.open--
+	if l.clients[client]--; l.clients[client] <= 0 {
+		delete(l.clients, client)
+	}
+	l.counters.Connections.WithLabelValues(l.name).Dec()
+}
+
+// limitConn releases its slot of the listener when closed, which the http server may do more than once
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// CloseWrite half-closes the connection, as a plain TCP connection does. Connections which cannot be half-closed are
+// closed, releasing their slot
+func (c *limitConn) CloseWrite() error {
+	if conn, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return conn.CloseWrite()
+	}
+	return c.Close()
+}
+
+func clientIP(addr net.Addr) string {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
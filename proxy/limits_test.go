@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dbcdk/shelob/util"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLimitListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counters := util.CreateCounters()
+	listener := LimitListener(inner, "http", util.Limits{MaxConnectionsPerIP: 2}, &counters)
+	defer listener.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	clients := make([]net.Conn, 0)
+	for n := 0; n < 3; n++ {
+		client, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		clients = append(clients, client)
+	}
+
+	first, second := <-accepted, <-accepted
+	defer second.Close()
+	clients[2].SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := clients[2].Read(make([]byte, 1)); err == nil {
+		t.Error("Expected connection above the client limit to be closed")
+	}
+	if rejected := testutil.ToFloat64(counters.RejectedConns.WithLabelValues("http", "client_limit")); rejected != 1 {
+		t.Errorf("Expected rejected connection to be counted, got %v", rejected)
+	}
+	if open := testutil.ToFloat64(counters.Connections.WithLabelValues("http")); open != 2 {
+		t.Errorf("Expected two open connections, got %v", open)
+	}
+
+	first.Close()
+	first.Close()
+	client, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(time.Second):
+		t.Error("Expected connection to be accepted after another one was closed")
+	}
+}
+
+// pipeListener accepts one end of in-memory pipes, which cannot be half-closed
+type pipeListener struct {
+	net.Listener
+	conns chan net.Conn
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	return <-l.conns, nil
+}
+
+func TestLimitConnCloseWrite(t *testing.T) {
+	counters := util.CreateCounters()
+	inner := &pipeListener{conns: make(chan net.Conn, 1)}
+	listener := LimitListener(inner, "https", util.Limits{MaxConnections: 1}, &counters)
+
+	server, client := net.Pipe()
+	defer client.Close()
+	inner.conns <- server
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if open := testutil.ToFloat64(counters.Connections.WithLabelValues("https")); open != 1 {
+		t.Errorf("Expected one open connection, got %v", open)
+	}
+
+	conn.(interface{ CloseWrite() error }).CloseWrite()
+	if open := testutil.ToFloat64(counters.Connections.WithLabelValues("https")); open != 0 {
+		t.Errorf("Expected connection which cannot be half-closed to release its slot, got %v open", open)
+	}
+	conn.Close()
+	if open := testutil.ToFloat64(counters.Connections.WithLabelValues("https")); open != 0 {
+		t.Errorf("Expected slot to be released once, got %v open", open)
+	}
+}
@@ -33,11 +33,17 @@ func StartProxyServer(config *util.Config) {
 	if err != nil {
 		log.Fatal(err.Error())
 	}
+	listener = LimitListener(listener, "http", config.Limits, &config.Counters)
 	defer listener.Close()
 
 	proxyServer := &http.Server{
-		Handler: RedirectHandler(config),
+		Handler:   RedirectHandler(config, nil),
+		Protocols: new(http.Protocols),
 	}
+	proxyServer.Protocols.SetHTTP1(true)
+	// without TLS there is no ALPN, clients must know the server speaks HTTP/2 beforehand
+	proxyServer.Protocols.SetUnencryptedHTTP2(config.EnableH2c)
+	applyLimits(proxyServer, config.Limits)
 
 	log.Info("Shelob started HTTP-listen",
 		zap.String("event", "started"),
@@ -57,6 +63,8 @@ func StartTLSProxyServer(config *util.Config, cl certs.CertLookup) {
 	if err != nil {
 		log.Fatal(err.Error())
 	}
+	listener = LimitListener(listener, "https", config.Limits, &config.Counters)
+	listener = PassthroughListener(listener, config)
 	defer listener.Close()
 
 	selfSigned, err := certs.SelfSignedCert()
@@ -66,9 +74,11 @@ func StartTLSProxyServer(config *util.Config, cl certs.CertLookup) {
 	}
 
 	proxyServer := &http.Server{
-		Handler: RedirectHandler(config),
-		TLSConfig: &tls.Config{
+		Handler:   RedirectHandler(config, cl),
+		Protocols: new(http.Protocols),
+		TLSConfig: withClientAuth(&tls.Config{
 			MinVersion: tls.VersionTLS12,
+			NextProtos: nextProtos(config.EnableHttp2),
 			GetCertificate: func(info *tls.ClientHelloInfo) (certificate *tls.Certificate, e error) {
 				if cert := cl.Lookup(info.ServerName); cert != nil {
 					return cert, nil
@@ -83,8 +93,11 @@ func StartTLSProxyServer(config *util.Config, cl certs.CertLookup) {
 					return nil, fmt.Errorf("No matching sni-cert and no self-signed cert to serve")
 				}
 			},
-		},
+		}, cl),
 	}
+	proxyServer.Protocols.SetHTTP1(true)
+	proxyServer.Protocols.SetHTTP2(config.EnableHttp2)
+	applyLimits(proxyServer, config.Limits)
 
 	log.Info("Shelob started HTTPS-listen",
 		zap.String("event", "started"),
@@ -97,6 +110,41 @@ func StartTLSProxyServer(config *util.Config, cl certs.CertLookup) {
 	)
 }
 
+// withClientAuth asks clients of hosts with client auth for a certificate, verified against the CA bundle of the host
+func withClientAuth(config *tls.Config, cl certs.CertLookup) *tls.Config {
+	config.GetConfigForClient = func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+		auth := cl.ClientAuth(info.ServerName)
+		if auth == nil {
+			return nil, nil
+		}
+		hostConfig := config.Clone()
+		hostConfig.GetConfigForClient = nil
+		hostConfig.ClientAuth = auth.TLSClientAuth()
+		hostConfig.ClientCAs = auth.CAs
+		// a session must not be resumed for a host verifying client certificates differently than the host it began with
+		hostConfig.SessionTicketsDisabled = true
+		return hostConfig, nil
+	}
+	return config
+}
+
+// nextProtos returns the protocols offered to clients with ALPN, HTTP/2 is preferred when enabled
+func nextProtos(http2 bool) []string {
+	if http2 {
+		return []string{"h2", "http/1.1"}
+	}
+	return []string{"http/1.1"}
+}
+
+// applyLimits sets the timeouts and header size limit of a proxy server, a zero limit leaves the default of the server
+func applyLimits(server *http.Server, limits util.Limits) {
+	server.ReadHeaderTimeout = limits.ReadHeaderTimeout
+	server.ReadTimeout = limits.ReadTimeout
+	server.WriteTimeout = limits.WriteTimeout
+	server.IdleTimeout = limits.IdleTimeout
+	server.MaxHeaderBytes = limits.MaxHeaderBytes
+}
+
 func StartAdminServer(config *util.Config) {
 	httpAddr := ":" + strconv.Itoa(config.MetricsPort)
 
@@ -0,0 +1,249 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/dbcdk/shelob/util"
+	"go.uber.org/zap"
+)
+
+// time a client has to send its ClientHello when no read header timeout is configured
+const DEFAULT_HELLO_TIMEOUT = 10 * time.Second
+
+var errHelloPeeked = errors.New("client hello peeked")
+
+// PassthroughListener wraps the listener of the TLS proxy server. The ClientHello of every connection is peeked, and
+// connections for passthrough hosts are spliced to a backend of the host instead of being accepted. The ClientHello is
+// peeked in the background, so a slow client does not hold up the others
+func PassthroughListener(listener net.Listener, config *util.Config) net.Listener {
+	l := &passthroughListener{
+		Listener: listener,
+		config:   config,
+		accepted: make(chan accepted),
+		done:     make(chan struct{}),
+	}
+	go l.serve()
+	return l
+}
+
+type passthroughListener struct {
+	net.Listener
+	config   *util.Config
+	accepted chan accepted
+	done     chan struct{}
+	once     sync.Once
+}
+
+type accepted struct {
+	conn net.Conn
+	err  error
+}
+
+func (l *passthroughListener) Accept() (net.Conn, error) {
+	select {
+	case a := <-l.accepted:
+		return a.conn, a.err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *passthroughListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+func (l *passthroughListener) serve() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			// errors are passed on, the server decides whether to keep accepting
+			if !l.deliver(accepted{err: err}) || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go l.route(conn)
+	}
+}
+
+// deliver hands a connection or error to Accept, and tells if the listener is still open
+func (l *passthroughListener) deliver(a accepted) bool {
+	select {
+	case l.accepted <- a:
+		return true
+	case <-l.done:
+		if a.conn != nil {
+			a.conn.Close()
+		}
+		return false
+	}
+}
+
+// route splices the connection of a passthrough host, and hands any other connection to the server with its peeked
+// bytes put back
+func (l *passthroughListener) route(conn net.Conn) {
+	timeout := l.config.Limits.ReadHeaderTimeout
+	if timeout <= 0 {
+		timeout = DEFAULT_HELLO_TIMEOUT
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	hello, serverName, err := peekClientHello(conn)
+	conn.SetReadDeadline(time.Time{})
+
+	if err == nil {
+		if frontend := l.config.RoutingTable().Frontends[serverName]; frontend != nil && frontend.Action == util.BACKEND_ACTION_PASSTHROUGH {
+			l.splice(conn, hello, serverName, frontend)
+			return
+		}
+	}
+	// connections which are not tls at all are handed to the server too, it answers plain HTTP requests with an error
+	l.deliver(accepted{conn: &peekedConn{Conn: conn, reader: io.MultiReader(bytes.NewReader(hello), conn)}})
+}
+
+// splice connects the client to a backend of the passthrough host, and copies the stream both ways until both sides
+// are done
+func (l *passthroughListener) splice(conn net.Conn, hello []byte, serverName string, frontend *util.Frontend) {
+	defer conn.Close()
+
+	backend := passthroughBackend(frontend)
+	if backend == nil {
+		l.config.Counters.PassthroughConns.WithLabelValues(serverName, "no_backend").Inc()
+		return
+	}
+	upstream, err := net.DialTimeout("tcp", backend.Host, util.DEFAULT_CONNECT_TIMEOUT)
+	if err != nil {
+		l.config.Counters.PassthroughConns.WithLabelValues(serverName, "dial_failed").Inc()
+		log.Debug("Failed to connect to passthrough backend",
+			zap.String("event", "passthroughFailed"),
+			zap.String("host", serverName),
+			zap.String("backend", backend.Host),
+			zap.String("error", err.Error()),
+		)
+		return
+	}
+	defer upstream.Close()
+	l.config.Counters.PassthroughConns.WithLabelValues(serverName, "spliced").Inc()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := upstream.Write(hello); err == nil {
+			io.Copy(upstream, conn)
+		}
+		closeWrite(upstream)
+	}()
+	io.Copy(conn, upstream)
+	closeWrite(conn)
+	<-done
+}
+
+// passthroughBackend picks a random backend in rotation of a passthrough host, in proportion to the weights of the
+// backends. Paths and request matches mean nothing without terminating tls, so the first route without matches is
+// used, or the first route with backends when all of them have matches
+func passthroughBackend(frontend *util.Frontend) *url.URL {
+	var fallback *util.Route
+	for _, route := range frontend.Routes {
+		if route.Balancer == nil || len(route.Balancer.Servers()) == 0 {
+			continue
+		}
+		if len(route.Matches) == 0 {
+			return weightedServer(route)
+		}
+		if fallback == nil {
+			fallback = route
+		}
+	}
+	if fallback != nil {
+		return weightedServer(fallback)
+	}
+	return nil
+}
+
+// weightedServer picks a random server in rotation of a route, servers which are not a backend of the route weigh 1
+func weightedServer(route *util.Route) *url.URL {
+	weights := make(map[string]int, len(route.Backends))
+	for _, backend := range route.Backends {
+		weights[backend.Url.String()] = backend.Weight
+	}
+
+	servers := route.Balancer.Servers()
+	serverWeights := make([]int, len(servers))
+	total := 0
+	for i, server := range servers {
+		weight, exists := weights[server.String()]
+		if !exists {
+			weight = 1
+		}
+		serverWeights[i] = weight
+		total += weight
+	}
+	if total <= 0 {
+		return nil
+	}
+
+	pick := rand.IntN(total)
+	for i, weight := range serverWeights {
+		if pick < weight {
+			return servers[i]
+		}
+		pick -= weight
+	}
+	return nil
+}
+
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+	} else {
+		conn.Close()
+	}
+}
+
+// peekClientHello reads the ClientHello of a connection and returns the bytes read along with the server name
+func peekClientHello(conn net.Conn) ([]byte, string, error) {
+	var hello bytes.Buffer
+	var serverName string
+	err := tls.Server(&readOnlyConn{Conn: conn, reader: io.TeeReader(conn, &hello)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = info.ServerName
+			return nil, errHelloPeeked
+		},
+	}).Handshake()
+	if !errors.Is(err, errHelloPeeked) {
+		return hello.Bytes(), "", err
+	}
+	return hello.Bytes(), serverName, nil
+}
+
+// readOnlyConn lets the tls handshake read from a connection without writing anything to it
+type readOnlyConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *readOnlyConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *readOnlyConn) Write(b []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+// peekedConn replays the bytes read while peeking before reading on from the connection
+type peekedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/dbcdk/shelob/util"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPassthroughListener(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "backend")
+	}))
+	defer backend.Close()
+	backendUrl, _ := url.Parse(backend.URL)
+
+	config := &util.Config{Counters: util.CreateCounters()}
+	config.PublishFrontends(map[string]*util.Frontend{
+		"passthrough.example.com": {
+			Action: util.BACKEND_ACTION_PASSTHROUGH,
+			Routes: []*util.Route{{
+				Balancer: util.CreateBalancer(nil, util.Balancing{}, []util.Backend{{Url: backendUrl, Weight: 1}}, nil),
+			}},
+		},
+	})
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "proxy")
+	}))
+	proxy.Listener = PassthroughListener(inner, config)
+	proxy.StartTLS()
+	defer proxy.Close()
+
+	get := func(serverName string) string {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{ServerName: serverName, InsecureSkipVerify: true},
+		}}
+		res, err := client.Get(proxy.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		return string(body)
+	}
+
+	if body := get("passthrough.example.com"); body != "backend" {
+		t.Errorf("Expected passthrough host to be spliced to its backend, got %q", body)
+	}
+	if body := get("app.example.com"); body != "proxy" {
+		t.Errorf("Expected other hosts to be served by the proxy, got %q", body)
+	}
+	if spliced := testutil.ToFloat64(config.Counters.PassthroughConns.WithLabelValues("passthrough.example.com", "spliced")); spliced != 1 {
+		t.Errorf("Expected spliced connection to be counted, got %v", spliced)
+	}
+}
+
+func TestPassthroughBackendWeights(t *testing.T) {
+	stable, _ := url.Parse("http://10.0.0.1:8443")
+	canary, _ := url.Parse("http://10.0.0.2:8443")
+	matched, _ := url.Parse("http://10.0.0.3:8443")
+	backends := []util.Backend{{Url: stable, Weight: 9}, {Url: canary, Weight: 1}}
+	frontend := &util.Frontend{
+		Action: util.BACKEND_ACTION_PASSTHROUGH,
+		Routes: []*util.Route{
+			{
+				Matches:  []util.RequestMatch{{Source: util.MATCH_SOURCE_HEADER, Name: "X-Canary", Value: "always"}},
+				Backends: []util.Backend{{Url: matched, Weight: 1}},
+				Balancer: util.CreateBalancer(nil, util.Balancing{}, []util.Backend{{Url: matched, Weight: 1}}, nil),
+			},
+			{
+				Backends: backends,
+				Balancer: util.CreateBalancer(nil, util.Balancing{}, backends, nil),
+			},
+		},
+	}
+
+	picks := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		picks[passthroughBackend(frontend).Host]++
+	}
+	if picks[matched.Host] != 0 {
+		t.Errorf("Expected routes with request matches to be passed over, got %v", picks)
+	}
+	if picks[canary.Host] < 800 || picks[canary.Host] > 1200 {
+		t.Errorf("Expected backends to be picked in proportion to their weights, got %v", picks)
+	}
+}
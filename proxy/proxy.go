@@ -3,6 +3,7 @@ package proxy
 import (
 	"context"
 	"crypto/tls"
+	"github.com/dbcdk/shelob/certs"
 	"github.com/dbcdk/shelob/logging"
 	"github.com/dbcdk/shelob/mux"
 	"github.com/dbcdk/shelob/util"
@@ -13,12 +14,17 @@ import (
 	"go.uber.org/zap"
 	"net"
 	"net/http"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"weak"
 )
 
-func RedirectHandler(config *util.Config) http.Handler {
+// RedirectHandler serves the requests of a proxy listener, cl is the certificate lookup of the TLS listener and nil for
+// the plain listener
+func RedirectHandler(config *util.Config, cl certs.CertLookup) http.Handler {
 	webMux := mux.CreateWebMux(config)
 
 	return http.HandlerFunc(func(plainwriter http.ResponseWriter, req *http.Request) {
@@ -49,16 +55,30 @@ func RedirectHandler(config *util.Config) http.Handler {
 
 		if tooManyXForwardedHostHeaders {
 			status = http.StatusBadRequest
-			http.Error(w, "X-Forwarded-Host must not be repeated", status)
-		} else if frontend := config.Frontends[domain]; frontend != nil { // select frontend
-			request_type = dispatchRequest(*frontend, w, req, config.Forwarder)
+			util.Error(w, req, "X-Forwarded-Host must not be repeated", status)
+		} else if misdirected(req, domain, cl) {
+			// the client retries on a connection of its own for the host
+			request_type = "misdirected"
+			status = http.StatusMisdirectedRequest
+			util.Error(w, req, http.StatusText(status), status)
+		} else if frontend := config.RoutingTable().Frontends[domain]; frontend != nil { // select frontend
+			forwardClientCert(req)
+			if allowed, delay := frontend.RateLimiter.Allow(req); allowed {
+				request_type = dispatchRequest(*frontend, w, req, config.Forwarder)
+			} else {
+				request_type = "ratelimited"
+				status = http.StatusTooManyRequests
+				w.Header().Set("Retry-After", strconv.Itoa(util.RetryAfter(delay)))
+				util.Error(w, req, http.StatusText(status), status)
+			}
 		} else {
 			// TODO: make internal endpoint serving as explicit frontends -> get rid of this fallback
 			// no matching frontends, try serving internally
 			request_type = "internal"
 			webMux.ServeHTTP(w, req)
 		}
-		status = w.StatusCode()
+		// gRPC calls are counted by their gRPC status
+		status = util.ResponseStatus(req, w.Header(), w.StatusCode())
 
 		duration := float64(time.Now().UnixNano()-t__start) / 1000000
 
@@ -90,14 +110,16 @@ func RedirectHandler(config *util.Config) http.Handler {
 	})
 }
 
-func CreateForwarder() *forward.Forwarder {
+// CreateTransport creates the transport to the backends, shared by the forwarder and the health checker. The
+// certificates of https backends are left unverified when ignoreSSLErrors is set
+func CreateTransport(ignoreSSLErrors bool) http.RoundTripper {
 	resolver := dnscache.New(time.Minute * 1)
 
 	dialContextFn := func(ctx context.Context, network string, address string) (net.Conn, error) {
 		separator := strings.LastIndex(address, ":")
 		ip, _ := resolver.FetchOneString(address[:separator])
 		dialer := &net.Dialer{
-			Timeout: 1 * time.Second,
+			Timeout: util.ConnectTimeout(ctx),
 		}
 
 		return dialer.DialContext(ctx, network, ip+address[separator:])
@@ -112,11 +134,26 @@ func CreateForwarder() *forward.Forwarder {
 		ExpectContinueTimeout: 1 * time.Second,
 		DialContext:           dialContextFn,
 		TLSClientConfig: &tls.Config{
-			MinVersion: tls.VersionTLS12,
+			MinVersion:         tls.VersionTLS12,
+			InsecureSkipVerify: ignoreSSLErrors,
 		},
 	}
 
-	forwarder, err := forward.New(forward.PassHostHeader(true), forward.RoundTripper(transport))
+	// backends speaking HTTP/2 get a transport of their own, over TLS for https backends and in cleartext (h2c) otherwise
+	http2Transport := transport.Clone()
+	http2Transport.Protocols = new(http.Protocols)
+	http2Transport.Protocols.SetHTTP2(true)
+	http2Transport.Protocols.SetUnencryptedHTTP2(true)
+
+	return &protocolTransport{
+		backendTransport: backendTransport{http1: transport, http2: http2Transport},
+		tls:              make(map[weak.Pointer[tls.Config]]backendTransport),
+	}
+}
+
+// CreateForwarder creates the forwarder shared by all routes
+func CreateForwarder(transport http.RoundTripper) *forward.Forwarder {
+	forwarder, err := forward.New(forward.PassHostHeader(true), forward.RoundTripper(transport), forward.ErrorHandler(util.ForwardErrorHandler))
 
 	if err != nil {
 		panic(err)
@@ -125,6 +162,64 @@ func CreateForwarder() *forward.Forwarder {
 	return forwarder
 }
 
+// backendTransport speaks HTTP/1.1 or HTTP/2 to backends, depending on the protocol of the route of a request
+type backendTransport struct {
+	http1 *http.Transport
+	http2 *http.Transport
+}
+
+func (t backendTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if util.BackendProtocol(req.Context()) == util.BACKEND_PROTOCOL_HTTP2 {
+		return t.http2.RoundTrip(req)
+	}
+	return t.http1.RoundTrip(req)
+}
+
+// protocolTransport picks the transport speaking the protocol of the route of a request. Routes with a tls config of
+// their own get transports of their own, which are dropped along with the config when the route is replaced
+type protocolTransport struct {
+	backendTransport
+
+	mutex sync.Mutex
+	tls   map[weak.Pointer[tls.Config]]backendTransport
+}
+
+func (t *protocolTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if config := util.BackendTLSConfig(req.Context()); config != nil {
+		return t.withTLS(config).RoundTrip(req)
+	}
+	return t.backendTransport.RoundTrip(req)
+}
+
+func (t *protocolTransport) withTLS(config *tls.Config) backendTransport {
+	key := weak.Make(config)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if transport, exists := t.tls[key]; exists {
+		return transport
+	}
+	// the transports get copies of the config, so they do not keep it from being collected
+	transport := backendTransport{http1: t.http1.Clone(), http2: t.http2.Clone()}
+	transport.http1.TLSClientConfig = config.Clone()
+	transport.http2.TLSClientConfig = config.Clone()
+	t.tls[key] = transport
+	runtime.AddCleanup(config, t.drop, key)
+	return transport
+}
+
+func (t *protocolTransport) drop(key weak.Pointer[tls.Config]) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if transport, exists := t.tls[key]; exists {
+		transport.http1.CloseIdleConnections()
+		transport.http2.CloseIdleConnections()
+		delete(t.tls, key)
+	}
+}
+
 func dispatchRequest(frontend util.Frontend, w http.ResponseWriter, req *http.Request, forwarder *forward.Forwarder) string {
 
 	// http vs. https
@@ -152,18 +247,38 @@ func dispatchRequest(frontend util.Frontend, w http.ResponseWriter, req *http.Re
 
 	switch frontend.Action {
 	case util.BACKEND_ACTION_REDIRECT:
-		url := frontend.Intercept.Url
+		// copy the url, the intercept is shared with concurrent requests through the routing table
+		url := *frontend.Intercept.Url
 		if url.Path == "" {
 			url.Path = req.RequestURI
 		}
 		http.Redirect(w, req, url.String(), int(frontend.Intercept.Code))
 	case util.BACKEND_ACTION_PROXY_RR:
-		rr := frontend.RR
-		if rr != nil && len(rr.Servers()) > 0 {
-			rr.ServeHTTP(w, req)
+		route := frontend.MatchRoute(req)
+		if route == nil {
+			status := http.StatusNotFound
+			util.Error(w, req, http.StatusText(status), status)
+		} else if route.LostAffinity(req) {
+			status := http.StatusServiceUnavailable
+			util.Error(w, req, "Pinned backend is no longer available", status)
+		} else if balancer := route.Balancer; balancer != nil && len(balancer.Servers()) > 0 {
+			if util.ServeWithTimeouts(balancer, route.Timeouts, w, req) {
+				return "timeout"
+			}
 		} else {
 			status := http.StatusServiceUnavailable
-			http.Error(w, http.StatusText(status), status)
+			util.Error(w, req, http.StatusText(status), status)
+		}
+	case util.BACKEND_ACTION_PASSTHROUGH:
+		// connections of passthrough hosts are spliced by the TLS listener, their requests only end up here when sent
+		// in plain HTTP or on the connection of another host
+		if req.TLS != nil {
+			status := http.StatusMisdirectedRequest
+			util.Error(w, req, http.StatusText(status), status)
+		} else {
+			url := util.UrlClone(req)
+			url.Scheme = "https"
+			http.Redirect(w, req, url.String(), http.StatusTemporaryRedirect)
 		}
 	case util.BACKEND_ACTION_RESPOND:
 		status := int(frontend.Intercept.Code)
@@ -171,7 +286,7 @@ func dispatchRequest(frontend util.Frontend, w http.ResponseWriter, req *http.Re
 		if responseText == "" {
 			responseText = http.StatusText(status)
 		}
-		http.Error(w, responseText, status)
+		util.Error(w, req, responseText, status)
 	}
 
 	return actionToPrometheusRequestType(frontend.Action)
@@ -187,6 +302,8 @@ func actionToPrometheusRequestType(a uint16) (request_type string) {
 		request_type = "respond"
 	case util.BACKEND_ACTION_PROXY_RR:
 		request_type = "proxy"
+	case util.BACKEND_ACTION_PASSTHROUGH:
+		request_type = "passthrough"
 	}
 	return
 }
@@ -0,0 +1,191 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/dbcdk/shelob/util"
+)
+
+func TestForwarderProtocols(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Proto", req.Proto)
+	}))
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetHTTP1(true)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	forwarder := CreateForwarder(CreateTransport(false))
+	for protocol, expected := range map[uint16]string{util.BACKEND_PROTOCOL_HTTP1: "HTTP/1.1", util.BACKEND_PROTOCOL_HTTP2: "HTTP/2.0"} {
+		balancer := util.CreateBalancer(util.WithProtocol(forwarder, protocol), util.Balancing{}, []util.Backend{{Url: u}}, nil)
+		w := httptest.NewRecorder()
+		balancer.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if w.Code != http.StatusOK || w.Header().Get("X-Proto") != expected {
+			t.Errorf("Expected backend to be spoken to with %s, got %d %s", expected, w.Code, w.Header().Get("X-Proto"))
+		}
+	}
+}
+
+func TestForwarderGrpc(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte{0, 0, 0, 0, 0})
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "5")
+	}))
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	u, _ := url.Parse(server.URL)
+	balancer := util.CreateBalancer(util.WithProtocol(CreateForwarder(CreateTransport(false)), util.BACKEND_PROTOCOL_HTTP2), util.Balancing{}, []util.Backend{{Url: u}}, nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/package.Service/Method", nil)
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	w := httptest.NewRecorder()
+	balancer.ServeHTTP(w, req)
+	if status := util.ResponseStatus(req, w.Header(), w.Code); status != http.StatusNotFound {
+		t.Errorf("Expected grpc status in the trailers to be counted as 404, got %d", status)
+	}
+
+	server.Close()
+	w = httptest.NewRecorder()
+	balancer.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Header().Get("Grpc-Status") != "14" {
+		t.Errorf("Expected unavailable backend to give grpc status 14, got %d %q", w.Code, w.Header().Get("Grpc-Status"))
+	}
+}
+
+func TestForwarderBackendTLS(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if len(req.TLS.PeerCertificates) > 0 {
+			w.Header().Set("X-Client", req.TLS.PeerCertificates[0].Subject.CommonName)
+		}
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	cert, key := createKeyPair(t, "client")
+	withTLS := func(serverName string, ca []byte, cert []byte, key []byte) *util.BackendTLS {
+		backendTLS, err := util.NewBackendTLS(serverName, "", ca, "", cert, key, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return backendTLS
+	}
+
+	tests := []struct {
+		name     string
+		insecure bool
+		tls      *util.BackendTLS
+		code     int
+		client   string
+	}{
+		{"unknown CA", false, nil, http.StatusBadGateway, ""},
+		{"insecure", true, nil, http.StatusOK, ""},
+		{"CA", false, withTLS("", ca, nil, nil), http.StatusOK, ""},
+		{"server name", false, withTLS("example.com", ca, nil, nil), http.StatusOK, ""},
+		{"wrong server name", false, withTLS("example.org", ca, nil, nil), http.StatusBadGateway, ""},
+		{"client certificate", false, withTLS("", ca, cert, key), http.StatusOK, "client"},
+	}
+	for _, test := range tests {
+		var next http.Handler = CreateForwarder(CreateTransport(test.insecure))
+		if test.tls != nil {
+			next = util.WithBackendTLS(next, test.tls)
+		}
+		balancer := util.CreateBalancer(next, util.Balancing{}, []util.Backend{{Url: u}}, nil)
+		w := httptest.NewRecorder()
+		balancer.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if w.Code != test.code || w.Header().Get("X-Client") != test.client {
+			t.Errorf("Expected %s to give %d with client %q, got %d with client %q", test.name, test.code, test.client, w.Code, w.Header().Get("X-Client"))
+		}
+	}
+}
+
+func TestHealthCheckProtocols(t *testing.T) {
+	h2c := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	h2c.Config.Protocols = new(http.Protocols)
+	h2c.Config.Protocols.SetUnencryptedHTTP2(true)
+	h2c.Start()
+	defer h2c.Close()
+	private := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer private.Close()
+
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: private.Certificate().Raw})
+	backendTLS, err := util.NewBackendTLS("", "", ca, "", nil, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := util.HealthCheck{Path: "/", Interval: time.Hour, Timeout: time.Second, HealthyThreshold: 1, UnhealthyThreshold: 1}
+	routes := []*util.Route{
+		{Protocol: util.BACKEND_PROTOCOL_HTTP2, HealthCheck: &check},
+		{TLS: backendTLS, HealthCheck: &check},
+	}
+	for i, server := range []*httptest.Server{h2c, private} {
+		u, _ := url.Parse(server.URL)
+		routes[i].Backends = []util.Backend{{Url: u}}
+	}
+
+	counters := util.CreateCounters()
+	checker := util.NewHealthChecker(&counters, CreateTransport(false))
+	for _, route := range routes {
+		route.Balancer = util.GuardBalancer(util.CreateBalancer(nil, util.Balancing{}, route.Backends, nil), route, checker, nil)
+	}
+	checker.Sync(&util.RoutingTable{Frontends: map[string]*util.Frontend{"app.example.com": {Routes: routes}}})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for _, health := range checker.Status() {
+		for health.LastCheck.IsZero() && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+			for _, current := range checker.Status() {
+				if current.Url == health.Url {
+					health = current
+				}
+			}
+		}
+		if !health.Healthy || health.LastCheck.IsZero() {
+			t.Errorf("Expected %s to be probed with the protocol and tls config of its route, got %+v", health.Url, health)
+		}
+	}
+}
+
+// createKeyPair creates a self-signed certificate and its key, PEM encoded
+func createKeyPair(t *testing.T, commonName string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
@@ -14,6 +14,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var (
@@ -35,7 +36,21 @@ var (
 	ignoreNamespaces    = kingpin.Flag("ignore-namespaces", "Ignore endpoint watch-events from one or more (comma-separated) namespaces").Default("default,kube-system").String()
 	certFilePairs       = kingpin.Flag("cert-file-pairs", "Comma-separated list of keypair paths in local fs - format: 'hostname1:path-to-pubkey1:path-to-privkey1,hostname2:path-to-pubkey2:path-to-privkey2' etc., mutually excusive with 'cert-namespace'").String()
 	certNamespace       = kingpin.Flag("cert-namespace", "Kubernetes Namespace in which to search for issued certificates, mutually excusive with 'cert-file-pairs'").String()
+	clientCAFiles       = kingpin.Flag("client-ca-files", "Comma-separated list of client auth modes (off, optional or required) and CA bundles verifying client certificates of hosts in local fs - format: 'hostname1:mode1:path-to-ca1,hostname2:mode2:path-to-ca2' etc., used along with 'cert-file-pairs'").String()
 	wildcardCertPrefix  = kingpin.Flag("wildcard-cert-prefix", "The name prefix to use for wildcard certificates in Kubernetes, e.g. (prefix).wildcardexample.com.").Default("").String()
+	ingressClass        = kingpin.Flag("ingress-class", "Only handle ingresses of this IngressClass. Ingresses without a class are handled when the IngressClass is marked as default (empty=handle all ingresses)").Default("").String()
+	gatewayController   = kingpin.Flag("gateway-controller-name", "Handle Gateway API HTTPRoutes attached to Gateways of a GatewayClass with this controllerName, requires the watch-api (empty=disabled)").Default("").String()
+	affinitySecret      = kingpin.Flag("affinity-secret", "Secret used to sign affinity cookies, must be the same on all instances for clients to stay pinned when switching between them (empty=random secret per instance)").Envar("SHELOB_AFFINITY_SECRET").Default("").String()
+	enableHttp2         = kingpin.Flag("http2", "Negotiate HTTP/2 with clients on the https port using ALPN").Default("false").Bool()
+	enableH2c           = kingpin.Flag("h2c", "Accept HTTP/2 in cleartext (h2c with prior knowledge) on the http port").Default("false").Bool()
+	readHeaderTimeout   = kingpin.Flag("read-header-timeout", "Close client connections not sending the request headers within this many seconds (0=no limit)").Default("10").Int()
+	readTimeout         = kingpin.Flag("read-timeout", "Close client connections not sending the whole request within this many seconds (0=no limit)").Default("0").Int()
+	writeTimeout        = kingpin.Flag("write-timeout", "Close client connections not receiving the whole response within this many seconds (0=no limit)").Default("0").Int()
+	idleTimeout         = kingpin.Flag("idle-timeout", "Close idle keep-alive client connections after this many seconds (0=use the read timeout)").Default("120").Int()
+	maxHeaderBytes      = kingpin.Flag("max-header-bytes", "Maximum size of the request headers in bytes").Default("1048576").Int()
+	maxConnections      = kingpin.Flag("max-connections", "Maximum number of open client connections per listener (0=unlimited)").Default("0").Int()
+	maxConnectionsPerIP = kingpin.Flag("max-connections-per-ip", "Maximum number of open connections of a single client ip per listener (0=unlimited)").Default("0").Int()
+	backendTLSSources   = kingpin.Flag("backend-tls-sources", "Read CA bundles and client certificates of https backends from the secrets and config maps named by ingresses, requires read access to secrets and config maps in all namespaces").Default("false").Bool()
 	log                 = logging.GetInstance()
 )
 
@@ -107,6 +122,36 @@ func main() {
 			}
 		}
 	}
+
+	clientCAFileMap := make(map[string]util.ClientCAFile)
+	if *clientCAFiles != "" {
+		for _, file := range strings.Split(*clientCAFiles, ",") {
+			parts := strings.SplitN(file, ":", 3)
+			if len(parts) != 3 {
+				log.Error("Client CA: Invalid entry: " + file)
+				os.Exit(1)
+			}
+			caHostName, mode, path := parts[0], parts[1], parts[2]
+			if _, exists := clientCAFileMap[caHostName]; exists || caHostName == "" {
+				log.Error("Client CA: Invalid or duplicate hostname: " + caHostName)
+				os.Exit(1)
+			}
+			caRaw, err := ioutil.ReadFile(path)
+			if err != nil {
+				log.Error("Invalid client CA file: " + path + " err: " + err.Error())
+				os.Exit(1)
+			}
+			if _, err := util.NewClientAuth(mode, caRaw); err != nil {
+				log.Error("Unable to parse client auth: " + path + " err: " + err.Error())
+				os.Exit(1)
+			}
+			clientCAFileMap[caHostName] = util.ClientCAFile{
+				Mode: mode,
+				Path: path,
+			}
+		}
+	}
+	transport := proxy.CreateTransport(*insecureSSL)
 	config := util.Config{
 		HttpPort:        *httpPort,
 		HttpsPort:       *httpsPort,
@@ -117,26 +162,43 @@ func main() {
 		Logging: util.Logging{
 			AccessLog: *accessLogEnabled,
 		},
+		Limits: util.Limits{
+			ReadHeaderTimeout:   time.Duration(*readHeaderTimeout) * time.Second,
+			ReadTimeout:         time.Duration(*readTimeout) * time.Second,
+			WriteTimeout:        time.Duration(*writeTimeout) * time.Second,
+			IdleTimeout:         time.Duration(*idleTimeout) * time.Second,
+			MaxHeaderBytes:      *maxHeaderBytes,
+			MaxConnections:      *maxConnections,
+			MaxConnectionsPerIP: *maxConnectionsPerIP,
+		},
 		State: util.State{
 			ShutdownInProgress: false,
 			ShutdownChan:       make(chan bool),
 		},
-		Counters:            util.CreateAndRegisterCounters(),
-		Kubeconfig:          kubeconfig,
-		Domain:              *masterDomain,
-		ShutdownDelay:       *shutdownDelay,
-		ReloadEvery:         *reloadEvery,
-		ReloadRollup:        *reloadRollup,
-		AcceptableUpdateLag: *acceptableUpdateLag,
-		Frontends:           make(map[string]*util.Frontend, 0),
-		Forwarder:           proxy.CreateForwarder(),
-		DisableWatch:        *disableWatch,
-		IgnoreNamespaces:    ignoreNamespacesMap,
-		CertFilePairMap:     certFilePairMap,
-		CertNamespace:       *certNamespace,
-		WildcardCertPrefix:  *wildcardCertPrefix,
+		Counters:              util.CreateAndRegisterCounters(),
+		Kubeconfig:            kubeconfig,
+		Domain:                *masterDomain,
+		ShutdownDelay:         *shutdownDelay,
+		ReloadEvery:           *reloadEvery,
+		ReloadRollup:          *reloadRollup,
+		AcceptableUpdateLag:   *acceptableUpdateLag,
+		Forwarder:             proxy.CreateForwarder(transport),
+		DisableWatch:          *disableWatch,
+		IgnoreNamespaces:      ignoreNamespacesMap,
+		CertFilePairMap:       certFilePairMap,
+		ClientCAFileMap:       clientCAFileMap,
+		CertNamespace:         *certNamespace,
+		WildcardCertPrefix:    *wildcardCertPrefix,
+		IngressClass:          *ingressClass,
+		GatewayControllerName: *gatewayController,
+		AffinityKey:           util.CreateAffinityKey(*affinitySecret),
+		EnableHttp2:           *enableHttp2,
+		EnableH2c:             *enableH2c,
+		BackendTLSSources:     *backendTLSSources,
 	}
 
+	config.HealthChecker = util.NewHealthChecker(&config.Counters, transport)
+
 	signals.RegisterSignals(&config)
 
 	// messages to these channels will trigger instant updates
@@ -154,5 +216,8 @@ func main() {
 	go proxy.StartAdminServer(&config)
 
 	// start main loop
-	backends.BackendManager(&config, backendsChan)
+	if err := backends.BackendManager(&config, backendsChan); err != nil {
+		log.Error("Couldn't start backendManager, exitting... err: " + err.Error())
+		os.Exit(1)
+	}
 }
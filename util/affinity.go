@@ -0,0 +1,116 @@
+package util
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/vulcand/oxy/roundrobin"
+	"github.com/vulcand/oxy/roundrobin/stickycookie"
+)
+
+// CreateAffinityKey derives the key used to sign affinity cookies from a shared secret, without a secret a random key
+// is used and cookies are only honoured by the instance that issued them
+func CreateAffinityKey(secret string) []byte {
+	if secret == "" {
+		key := make([]byte, sha256.Size)
+		if _, err := rand.Read(key); err != nil {
+			panic(err)
+		}
+		return key
+	}
+
+	key := sha256.Sum256([]byte(secret))
+	return key[:]
+}
+
+// StickySession pins the clients of a route to a backend with an affinity cookie, which is marked Secure when set on a
+// request over tls
+type StickySession struct {
+	name   string
+	plain  *roundrobin.StickySession
+	secure *roundrobin.StickySession
+}
+
+// StickySession creates the sticky session of the affinity of a route. The cookie holds the backend encrypted and
+// authenticated with the given key, so clients can neither read nor forge it, and it expires after the TTL. Every
+// route of a host has a cookie of its own, limited to the path of the route, so being pinned by one route does not
+// affect the others
+func (route *Route) StickySession(key []byte) (*StickySession, error) {
+	if route.Affinity == nil {
+		return nil, nil
+	}
+
+	value, err := stickycookie.NewAESValue(key, route.Affinity.TTL)
+	if err != nil {
+		return nil, err
+	}
+
+	name := route.cookieName()
+	options := roundrobin.CookieOptions{
+		HTTPOnly: true,
+		Path:     route.cookiePath(),
+		MaxAge:   int(route.Affinity.TTL.Seconds()),
+		SameSite: http.SameSiteLaxMode,
+	}
+	plain := roundrobin.NewStickySessionWithOptions(name, options).SetCookieValue(value)
+	options.Secure = true
+	secure := roundrobin.NewStickySessionWithOptions(name, options).SetCookieValue(value)
+
+	return &StickySession{name: name, plain: plain, secure: secure}, nil
+}
+
+// GetBackend returns the backend the request is pinned to, if it is one of the given servers
+func (s *StickySession) GetBackend(req *http.Request, servers []*url.URL) (*url.URL, bool, error) {
+	return s.plain.GetBackend(req, servers)
+}
+
+// StickBackend pins the client of the request to a backend
+func (s *StickySession) StickBackend(req *http.Request, backend *url.URL, w http.ResponseWriter) {
+	if req.TLS != nil {
+		s.secure.StickBackend(backend, w)
+	} else {
+		s.plain.StickBackend(backend, w)
+	}
+}
+
+// cookieName names the affinity cookie of a route. The route of the whole host uses the name of the affinity, the other
+// routes add a hash of their path and matches
+func (route *Route) cookieName() string {
+	if route.Path == "/" && route.PathType == PATH_TYPE_PREFIX && len(route.Matches) == 0 {
+		return route.Affinity.CookieName
+	}
+
+	key := strconv.Itoa(int(route.PathType)) + route.Path
+	for _, match := range route.Matches {
+		key += "\x00" + strconv.Itoa(int(match.Source)) + match.Name + "=" + match.Value
+	}
+	return fmt.Sprintf("%s-%08x", route.Affinity.CookieName, uint32(hashString(key)))
+}
+
+// cookiePath limits the affinity cookie to the requests matching the path of the route
+func (route *Route) cookiePath() string {
+	if path := strings.TrimSuffix(route.Path, "/"); path != "" {
+		return path
+	}
+	return "/"
+}
+
+// LostAffinity tells if the request is pinned to a backend which is no longer part of the route, and the affinity of
+// the route rejects such requests rather than rebalancing them. Invalid and expired cookies are always rebalanced
+func (route Route) LostAffinity(req *http.Request) bool {
+	if route.Affinity == nil || route.Affinity.Fallback != AFFINITY_FALLBACK_REJECT || route.Sticky == nil || route.Balancer == nil {
+		return false
+	}
+	if _, err := req.Cookie(route.Sticky.name); errors.Is(err, http.ErrNoCookie) {
+		return false
+	}
+
+	_, present, err := route.Sticky.GetBackend(req, route.Balancer.Servers())
+	return err == nil && !present
+}
@@ -0,0 +1,128 @@
+package util
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func createAffinityCookie(t *testing.T, route Route, req *http.Request, backend *url.URL) *http.Cookie {
+	w := httptest.NewRecorder()
+	route.Sticky.StickBackend(req, backend, w)
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("Expected an affinity cookie, got %v", cookies)
+	}
+	return cookies[0]
+}
+
+func createAffinityRoute(t *testing.T, affinity *Affinity, key []byte, backends ...Backend) Route {
+	route := Route{Path: "/", Affinity: affinity}
+	sticky, err := route.StickySession(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	route.Sticky, route.Balancer = sticky, CreateBalancer(nil, Balancing{}, backends, sticky)
+	return route
+}
+
+func TestAffinityCookie(t *testing.T) {
+	a, _ := url.Parse("http://10.0.0.1:8080")
+	b, _ := url.Parse("http://10.0.0.2:8080")
+	affinity := &Affinity{CookieName: "pin", TTL: time.Hour, Fallback: AFFINITY_FALLBACK_REJECT}
+	key := CreateAffinityKey("secret")
+
+	route := createAffinityRoute(t, affinity, key, Backend{Url: a}, Backend{Url: b})
+	cookie := createAffinityCookie(t, route, createRequest("/", http.Header{}), a)
+	if cookie.Name != "pin" || cookie.MaxAge != 3600 || !cookie.HttpOnly || cookie.Secure {
+		t.Errorf("Expected cookie with configured name and TTL, got %v", cookie)
+	}
+	if cookie.Value == a.String() {
+		t.Error("Expected backend not to be readable from the cookie")
+	}
+
+	req := createRequest("/", http.Header{})
+	req.AddCookie(cookie)
+	if backend, present, err := route.Sticky.GetBackend(req, route.Balancer.Servers()); err != nil || !present || backend.String() != a.String() {
+		t.Errorf("Expected cookie to pin the backend, got %v", backend)
+	}
+	if route.LostAffinity(req) {
+		t.Error("Expected affinity to be kept while the backend is available")
+	}
+
+	other := createAffinityRoute(t, affinity, CreateAffinityKey("other"), Backend{Url: a}, Backend{Url: b})
+	if _, present, _ := other.Sticky.GetBackend(req, other.Balancer.Servers()); present || other.LostAffinity(req) {
+		t.Error("Expected cookie signed with another key to be rebalanced")
+	}
+
+	gone := createAffinityRoute(t, affinity, key, Backend{Url: b})
+	if !gone.LostAffinity(req) {
+		t.Error("Expected request pinned to a removed backend to be rejected")
+	}
+
+	rebalance := createAffinityRoute(t, &Affinity{CookieName: "pin", TTL: time.Hour}, key, Backend{Url: b})
+	if rebalance.LostAffinity(req) {
+		t.Error("Expected request pinned to a removed backend to be rebalanced by default")
+	}
+
+	if createAffinityRoute(t, affinity, key, Backend{Url: b}).LostAffinity(createRequest("/", http.Header{})) {
+		t.Error("Expected request without cookie to be balanced")
+	}
+}
+
+func TestAffinityCookiePerRoute(t *testing.T) {
+	a, _ := url.Parse("http://10.0.0.1:8080")
+	affinity := &Affinity{CookieName: "pin", TTL: time.Hour, Fallback: AFFINITY_FALLBACK_REJECT}
+	key := CreateAffinityKey("secret")
+	root := createAffinityRoute(t, affinity, key, Backend{Url: a})
+
+	api := Route{Path: "/api/", PathType: PATH_TYPE_PREFIX, Affinity: affinity}
+	sticky, err := api.StickySession(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.Sticky, api.Balancer = sticky, CreateBalancer(nil, Balancing{}, []Backend{{Url: a}}, sticky)
+
+	req := createRequest("/api/users", http.Header{})
+	req.TLS = &tls.ConnectionState{}
+	cookie := createAffinityCookie(t, api, req, a)
+	if cookie.Name == "pin" || cookie.Path != "/api" || !cookie.Secure {
+		t.Errorf("Expected secure cookie of its own limited to the path of the route, got %v", cookie)
+	}
+
+	// a client pinned by another route is balanced by the route of the whole host
+	req = createRequest("/", http.Header{})
+	req.AddCookie(cookie)
+	if root.LostAffinity(req) {
+		t.Error("Expected cookie of another route to be ignored")
+	}
+}
+
+func TestAffinityRoundRobin(t *testing.T) {
+	a, _ := url.Parse("http://10.0.0.1:8080")
+	b, _ := url.Parse("http://10.0.0.2:8080")
+	route := Route{Path: "/", Affinity: &Affinity{CookieName: "pin", TTL: time.Hour}}
+	sticky, _ := route.StickySession(CreateAffinityKey("secret"))
+	hits := make(map[string]int)
+	balancer := CreateBalancer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		hits[req.URL.Host]++
+	}), Balancing{}, []Backend{{Url: a}, {Url: b}}, sticky)
+
+	w := httptest.NewRecorder()
+	balancer.ServeHTTP(w, createRequest("/", http.Header{}))
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("Expected round robin to pin the client, got %v", cookies)
+	}
+	for n := 0; n < 4; n++ {
+		req := createRequest("/", http.Header{})
+		req.AddCookie(cookies[0])
+		balancer.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	if len(hits) != 1 {
+		t.Errorf("Expected pinned requests to go to the same backend, got %v", hits)
+	}
+}
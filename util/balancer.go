@@ -0,0 +1,451 @@
+package util
+
+import (
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/vulcand/oxy/roundrobin"
+)
+
+const (
+	// decay time of the latency average of peak EWMA, the average follows the recent latency of a backend while
+	// latency spikes are picked up immediately
+	EWMA_DECAY = 10 * time.Second
+	// cost of a backend with requests in flight but no measured latency yet, so it is not flooded with requests
+	EWMA_PENALTY = float64(time.Second)
+	// number of points on the hash ring for a backend with the highest weight of the route
+	HASH_REPLICAS = 100
+)
+
+// Balancer distributes the requests of a route over its backends
+type Balancer interface {
+	http.Handler
+	Servers() []*url.URL
+	UpsertServer(backend Backend) error
+	RemoveServer(u *url.URL) error
+}
+
+// CreateBalancer creates a balancer of the given algorithm for the backends, requests are passed on to next
+func CreateBalancer(next http.Handler, balancing Balancing, backends []Backend, sticky *StickySession) Balancer {
+	var algorithm algorithm
+	switch balancing.Algorithm {
+	case BALANCER_WEIGHTED_ROUND_ROBIN:
+		algorithm = weightedRoundRobin{}
+	case BALANCER_LEAST_REQUEST:
+		algorithm = leastRequest{}
+	case BALANCER_PEAK_EWMA:
+		algorithm = peakEWMA{}
+	case BALANCER_HASH:
+		algorithm = &consistentHash{key: balancing.HashKey, name: balancing.HashKeyName}
+	default:
+		return roundRobinBalancer{RoundRobin: CreateRR(recordAttempt(next), backends), sticky: sticky}
+	}
+
+	b := &balancer{
+		next:      recordAttempt(next),
+		sticky:    sticky,
+		algorithm: algorithm,
+		endpoints: make([]*endpoint, 0, len(backends)),
+	}
+	for _, backend := range backends {
+		b.UpsertServer(backend)
+	}
+
+	return b
+}
+
+// appliedBackends are the backends a balancer was last updated with, shared by the routes of every routing table built
+// with the balancer
+type appliedBackends struct {
+	backends []Backend
+}
+
+// SetBalancer sets a new balancer of the route, created with the backends of the route
+func (route *Route) SetBalancer(balancer Balancer) {
+	route.Balancer = balancer
+	route.applied = &appliedBackends{backends: route.Backends}
+}
+
+// KeepBalancer takes over the balancer of a route of a previous routing table. The balancer is left untouched until
+// the route is published, so building a routing table which is never published does not change the live balancers
+func (route *Route) KeepBalancer(previous *Route) {
+	route.Sticky, route.Balancer, route.applied = previous.Sticky, previous.Balancer, previous.applied
+}
+
+// UpdateBalancer updates the servers of a balancer in place, from the backends it was last updated with to the given
+// backends. Servers with an unchanged weight are left untouched to keep their state
+func UpdateBalancer(balancer Balancer, previous []Backend, backends []Backend) {
+	weights := make(map[string]int)
+	for _, backend := range previous {
+		weights[backend.Url.String()] = backend.Weight
+	}
+
+	current := make(map[string]bool)
+	for _, backend := range backends {
+		current[backend.Url.String()] = true
+		if weight, exists := weights[backend.Url.String()]; !exists || weight != backend.Weight {
+			balancer.UpsertServer(backend)
+		}
+	}
+
+	for _, backend := range previous {
+		if !current[backend.Url.String()] {
+			balancer.RemoveServer(backend.Url)
+		}
+	}
+}
+
+// roundRobinBalancer adapts the oxy round robin to the balancer interface. Clients pinned by an affinity cookie bypass
+// the rotation
+type roundRobinBalancer struct {
+	*roundrobin.RoundRobin
+	sticky *StickySession
+}
+
+// ServeHTTP lets retried requests skip the servers already tried, the next servers of the rotation are taken until an
+// untried one comes up
+func (b roundRobinBalancer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	state, ok := req.Context().Value(attemptKey{}).(*attempt)
+	retried := ok && len(state.tried) > 0
+	if b.sticky != nil && !retried {
+		if u, present, _ := b.sticky.GetBackend(req, b.RoundRobin.Servers()); present {
+			b.forward(w, req, u)
+			return
+		}
+	}
+
+	for range b.RoundRobin.Servers() {
+		u, err := b.RoundRobin.NextServer()
+		if err != nil {
+			break
+		}
+		if !retried || !containsURL(state.tried, u) {
+			if b.sticky != nil {
+				b.sticky.StickBackend(req, u, w)
+			}
+			b.forward(w, req, u)
+			return
+		}
+	}
+	b.RoundRobin.ServeHTTP(w, req)
+}
+
+// forward passes a request on to a server, on a shallow copy of the request like the oxy round robin
+func (b roundRobinBalancer) forward(w http.ResponseWriter, req *http.Request, u *url.URL) {
+	newReq := *req
+	newReq.URL = u
+	b.RoundRobin.Next().ServeHTTP(w, &newReq)
+}
+
+// UpsertServer sets the weight explicitly, as the round robin keeps the weight of a known server when none is given
+func (b roundRobinBalancer) UpsertServer(backend Backend) error {
+	weight := backend.Weight
+	if weight <= 0 {
+		weight = 1
+	}
+	return b.RoundRobin.UpsertServer(backend.Url, roundrobin.Weight(weight))
+}
+
+type endpoint struct {
+	url      *url.URL
+	weight   float64
+	inflight int
+	ewma     float64
+	measured time.Time
+	current  float64
+}
+
+// algorithm picks the endpoint of a request, it is called with the lock of the balancer held
+type algorithm interface {
+	pick(req *http.Request, endpoints []*endpoint) *endpoint
+	update(endpoints []*endpoint)
+}
+
+// balancer keeps track of requests in flight and their latency for each endpoint, and lets an algorithm pick the
+// endpoint of each request. Clients pinned by an affinity cookie bypass the algorithm
+type balancer struct {
+	next      http.Handler
+	sticky    *StickySession
+	algorithm algorithm
+
+	mutex     sync.Mutex
+	endpoints []*endpoint
+}
+
+func (b *balancer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	e := b.acquire(w, req)
+	if e == nil {
+		status := http.StatusServiceUnavailable
+		Error(w, req, http.StatusText(status), status)
+		return
+	}
+
+	start := time.Now()
+	defer func() {
+		b.release(e, time.Since(start))
+	}()
+
+	// make shallow copy of request before changing anything, like the oxy round robin
+	newReq := *req
+	newReq.URL = e.url
+	b.next.ServeHTTP(w, &newReq)
+}
+
+func (b *balancer) acquire(w http.ResponseWriter, req *http.Request) *endpoint {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if len(b.endpoints) == 0 {
+		return nil
+	}
+
+	var e *endpoint
+	candidates := excludeTried(req, b.endpoints)
+	if b.sticky != nil && len(candidates) == len(b.endpoints) {
+		if u, present, _ := b.sticky.GetBackend(req, b.servers()); present {
+			e = b.find(u)
+		}
+	}
+	if e == nil {
+		if len(candidates) < len(b.endpoints) {
+			// retries go to the least loaded of the backends not tried yet
+			e = leastRequest{}.pick(req, candidates)
+		} else {
+			e = b.algorithm.pick(req, b.endpoints)
+		}
+		if b.sticky != nil {
+			b.sticky.StickBackend(req, e.url, w)
+		}
+	}
+
+	e.inflight++
+	return e
+}
+
+func (b *balancer) release(e *endpoint, latency time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	e.inflight--
+	e.observe(latency, time.Now())
+}
+
+func (b *balancer) Servers() []*url.URL {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.servers()
+}
+
+func (b *balancer) servers() []*url.URL {
+	out := make([]*url.URL, len(b.endpoints))
+	for n, e := range b.endpoints {
+		out[n] = e.url
+	}
+	return out
+}
+
+func (b *balancer) UpsertServer(backend Backend) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	weight := float64(backend.Weight)
+	if backend.Weight <= 0 {
+		weight = 1
+	}
+	if e := b.find(backend.Url); e != nil {
+		e.weight = weight
+	} else {
+		b.endpoints = append(b.endpoints, &endpoint{url: backend.Url, weight: weight})
+	}
+	b.algorithm.update(b.endpoints)
+
+	return nil
+}
+
+func (b *balancer) RemoveServer(u *url.URL) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for n, e := range b.endpoints {
+		if sameURL(e.url, u) {
+			b.endpoints = append(b.endpoints[:n:n], b.endpoints[n+1:]...)
+			b.algorithm.update(b.endpoints)
+			break
+		}
+	}
+
+	return nil
+}
+
+func (b *balancer) find(u *url.URL) *endpoint {
+	for _, e := range b.endpoints {
+		if sameURL(e.url, u) {
+			return e
+		}
+	}
+	return nil
+}
+
+func sameURL(a *url.URL, b *url.URL) bool {
+	return a.Scheme == b.Scheme && a.Host == b.Host && a.Path == b.Path
+}
+
+// observe updates the latency average, which decays with the time passed since the last measurement. A latency above
+// the average replaces it right away
+func (e *endpoint) observe(latency time.Duration, now time.Time) {
+	rtt := float64(latency)
+	if rtt > e.ewma || e.measured.IsZero() {
+		e.ewma = rtt
+	} else {
+		w := math.Exp(-float64(now.Sub(e.measured)) / float64(EWMA_DECAY))
+		e.ewma = e.ewma*w + rtt*(1-w)
+	}
+	e.measured = now
+}
+
+// weightedRoundRobin interleaves the endpoints in proportion to their weights, the smooth weighted round robin of
+// nginx. Unlike the oxy round robin, endpoints with a low weight are not held back until the end of a cycle, and
+// changing the endpoints does not start the cycle over
+type weightedRoundRobin struct{}
+
+func (weightedRoundRobin) pick(req *http.Request, endpoints []*endpoint) *endpoint {
+	total := 0.0
+	var best *endpoint
+	for _, e := range endpoints {
+		e.current += e.weight
+		total += e.weight
+		if best == nil || e.current > best.current {
+			best = e
+		}
+	}
+	best.current -= total
+	return best
+}
+
+func (weightedRoundRobin) update(endpoints []*endpoint) {}
+
+// leastRequest picks the endpoint with the fewest requests in flight relative to its weight, ties are broken by
+// starting the scan at a random endpoint
+type leastRequest struct{}
+
+func (leastRequest) pick(req *http.Request, endpoints []*endpoint) *endpoint {
+	return pickLowest(endpoints, func(e *endpoint) float64 {
+		return float64(e.inflight+1) / e.weight
+	})
+}
+
+func (leastRequest) update(endpoints []*endpoint) {}
+
+// peakEWMA picks the endpoint with the lowest expected latency, estimated from its latency average and the number of
+// requests in flight
+type peakEWMA struct{}
+
+func (peakEWMA) pick(req *http.Request, endpoints []*endpoint) *endpoint {
+	return pickLowest(endpoints, func(e *endpoint) float64 {
+		if e.measured.IsZero() && e.inflight > 0 {
+			return (EWMA_PENALTY + float64(e.inflight)) / e.weight
+		}
+		return e.ewma * float64(e.inflight+1) / e.weight
+	})
+}
+
+func (peakEWMA) update(endpoints []*endpoint) {}
+
+func pickLowest(endpoints []*endpoint, cost func(e *endpoint) float64) *endpoint {
+	offset := rand.Intn(len(endpoints))
+	var best *endpoint
+	bestCost := math.Inf(1)
+	for n := range endpoints {
+		e := endpoints[(n+offset)%len(endpoints)]
+		if c := cost(e); c < bestCost {
+			best, bestCost = e, c
+		}
+	}
+	return best
+}
+
+type ringPoint struct {
+	hash     uint64
+	endpoint *endpoint
+}
+
+// consistentHash maps a key of the request onto a ring of endpoints, so requests with the same key go to the same
+// endpoint and only the keys of an added or removed endpoint move. Requests without the key are spread randomly
+type consistentHash struct {
+	key  uint16
+	name string
+	ring []ringPoint
+}
+
+func (h *consistentHash) pick(req *http.Request, endpoints []*endpoint) *endpoint {
+	key, present := h.requestKey(req)
+	if !present || len(h.ring) == 0 {
+		return endpoints[rand.Intn(len(endpoints))]
+	}
+
+	hash := hashString(key)
+	n := sort.Search(len(h.ring), func(i int) bool { return h.ring[i].hash >= hash })
+	if n == len(h.ring) {
+		n = 0
+	}
+	return h.ring[n].endpoint
+}
+
+func (h *consistentHash) update(endpoints []*endpoint) {
+	maxWeight := 0.0
+	for _, e := range endpoints {
+		maxWeight = math.Max(maxWeight, e.weight)
+	}
+
+	ring := make([]ringPoint, 0, len(endpoints)*HASH_REPLICAS)
+	for _, e := range endpoints {
+		replicas := int(math.Max(1, math.Round(HASH_REPLICAS*e.weight/maxWeight)))
+		for n := 0; n < replicas; n++ {
+			ring = append(ring, ringPoint{hash: hashString(e.url.Host + "-" + strconv.Itoa(n)), endpoint: e})
+		}
+	}
+	sort.Slice(ring, func(a, b int) bool { return ring[a].hash < ring[b].hash })
+	h.ring = ring
+}
+
+func (h *consistentHash) requestKey(req *http.Request) (string, bool) {
+	switch h.key {
+	case HASH_KEY_CLIENT_IP:
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			return req.RemoteAddr, req.RemoteAddr != ""
+		}
+		return host, true
+	case HASH_KEY_HEADER:
+		value := req.Header.Get(h.name)
+		return value, value != ""
+	case HASH_KEY_COOKIE:
+		cookie, err := req.Cookie(h.name)
+		if err != nil {
+			return "", false
+		}
+		return cookie.Value, true
+	case HASH_KEY_PATH:
+		return req.URL.Path, true
+	}
+	return "", false
+}
+
+// hashString is a stable hash, so all instances map keys to the same endpoints
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	// fnv spreads similar strings poorly, finish with the mixer of splitmix64
+	x := h.Sum64()
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
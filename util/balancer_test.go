@@ -0,0 +1,157 @@
+package util
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func createEndpoints(weights ...int) []*endpoint {
+	endpoints := make([]*endpoint, 0)
+	for n, w := range weights {
+		u, _ := url.Parse(fmt.Sprintf("http://10.0.0.%d:8080", n+1))
+		endpoints = append(endpoints, &endpoint{url: u, weight: float64(w)})
+	}
+	return endpoints
+}
+
+func TestLeastRequest(t *testing.T) {
+	endpoints := createEndpoints(1, 1, 2)
+	endpoints[0].inflight = 3
+	endpoints[1].inflight = 1
+	endpoints[2].inflight = 2
+
+	// the third endpoint has the capacity of two, so (2+1)/2 is less than (1+1)/1
+	if e := (leastRequest{}).pick(nil, endpoints); e != endpoints[2] {
+		t.Errorf("Expected endpoint with fewest requests relative to its weight, got %v", e.url)
+	}
+}
+
+func TestWeightedRoundRobin(t *testing.T) {
+	endpoints := createEndpoints(3, 1)
+	picks := make([]*endpoint, 0)
+	for n := 0; n < 4; n++ {
+		picks = append(picks, weightedRoundRobin{}.pick(nil, endpoints))
+	}
+	if picks[0] != endpoints[0] || picks[2] != endpoints[1] || picks[1] != endpoints[0] || picks[3] != endpoints[0] {
+		t.Errorf("Expected the light endpoint once in the middle of a cycle of four, got %v", picks)
+	}
+
+	// an added endpoint joins the rotation without starting the cycle over
+	endpoints = append(endpoints, createEndpoints(1, 1, 1)[2])
+	counts := make(map[*endpoint]int)
+	for n := 0; n < 5; n++ {
+		counts[weightedRoundRobin{}.pick(nil, endpoints)]++
+	}
+	if counts[endpoints[0]] != 3 || counts[endpoints[1]] != 1 || counts[endpoints[2]] != 1 {
+		t.Errorf("Expected requests in proportion to the weights, got %v", counts)
+	}
+}
+
+func TestPeakEWMA(t *testing.T) {
+	now := time.Now()
+	endpoints := createEndpoints(1, 1)
+	endpoints[0].observe(100*time.Millisecond, now)
+	endpoints[1].observe(10*time.Millisecond, now)
+
+	if e := (peakEWMA{}).pick(nil, endpoints); e != endpoints[1] {
+		t.Errorf("Expected endpoint with the lowest latency, got %v", e.url)
+	}
+
+	endpoints[1].observe(500*time.Millisecond, now.Add(time.Second))
+	if endpoints[1].ewma != float64(500*time.Millisecond) {
+		t.Errorf("Expected latency peak to replace the average, got %v", time.Duration(endpoints[1].ewma))
+	}
+	if e := (peakEWMA{}).pick(nil, endpoints); e != endpoints[0] {
+		t.Errorf("Expected the slow endpoint to be avoided, got %v", e.url)
+	}
+
+	endpoints[1].observe(10*time.Millisecond, now.Add(time.Minute))
+	if endpoints[1].ewma > float64(20*time.Millisecond) {
+		t.Errorf("Expected latency average to decay, got %v", time.Duration(endpoints[1].ewma))
+	}
+}
+
+func TestConsistentHash(t *testing.T) {
+	endpoints := createEndpoints(1, 1, 1, 1)
+	hash := &consistentHash{key: HASH_KEY_HEADER, name: "X-User"}
+	hash.update(endpoints)
+
+	picked := make(map[string]*endpoint)
+	for n := 0; n < 100; n++ {
+		user := fmt.Sprintf("user-%d", n)
+		picked[user] = hash.pick(createRequest("/", http.Header{"X-User": {user}}), endpoints)
+		if again := hash.pick(createRequest("/", http.Header{"X-User": {user}}), endpoints); again != picked[user] {
+			t.Fatalf("Expected the same key to pick the same endpoint, got %v and %v", picked[user].url, again.url)
+		}
+	}
+
+	hash.update(endpoints[:3])
+	for user, e := range picked {
+		if e == endpoints[3] {
+			continue
+		}
+		if again := hash.pick(createRequest("/", http.Header{"X-User": {user}}), endpoints[:3]); again != e {
+			t.Errorf("Expected key of a remaining endpoint to stay, %s moved from %v to %v", user, e.url, again.url)
+		}
+	}
+}
+
+func TestBalancerTracksRequests(t *testing.T) {
+	var b *balancer
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if e := b.find(req.URL); e == nil || e.inflight != 1 {
+			t.Errorf("Expected request to be in flight on %v", req.URL)
+		}
+	})
+	b = &balancer{next: next, algorithm: leastRequest{}}
+	u, _ := url.Parse("http://10.0.0.1:8080")
+	b.UpsertServer(Backend{Url: u})
+
+	b.ServeHTTP(httptest.NewRecorder(), createRequest("/", http.Header{}))
+	if e := b.find(u); e.inflight != 0 || e.measured.IsZero() {
+		t.Errorf("Expected request to be released and measured, got %v", e)
+	}
+
+	b.RemoveServer(u)
+	w := httptest.NewRecorder()
+	b.ServeHTTP(w, createRequest("/", http.Header{}))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected balancer without servers to respond 503, got %d", w.Code)
+	}
+}
+
+func TestUpdateBalancer(t *testing.T) {
+	a, _ := url.Parse("http://10.0.0.1:8080")
+	b, _ := url.Parse("http://10.0.0.2:8080")
+	c, _ := url.Parse("http://10.0.0.3:8080")
+	previous := []Backend{{Url: a}, {Url: b}}
+
+	for _, balancing := range []Balancing{{Algorithm: BALANCER_ROUND_ROBIN}, {Algorithm: BALANCER_LEAST_REQUEST}} {
+		lb := CreateBalancer(nil, balancing, append([]Backend{}, previous...), nil)
+		if b, ok := lb.(*balancer); ok {
+			b.find(a).inflight = 5
+		}
+
+		UpdateBalancer(lb, previous, []Backend{{Url: a}, {Url: c, Weight: 2}})
+
+		servers := make(map[string]bool)
+		for _, u := range lb.Servers() {
+			servers[u.String()] = true
+		}
+		if len(servers) != 2 || !servers[a.String()] || !servers[c.String()] {
+			t.Errorf("Expected removed backend to be dropped and new backend to be added, got %v", servers)
+		}
+		if b, ok := lb.(*balancer); ok && b.find(a).inflight != 5 {
+			t.Error("Expected state of unchanged backend to be kept")
+		}
+		if rr, ok := lb.(roundRobinBalancer); ok {
+			if weight, _ := rr.ServerWeight(c); weight != 2 {
+				t.Errorf("Expected weight of new backend to be set, got %d", weight)
+			}
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package util
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dbcdk/shelob/logging"
+	"github.com/vulcand/oxy/utils"
+	"go.uber.org/zap"
+)
+
+const (
+	BREAKER_STATE_CLOSED = iota
+	BREAKER_STATE_HALF_OPEN
+	BREAKER_STATE_OPEN
+)
+
+// BreakBalancer wraps the balancer of a route with a circuit breaker. The breaker opens when the error ratio or the
+// average latency of the route exceeds its thresholds, and then answers requests with the fallback instead of
+// queuing them on the backends. After the open time a few probe requests are let through, and the breaker closes
+// again when they succeed. The state of the breaker is exported by domain, path and request matches of the route
+func BreakBalancer(balancer Balancer, route *Route, domain string, counters *Counters) Balancer {
+	b := &breakerBalancer{
+		Balancer: balancer,
+		breaker:  *route.CircuitBreaker,
+		domain:   domain,
+		path:     route.Path,
+		match:    route.matchKey(),
+		counters: counters,
+	}
+	b.setState(BREAKER_STATE_CLOSED, time.Now())
+	return b
+}
+
+type breakerBalancer struct {
+	Balancer
+	breaker  CircuitBreaker
+	domain   string
+	path     string
+	match    string
+	counters *Counters
+
+	mutex     sync.Mutex
+	dropped   bool
+	state     int
+	since     time.Time
+	requests  int
+	errors    int
+	latency   time.Duration
+	probes    int
+	successes int
+}
+
+func (b *breakerBalancer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	allowed, probe := b.allow(time.Now())
+	if !allowed {
+		b.fallback(w, req)
+		return
+	}
+
+	start := time.Now()
+	pw := utils.NewProxyWriter(w)
+	b.Balancer.ServeHTTP(pw, req)
+	b.record(probe, pw.StatusCode() >= http.StatusInternalServerError, time.Since(start), time.Now())
+}
+
+// allow tells if a request may be passed on to the backends, and if it is a probe of a half-open breaker
+func (b *breakerBalancer) allow(now time.Time) (bool, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.state {
+	case BREAKER_STATE_OPEN:
+		if now.Sub(b.since) < b.breaker.OpenTime {
+			return false, false
+		}
+		b.setState(BREAKER_STATE_HALF_OPEN, now)
+		fallthrough
+	case BREAKER_STATE_HALF_OPEN:
+		if b.probes >= b.breaker.Probes {
+			return false, false
+		}
+		b.probes++
+		return true, true
+	}
+	return true, false
+}
+
+// record adds the outcome of a request to the current window of a closed breaker, or decides the state of a
+// half-open breaker from the outcome of a probe
+func (b *breakerBalancer) record(probe bool, failed bool, latency time.Duration, now time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	slow := b.breaker.Latency > 0 && latency > b.breaker.Latency
+	if probe {
+		if b.state != BREAKER_STATE_HALF_OPEN {
+			return
+		}
+		if failed || slow {
+			b.open(now, "probe failed")
+			return
+		}
+		b.successes++
+		if b.successes >= b.breaker.Probes {
+			logging.GetInstance().Info("Circuit breaker closed, backends are responding again",
+				zap.String("event", "circuitBreakerClosed"),
+				zap.String("domain", b.domain),
+				zap.String("path", b.path),
+				zap.String("match", b.match),
+			)
+			b.setState(BREAKER_STATE_CLOSED, now)
+		}
+		return
+	}
+
+	if b.state != BREAKER_STATE_CLOSED {
+		return
+	}
+	if now.Sub(b.since) >= b.breaker.Window {
+		b.since, b.requests, b.errors, b.latency = now, 0, 0, 0
+	}
+	b.requests++
+	b.latency += latency
+	if failed {
+		b.errors++
+	}
+	if b.requests < b.breaker.MinRequests {
+		return
+	}
+
+	if b.breaker.ErrorPercent > 0 && b.errors*100 >= b.requests*b.breaker.ErrorPercent {
+		b.open(now, "error ratio "+strconv.Itoa(b.errors*100/b.requests)+"%")
+	} else if b.breaker.Latency > 0 && b.latency/time.Duration(b.requests) > b.breaker.Latency {
+		b.open(now, "average latency "+(b.latency/time.Duration(b.requests)).String())
+	}
+}
+
+func (b *breakerBalancer) open(now time.Time, reason string) {
+	logging.GetInstance().Warn("Circuit breaker opened, serving fallback instead of backends",
+		zap.String("event", "circuitBreakerOpen"),
+		zap.String("domain", b.domain),
+		zap.String("path", b.path),
+		zap.String("match", b.match),
+		zap.String("reason", reason),
+		zap.Duration("openTime", b.breaker.OpenTime),
+	)
+	b.setState(BREAKER_STATE_OPEN, now)
+}
+
+// setState moves the breaker into a state and starts over counting requests and probes, it is called with the lock
+// held
+func (b *breakerBalancer) setState(state int, now time.Time) {
+	b.state, b.since = state, now
+	b.requests, b.errors, b.latency = 0, 0, 0
+	b.probes, b.successes = 0, 0
+	if !b.dropped {
+		b.counters.BreakerState.WithLabelValues(b.domain, b.path, b.match).Set(float64(state))
+	}
+}
+
+// report exports the state of a breaker of the published routing table, possibly overwritten by a breaker of the same
+// route which has been dropped
+func (b *breakerBalancer) report() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.dropped = false
+	b.counters.BreakerState.WithLabelValues(b.domain, b.path, b.match).Set(float64(b.state))
+}
+
+// drop stops exporting the state of a breaker no longer in the routing table, requests still in flight may change its
+// state
+func (b *breakerBalancer) drop() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.dropped = true
+	b.counters.BreakerState.DeleteLabelValues(b.domain, b.path, b.match)
+}
+
+// dropBreakers removes the state of the circuit breakers of the previous routing table which are not in the published
+// table from the metrics, so removed routes do not leave stale states behind
+func dropBreakers(previous *RoutingTable, table *RoutingTable) {
+	kept := breakers(table)
+	for b := range breakers(previous) {
+		if !kept[b] {
+			b.drop()
+		}
+	}
+	for b := range kept {
+		b.report()
+	}
+}
+
+func breakers(table *RoutingTable) map[*breakerBalancer]bool {
+	out := make(map[*breakerBalancer]bool)
+	for _, frontend := range table.Frontends {
+		for _, route := range frontend.Routes {
+			if b, ok := route.Balancer.(*breakerBalancer); ok {
+				out[b] = true
+			}
+		}
+	}
+	return out
+}
+
+func (b *breakerBalancer) fallback(w http.ResponseWriter, req *http.Request) {
+	fallback := b.breaker.Fallback
+	if fallback != nil && fallback.Action == BACKEND_ACTION_REDIRECT {
+		url := *fallback.Url
+		if url.Path == "" {
+			url.Path = req.RequestURI
+		}
+		http.Redirect(w, req, url.String(), int(fallback.Code))
+		return
+	}
+
+	b.mutex.Lock()
+	retryAfter := b.breaker.OpenTime - time.Since(b.since)
+	b.mutex.Unlock()
+	w.Header().Set("Retry-After", strconv.Itoa(RetryAfter(retryAfter)))
+
+	status, responseText := http.StatusServiceUnavailable, ""
+	if fallback != nil {
+		status, responseText = int(fallback.Code), fallback.ResponseText
+	}
+	if responseText == "" {
+		responseText = http.StatusText(status)
+	}
+	Error(w, req, responseText, status)
+}
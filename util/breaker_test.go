@@ -0,0 +1,137 @@
+package util
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	a, _ := url.Parse("http://10.0.0.1:8080")
+	failing := true
+	calls := 0
+	backends := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		if failing {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+
+	counters := CreateCounters()
+	breaker := CircuitBreaker{ErrorPercent: 50, MinRequests: 4, Window: time.Minute, OpenTime: 50 * time.Millisecond, Probes: 2}
+	balancer := BreakBalancer(CreateBalancer(backends, Balancing{}, []Backend{{Url: a}}, nil), &Route{Path: "/", CircuitBreaker: &breaker}, "app.example.com", &counters)
+	state := counters.BreakerState.WithLabelValues("app.example.com", "/", "")
+
+	for n := 0; n < 10; n++ {
+		balancer.ServeHTTP(httptest.NewRecorder(), createRequest("/", http.Header{}))
+	}
+	if calls != 4 {
+		t.Errorf("Expected breaker to open after the minimum number of requests, got %d calls", calls)
+	}
+	if s := testutil.ToFloat64(state); s != BREAKER_STATE_OPEN {
+		t.Errorf("Expected open state in metrics, got %v", s)
+	}
+	w := httptest.NewRecorder()
+	balancer.ServeHTTP(w, createRequest("/", http.Header{}))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("Expected fast 503 with Retry-After while open, got %d %v", w.Code, w.Header())
+	}
+
+	<-time.After(60 * time.Millisecond)
+	balancer.ServeHTTP(httptest.NewRecorder(), createRequest("/", http.Header{}))
+	if calls != 5 || testutil.ToFloat64(state) != BREAKER_STATE_OPEN {
+		t.Errorf("Expected failed probe to open the breaker again, got %d calls", calls)
+	}
+
+	failing = false
+	<-time.After(60 * time.Millisecond)
+	for n := 0; n < 2; n++ {
+		balancer.ServeHTTP(httptest.NewRecorder(), createRequest("/", http.Header{}))
+	}
+	if s := testutil.ToFloat64(state); s != BREAKER_STATE_CLOSED {
+		t.Errorf("Expected successful probes to close the breaker, got state %v", s)
+	}
+	for n := 0; n < 10; n++ {
+		balancer.ServeHTTP(httptest.NewRecorder(), createRequest("/", http.Header{}))
+	}
+	if calls != 17 {
+		t.Errorf("Expected all requests to be passed on when closed, got %d calls", calls)
+	}
+}
+
+func TestCircuitBreakerLatency(t *testing.T) {
+	counters := CreateCounters()
+	breaker := CircuitBreaker{Latency: time.Second, MinRequests: 2, Window: time.Minute, OpenTime: time.Minute, Probes: 1}
+	b := BreakBalancer(nil, &Route{Path: "/", CircuitBreaker: &breaker}, "app.example.com", &counters).(*breakerBalancer)
+
+	now := time.Now()
+	b.record(false, false, 500*time.Millisecond, now)
+	b.record(false, false, time.Second, now)
+	if b.state != BREAKER_STATE_CLOSED {
+		t.Error("Expected breaker to stay closed below the latency threshold")
+	}
+	b.record(false, false, 3*time.Second, now)
+	if b.state != BREAKER_STATE_OPEN {
+		t.Error("Expected breaker to open above the latency threshold")
+	}
+}
+
+func TestCircuitBreakerFallback(t *testing.T) {
+	counters := CreateCounters()
+	fallback, _ := url.Parse("https://status.example.com")
+	breaker := CircuitBreaker{OpenTime: time.Minute, Fallback: &Intercept{Url: fallback, Code: http.StatusTemporaryRedirect, Action: BACKEND_ACTION_REDIRECT}}
+	b := BreakBalancer(nil, &Route{Path: "/", CircuitBreaker: &breaker}, "app.example.com", &counters).(*breakerBalancer)
+	b.open(time.Now(), "testing")
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/shop", nil)
+	b.ServeHTTP(w, req)
+	if w.Code != http.StatusTemporaryRedirect || w.Header().Get("Location") != "https://status.example.com/shop" {
+		t.Errorf("Expected redirect to fallback, got %d %v", w.Code, w.Header())
+	}
+}
+
+func TestDropBreakers(t *testing.T) {
+	counters := CreateCounters()
+	config := &Config{Counters: counters}
+	breaker := CircuitBreaker{ErrorPercent: 50, MinRequests: 1, Window: time.Minute, OpenTime: time.Minute, Probes: 1}
+	old := BreakBalancer(nil, &Route{Path: "/", CircuitBreaker: &breaker}, "app.example.com", &counters).(*breakerBalancer)
+	removed := BreakBalancer(nil, &Route{Path: "/old", CircuitBreaker: &breaker}, "app.example.com", &counters)
+	config.PublishFrontends(map[string]*Frontend{"app.example.com": {Routes: []*Route{{Path: "/", Balancer: old}, {Path: "/old", Balancer: removed}}}})
+
+	replaced := BreakBalancer(nil, &Route{Path: "/", CircuitBreaker: &breaker}, "app.example.com", &counters)
+	config.PublishFrontends(map[string]*Frontend{"app.example.com": {Routes: []*Route{{Path: "/", Balancer: replaced}}}})
+	if series := testutil.CollectAndCount(counters.BreakerState); series != 1 {
+		t.Errorf("Expected state of the removed route to be dropped, got %d series", series)
+	}
+
+	// requests in flight on the replaced breaker do not change the state of the route
+	old.record(false, true, 0, time.Now())
+	if s := testutil.ToFloat64(counters.BreakerState.WithLabelValues("app.example.com", "/", "")); s != BREAKER_STATE_CLOSED {
+		t.Errorf("Expected state of the breaker in use, got %v", s)
+	}
+}
+
+func TestCircuitBreakerStatePerRoute(t *testing.T) {
+	counters := CreateCounters()
+	breaker := CircuitBreaker{ErrorPercent: 50, MinRequests: 1, Window: time.Minute, OpenTime: time.Minute, Probes: 1}
+	canary := &Route{
+		Path:           "/",
+		Matches:        []RequestMatch{{Source: MATCH_SOURCE_HEADER, Name: "X-Canary", Value: "always"}},
+		CircuitBreaker: &breaker,
+	}
+	BreakBalancer(nil, &Route{Path: "/", CircuitBreaker: &breaker}, "app.example.com", &counters)
+	b := BreakBalancer(nil, canary, "app.example.com", &counters).(*breakerBalancer)
+	b.open(time.Now(), "testing")
+
+	if s := testutil.ToFloat64(counters.BreakerState.WithLabelValues("app.example.com", "/", "")); s != BREAKER_STATE_CLOSED {
+		t.Errorf("Expected state of the route without matches to be kept apart, got %v", s)
+	}
+	if s := testutil.ToFloat64(counters.BreakerState.WithLabelValues("app.example.com", "/", "header:X-Canary=always")); s != BREAKER_STATE_OPEN {
+		t.Errorf("Expected state of the route with matches to be exported by its matches, got %v", s)
+	}
+}
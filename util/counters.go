@@ -11,21 +11,72 @@ func CreateCounters() Counters {
 		Name: "shelob_reloads_total",
 		Help: "Number of times the service definitions have been reloaded",
 	})
+	reload_error_counter := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "shelob_reload_errors_total",
+		Help: "Number of times reloading the service definitions has failed",
+	})
 	last_update_gauge := prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "shelob_last_update_epoch",
 		Help: "Unix time/epoch of last successful backend update",
 	})
 
+	health_check_counter := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "shelob_health_checks_total",
+		Help: "Number of active health checks of backends",
+	}, []string{"backend", "path", "result"})
+	backend_health_gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "shelob_backend_healthy",
+		Help: "Whether a health checked backend is in rotation (1) or not (0)",
+	}, []string{"backend", "path"})
+	backend_ejection_counter := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "shelob_backend_ejections_total",
+		Help: "Number of times a backend has been ejected by outlier detection",
+	}, []string{"domain"})
+	ejected_backends_gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "shelob_ejected_backends",
+		Help: "Number of backends currently ejected by outlier detection",
+	}, []string{"domain"})
+	retry_counter := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "shelob_retries_total",
+		Help: "Number of failed requests retried with another backend, or not retried as the retry budget was exhausted",
+	}, []string{"domain", "result"})
+	breaker_state_gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "shelob_circuit_breaker_state",
+		Help: "State of the circuit breaker of a route, closed (0), half-open (1) or open (2)",
+	}, []string{"domain", "path", "match"})
+	connections_gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "shelob_open_connections",
+		Help: "Number of open client connections of a listener",
+	}, []string{"listener"})
+	rejected_connections_counter := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "shelob_rejected_connections_total",
+		Help: "Number of client connections closed right away, as the listener or the client ip was at its connection limit",
+	}, []string{"listener", "reason"})
+	passthrough_connections_counter := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "shelob_passthrough_connections_total",
+		Help: "Number of tls connections of passthrough hosts, spliced to a backend or closed as no backend was available or reachable",
+	}, []string{"domain", "result"})
+
 	return Counters{
-		Requests:   *request_counter,
-		Reloads:    reload_counter,
-		LastUpdate: last_update_gauge,
+		Requests:         *request_counter,
+		Reloads:          reload_counter,
+		ReloadErrors:     reload_error_counter,
+		LastUpdate:       last_update_gauge,
+		HealthChecks:     *health_check_counter,
+		BackendHealth:    *backend_health_gauge,
+		BackendEjections: *backend_ejection_counter,
+		EjectedBackends:  *ejected_backends_gauge,
+		Retries:          *retry_counter,
+		BreakerState:     *breaker_state_gauge,
+		Connections:      *connections_gauge,
+		RejectedConns:    *rejected_connections_counter,
+		PassthroughConns: *passthrough_connections_counter,
 	}
 }
 
 func CreateAndRegisterCounters() Counters {
 	counters := CreateCounters()
-	prometheus.MustRegister(counters.Requests, counters.Reloads, counters.LastUpdate)
+	prometheus.MustRegister(counters.Requests, counters.Reloads, counters.ReloadErrors, counters.LastUpdate, counters.HealthChecks, counters.BackendHealth, counters.BackendEjections, counters.EjectedBackends, counters.Retries, counters.BreakerState, counters.Connections, counters.RejectedConns, counters.PassthroughConns)
 
 	return counters
 }
@@ -0,0 +1,130 @@
+package util
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// gRPC status codes of the errors shelob answers gRPC requests with
+const (
+	GRPC_STATUS_OK                  = 0
+	GRPC_STATUS_CANCELLED           = 1
+	GRPC_STATUS_UNKNOWN             = 2
+	GRPC_STATUS_INVALID_ARGUMENT    = 3
+	GRPC_STATUS_DEADLINE_EXCEEDED   = 4
+	GRPC_STATUS_NOT_FOUND           = 5
+	GRPC_STATUS_ALREADY_EXISTS      = 6
+	GRPC_STATUS_PERMISSION_DENIED   = 7
+	GRPC_STATUS_RESOURCE_EXHAUSTED  = 8
+	GRPC_STATUS_FAILED_PRECONDITION = 9
+	GRPC_STATUS_ABORTED             = 10
+	GRPC_STATUS_OUT_OF_RANGE        = 11
+	GRPC_STATUS_UNIMPLEMENTED       = 12
+	GRPC_STATUS_INTERNAL            = 13
+	GRPC_STATUS_UNAVAILABLE         = 14
+	GRPC_STATUS_DATA_LOSS           = 15
+	GRPC_STATUS_UNAUTHENTICATED     = 16
+)
+
+// IsGrpc tells if a request is a gRPC call
+func IsGrpc(req *http.Request) bool {
+	return strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc")
+}
+
+// Error replies to a request with an error status and message, like http.Error. gRPC calls are answered with the
+// matching gRPC status in a trailers-only response, which gRPC clients understand where a plain text body is a
+// protocol error
+func Error(w http.ResponseWriter, req *http.Request, message string, status int) {
+	if !IsGrpc(req) {
+		http.Error(w, message, status)
+		return
+	}
+	header := w.Header()
+	header.Del("Content-Length")
+	header.Set("Content-Type", "application/grpc")
+	header.Set("Grpc-Status", strconv.Itoa(HttpToGrpcStatus(status)))
+	header.Set("Grpc-Message", encodeGrpcMessage(message))
+	w.WriteHeader(http.StatusOK)
+}
+
+// HttpToGrpcStatus maps the status of an error to a gRPC status, following the gRPC mapping of HTTP status codes
+func HttpToGrpcStatus(status int) int {
+	switch status {
+	case http.StatusBadRequest:
+		return GRPC_STATUS_INTERNAL
+	case http.StatusUnauthorized:
+		return GRPC_STATUS_UNAUTHENTICATED
+	case http.StatusForbidden:
+		return GRPC_STATUS_PERMISSION_DENIED
+	case http.StatusNotFound:
+		return GRPC_STATUS_UNIMPLEMENTED
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable:
+		return GRPC_STATUS_UNAVAILABLE
+	case http.StatusGatewayTimeout:
+		return GRPC_STATUS_DEADLINE_EXCEEDED
+	}
+	return GRPC_STATUS_UNKNOWN
+}
+
+// GrpcToHttpStatus maps the gRPC status of a response to the HTTP status with the same meaning, so gRPC calls are
+// counted along with plain HTTP requests
+func GrpcToHttpStatus(status int) int {
+	switch status {
+	case GRPC_STATUS_OK:
+		return http.StatusOK
+	case GRPC_STATUS_CANCELLED:
+		return 499
+	case GRPC_STATUS_INVALID_ARGUMENT, GRPC_STATUS_FAILED_PRECONDITION, GRPC_STATUS_OUT_OF_RANGE:
+		return http.StatusBadRequest
+	case GRPC_STATUS_DEADLINE_EXCEEDED:
+		return http.StatusGatewayTimeout
+	case GRPC_STATUS_NOT_FOUND:
+		return http.StatusNotFound
+	case GRPC_STATUS_ALREADY_EXISTS, GRPC_STATUS_ABORTED:
+		return http.StatusConflict
+	case GRPC_STATUS_PERMISSION_DENIED:
+		return http.StatusForbidden
+	case GRPC_STATUS_RESOURCE_EXHAUSTED:
+		return http.StatusTooManyRequests
+	case GRPC_STATUS_UNIMPLEMENTED:
+		return http.StatusNotImplemented
+	case GRPC_STATUS_UNAVAILABLE:
+		return http.StatusServiceUnavailable
+	case GRPC_STATUS_UNAUTHENTICATED:
+		return http.StatusUnauthorized
+	}
+	return http.StatusInternalServerError
+}
+
+// ResponseStatus returns the status of the response to a request from the headers written. The gRPC status of a
+// successful gRPC call is found in its headers or trailers, and is mapped to an HTTP status
+func ResponseStatus(req *http.Request, header http.Header, status int) int {
+	if status != http.StatusOK || !IsGrpc(req) {
+		return status
+	}
+	grpcStatus := header.Get("Grpc-Status")
+	if grpcStatus == "" {
+		grpcStatus = header.Get(http.TrailerPrefix + "Grpc-Status")
+	}
+	code, err := strconv.Atoi(grpcStatus)
+	if err != nil {
+		// a call without status ended abnormally
+		return http.StatusInternalServerError
+	}
+	return GrpcToHttpStatus(code)
+}
+
+// encodeGrpcMessage percent-encodes a message as required for the grpc-message header
+func encodeGrpcMessage(message string) string {
+	var b strings.Builder
+	for n := 0; n < len(message); n++ {
+		if c := message[n]; c >= ' ' && c <= '~' && c != '%' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,54 @@
+package util
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestError(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/package.Service/Method", nil)
+	w := httptest.NewRecorder()
+	Error(w, req, "Service Unavailable", http.StatusServiceUnavailable)
+	if w.Code != http.StatusServiceUnavailable || w.Body.String() != "Service Unavailable\n" {
+		t.Errorf("Expected plain text error, got %d %q", w.Code, w.Body.String())
+	}
+
+	req.Header.Set("Content-Type", "application/grpc+proto")
+	w = httptest.NewRecorder()
+	Error(w, req, "Pinned backend 100% gone", http.StatusServiceUnavailable)
+	if w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Errorf("Expected trailers-only response, got %d %q", w.Code, w.Body.String())
+	}
+	if status := w.Header().Get("Grpc-Status"); status != "14" {
+		t.Errorf("Expected grpc status 14, got %q", status)
+	}
+	if message := w.Header().Get("Grpc-Message"); message != "Pinned backend 100%25 gone" {
+		t.Errorf("Expected percent-encoded grpc message, got %q", message)
+	}
+}
+
+func TestResponseStatus(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/package.Service/Method", nil)
+	if status := ResponseStatus(req, http.Header{"Grpc-Status": {"5"}}, http.StatusOK); status != http.StatusOK {
+		t.Errorf("Expected status of plain request to be kept, got %d", status)
+	}
+
+	req.Header.Set("Content-Type", "application/grpc")
+	tests := []struct {
+		header   http.Header
+		status   int
+		expected int
+	}{
+		{http.Header{"Grpc-Status": {"0"}}, http.StatusOK, http.StatusOK},
+		{http.Header{"Grpc-Status": {"14"}}, http.StatusOK, http.StatusServiceUnavailable},
+		{http.Header{http.TrailerPrefix + "Grpc-Status": {"4"}}, http.StatusOK, http.StatusGatewayTimeout},
+		{http.Header{}, http.StatusOK, http.StatusInternalServerError},
+		{http.Header{}, http.StatusBadGateway, http.StatusBadGateway},
+	}
+	for _, test := range tests {
+		if status := ResponseStatus(req, test.header, test.status); status != test.expected {
+			t.Errorf("Expected %d %v to give %d, got %d", test.status, test.header, test.expected, status)
+		}
+	}
+}
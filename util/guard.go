@@ -0,0 +1,120 @@
+package util
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// GuardBalancer wraps the balancer of a route guarded by health checks and/or outlier detection. The guard keeps all
+// backends of the route, and passes only those which are healthy and not ejected on to the wrapped balancer
+func GuardBalancer(balancer Balancer, route *Route, checker *HealthChecker, detector *OutlierDetector) Balancer {
+	b := &guardedBalancer{
+		inner:    balancer,
+		checker:  checker,
+		detector: detector,
+		backends: make(map[string]Backend),
+	}
+	if checker != nil && route.HealthCheck != nil {
+		b.probe = &healthProbe{check: *route.HealthCheck, protocol: route.Protocol, tls: route.TLS}
+	}
+	for _, backend := range route.Backends {
+		b.backends[backend.Url.String()] = backend
+	}
+	if detector != nil {
+		detector.guard(b)
+	}
+	b.sync()
+
+	return b
+}
+
+// guardedBalancer is a balancer passing only available backends on to the wrapped balancer. When no backend is
+// available all of them are kept in rotation, as the guards are then more likely wrong than all backends being broken
+type guardedBalancer struct {
+	inner    Balancer
+	checker  *HealthChecker
+	probe    *healthProbe
+	detector *OutlierDetector
+
+	mutex    sync.Mutex
+	backends map[string]Backend
+}
+
+func (b *guardedBalancer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	b.inner.ServeHTTP(w, req)
+}
+
+func (b *guardedBalancer) Servers() []*url.URL {
+	return b.inner.Servers()
+}
+
+func (b *guardedBalancer) UpsertServer(backend Backend) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.backends[backend.Url.String()] = backend
+	for _, u := range b.inner.Servers() {
+		if sameURL(u, backend.Url) {
+			b.inner.UpsertServer(backend)
+		}
+	}
+	b.syncLocked()
+
+	return nil
+}
+
+func (b *guardedBalancer) RemoveServer(u *url.URL) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	delete(b.backends, u.String())
+	b.syncLocked()
+
+	return nil
+}
+
+func (b *guardedBalancer) available(backend Backend) bool {
+	if b.probe != nil && !b.checker.healthy(backend.Url, *b.probe) {
+		return false
+	}
+	if b.detector != nil && b.detector.Ejected(backend.Url) {
+		return false
+	}
+	return true
+}
+
+func (b *guardedBalancer) sync() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.syncLocked()
+}
+
+func (b *guardedBalancer) syncLocked() {
+	if b.detector != nil {
+		b.detector.retain(b.backends)
+	}
+
+	available := make(map[string]Backend)
+	for key, backend := range b.backends {
+		if b.available(backend) {
+			available[key] = backend
+		}
+	}
+	if len(available) == 0 {
+		available = b.backends
+	}
+
+	current := make(map[string]bool)
+	for _, u := range b.inner.Servers() {
+		current[u.String()] = true
+		if _, keep := available[u.String()]; !keep {
+			b.inner.RemoveServer(u)
+		}
+	}
+	for key, backend := range available {
+		if !current[key] {
+			b.inner.UpsertServer(backend)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dbcdk/shelob/logging"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// HealthChecker probes the backends of health checked routes, and keeps failing backends out of the balancers of these
+// routes. The backends to probe are taken from the published routing table by Sync, so state survives reloads
+type HealthChecker struct {
+	client   *http.Client
+	counters *Counters
+
+	mutex   sync.Mutex
+	targets map[healthTarget]*healthState
+}
+
+type healthTarget struct {
+	url string
+	healthProbe
+}
+
+// healthProbe is the health check of a route, probed with the protocol and tls config of the route
+type healthProbe struct {
+	check    HealthCheck
+	protocol uint16
+	tls      *BackendTLS
+}
+
+type healthState struct {
+	BackendHealth
+	stop      chan struct{}
+	balancers []*guardedBalancer
+}
+
+// NewHealthChecker creates a health checker probing backends through the transport of the forwarder, which speaks the
+// protocol of the route and uses its tls config when told so by the context of a request
+func NewHealthChecker(counters *Counters, transport http.RoundTripper) *HealthChecker {
+	return &HealthChecker{
+		client: &http.Client{
+			Transport: transport,
+			// a redirect is a healthy response, it is not followed
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		counters: counters,
+		targets:  make(map[healthTarget]*healthState),
+	}
+}
+
+// Sync starts probing the backends of health checked routes in the routing table, and stops probing backends which
+// are no longer part of it
+func (checker *HealthChecker) Sync(table *RoutingTable) {
+	balancers := make(map[healthTarget][]*guardedBalancer)
+	for _, frontend := range table.Frontends {
+		for _, route := range frontend.Routes {
+			b, ok := route.Balancer.(*guardedBalancer)
+			if !ok || b.probe == nil {
+				continue
+			}
+			for _, backend := range route.Backends {
+				target := healthTarget{url: backend.Url.String(), healthProbe: *b.probe}
+				balancers[target] = append(balancers[target], b)
+			}
+		}
+	}
+
+	checker.mutex.Lock()
+	defer checker.mutex.Unlock()
+
+	for target, state := range checker.targets {
+		if _, exists := balancers[target]; !exists {
+			close(state.stop)
+			delete(checker.targets, target)
+			// pod addresses are short-lived, drop their series along with them
+			labels := prometheus.Labels{"backend": target.url, "path": target.check.Path}
+			checker.counters.BackendHealth.Delete(labels)
+			checker.counters.HealthChecks.DeletePartialMatch(labels)
+		}
+	}
+	for target, b := range balancers {
+		state, exists := checker.targets[target]
+		if !exists {
+			state = &healthState{
+				BackendHealth: BackendHealth{Url: target.url, Path: target.check.Path, Healthy: true},
+				stop:          make(chan struct{}),
+			}
+			checker.targets[target] = state
+			checker.counters.BackendHealth.WithLabelValues(target.url, target.check.Path).Set(1)
+			go checker.probe(target, state.stop)
+		}
+		state.balancers = b
+	}
+}
+
+// healthy tells if a backend passes its health checks, backends which have not been probed yet are healthy
+func (checker *HealthChecker) healthy(u *url.URL, probe healthProbe) bool {
+	checker.mutex.Lock()
+	defer checker.mutex.Unlock()
+
+	if state, exists := checker.targets[healthTarget{url: u.String(), healthProbe: probe}]; exists {
+		return state.Healthy
+	}
+	return true
+}
+
+// Status returns the state of all probed backends
+func (checker *HealthChecker) Status() []BackendHealth {
+	checker.mutex.Lock()
+	defer checker.mutex.Unlock()
+
+	out := make([]BackendHealth, 0, len(checker.targets))
+	for _, state := range checker.targets {
+		out = append(out, state.BackendHealth)
+	}
+	sort.Slice(out, func(a, b int) bool {
+		if out[a].Url != out[b].Url {
+			return out[a].Url < out[b].Url
+		}
+		return out[a].Path < out[b].Path
+	})
+	return out
+}
+
+func (checker *HealthChecker) probe(target healthTarget, stop chan struct{}) {
+	ticker := time.NewTicker(target.check.Interval)
+	defer ticker.Stop()
+
+	for {
+		err := checker.check(target)
+		checker.record(target, err)
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (checker *HealthChecker) check(target healthTarget) error {
+	ctx, cancel := context.WithTimeout(context.Background(), target.check.Timeout)
+	defer cancel()
+	ctx = context.WithValue(ctx, protocolKey{}, target.protocol)
+	if target.tls != nil {
+		ctx = context.WithValue(ctx, tlsKey{}, target.tls.Config())
+	}
+
+	base, err := url.Parse(target.url)
+	if err != nil {
+		return err
+	}
+	path, err := url.Parse(target.check.Path)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base.ResolveReference(path).String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "shelob-health-check")
+
+	res, err := checker.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 400 {
+		return fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+	return nil
+}
+
+// record updates the state of a backend with the result of a check, balancers using the backend are updated when it
+// crosses one of the thresholds
+func (checker *HealthChecker) record(target healthTarget, err error) {
+	checker.mutex.Lock()
+	state, exists := checker.targets[target]
+	if !exists {
+		checker.mutex.Unlock()
+		return
+	}
+
+	result := "success"
+	state.LastCheck = time.Now()
+	if err == nil {
+		state.ConsecutiveSuccesses++
+		state.ConsecutiveFailures = 0
+		state.LastError = ""
+	} else {
+		result = "failure"
+		state.ConsecutiveFailures++
+		state.ConsecutiveSuccesses = 0
+		state.LastError = err.Error()
+	}
+	checker.counters.HealthChecks.WithLabelValues(target.url, target.check.Path, result).Inc()
+
+	changed := false
+	if state.Healthy && state.ConsecutiveFailures >= target.check.UnhealthyThreshold {
+		state.Healthy, changed = false, true
+		logging.GetInstance().Warn("Backend failed health checks, taking it out of rotation",
+			zap.String("event", "backendUnhealthy"),
+			zap.String("backend", target.url),
+			zap.String("path", target.check.Path),
+			zap.String("error", state.LastError),
+		)
+	} else if !state.Healthy && state.ConsecutiveSuccesses >= target.check.HealthyThreshold {
+		state.Healthy, changed = true, true
+		logging.GetInstance().Info("Backend passed health checks, putting it back in rotation",
+			zap.String("event", "backendHealthy"),
+			zap.String("backend", target.url),
+			zap.String("path", target.check.Path),
+		)
+	}
+
+	if !changed {
+		checker.mutex.Unlock()
+		return
+	}
+	gauge := 0.0
+	if state.Healthy {
+		gauge = 1
+	}
+	checker.counters.BackendHealth.WithLabelValues(target.url, target.check.Path).Set(gauge)
+	balancers := state.balancers
+	checker.mutex.Unlock()
+
+	for _, b := range balancers {
+		b.sync()
+	}
+}
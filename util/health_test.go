@@ -0,0 +1,91 @@
+package util
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHealthChecker(t *testing.T) {
+	var failing atomic.Bool
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer healthy.Close()
+	wedged := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer wedged.Close()
+
+	a, _ := url.Parse(healthy.URL)
+	b, _ := url.Parse(wedged.URL)
+	backends := []Backend{{Url: a}, {Url: b}}
+	check := HealthCheck{Path: "/healthz", Interval: 10 * time.Millisecond, Timeout: time.Second, HealthyThreshold: 2, UnhealthyThreshold: 2}
+
+	counters := CreateCounters()
+	checker := NewHealthChecker(&counters, nil)
+	route := &Route{Backends: backends, HealthCheck: &check}
+	balancer := GuardBalancer(CreateBalancer(nil, Balancing{}, append([]Backend{}, backends...), nil), route, checker, nil)
+	route.Balancer = balancer
+	checker.Sync(&RoutingTable{Frontends: map[string]*Frontend{"app.example.com": {Routes: []*Route{route}}}})
+
+	if len(balancer.Servers()) != 2 {
+		t.Errorf("Expected backends to be in rotation before they are checked, got %v", balancer.Servers())
+	}
+
+	failing.Store(true)
+	waitFor(t, func() bool { return len(balancer.Servers()) == 1 })
+	if balancer.Servers()[0].String() != a.String() || checker.healthy(b, healthProbe{check: check}) {
+		t.Errorf("Expected failing backend to be taken out of rotation, got %v", balancer.Servers())
+	}
+	if status := checker.Status(); len(status) != 2 || status[0].Healthy == status[1].Healthy {
+		t.Errorf("Expected status of both backends, got %v", status)
+	}
+
+	failing.Store(false)
+	waitFor(t, func() bool { return len(balancer.Servers()) == 2 })
+
+	checker.Sync(&RoutingTable{Frontends: map[string]*Frontend{}})
+	if status := checker.Status(); len(status) != 0 {
+		t.Errorf("Expected backends no longer routed to not to be checked, got %v", status)
+	}
+}
+
+func TestGuardedBalancerFailsOpen(t *testing.T) {
+	a, _ := url.Parse("http://10.0.0.1:8080")
+	b, _ := url.Parse("http://10.0.0.2:8080")
+	check := HealthCheck{Path: "/healthz"}
+
+	counters := CreateCounters()
+	checker := NewHealthChecker(&counters, nil)
+	checker.targets[healthTarget{url: a.String(), healthProbe: healthProbe{check: check}}] = &healthState{BackendHealth: BackendHealth{Healthy: false}}
+	checker.targets[healthTarget{url: b.String(), healthProbe: healthProbe{check: check}}] = &healthState{BackendHealth: BackendHealth{Healthy: true}}
+
+	backends := []Backend{{Url: a}, {Url: b}}
+	balancer := GuardBalancer(CreateBalancer(nil, Balancing{}, append([]Backend{}, backends...), nil), &Route{Backends: backends, HealthCheck: &check}, checker, nil)
+	if servers := balancer.Servers(); len(servers) != 1 || servers[0].String() != b.String() {
+		t.Errorf("Expected only the healthy backend, got %v", servers)
+	}
+
+	balancer.RemoveServer(b)
+	if servers := balancer.Servers(); len(servers) != 1 || servers[0].String() != a.String() {
+		t.Errorf("Expected unhealthy backend to be kept in rotation when no backend is healthy, got %v", servers)
+	}
+}
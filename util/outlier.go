@@ -0,0 +1,167 @@
+package util
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/dbcdk/shelob/logging"
+	"github.com/vulcand/oxy/utils"
+	"go.uber.org/zap"
+)
+
+// OutlierDetector watches the responses of the backends of a route, and ejects a backend for the ejection time after
+// a number of consecutive 5xx responses or connection errors (reported as 502 by the forwarder). No more backends than
+// the max ejection percentage of the route are ejected at the same time
+type OutlierDetector struct {
+	detection OutlierDetection
+	domain    string
+	counters  *Counters
+
+	mutex    sync.Mutex
+	backends map[string]*outlierState
+	total    int
+	balancer *guardedBalancer
+}
+
+type outlierState struct {
+	consecutiveErrors int
+	ejected           bool
+}
+
+func NewOutlierDetector(detection OutlierDetection, domain string, counters *Counters) *OutlierDetector {
+	return &OutlierDetector{
+		detection: detection,
+		domain:    domain,
+		counters:  counters,
+		backends:  make(map[string]*outlierState),
+	}
+}
+
+// Observe wraps the handler forwarding requests to the backends, the url of a request is the backend it is sent to
+func (detector *OutlierDetector) Observe(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		pw := utils.NewProxyWriter(w)
+		next.ServeHTTP(pw, req)
+		detector.record(req.URL, pw.StatusCode() >= http.StatusInternalServerError)
+	})
+}
+
+// Ejected tells if a backend is currently ejected
+func (detector *OutlierDetector) Ejected(u *url.URL) bool {
+	detector.mutex.Lock()
+	defer detector.mutex.Unlock()
+
+	state, exists := detector.backends[u.String()]
+	return exists && state.ejected
+}
+
+func (detector *OutlierDetector) guard(balancer *guardedBalancer) {
+	detector.mutex.Lock()
+	defer detector.mutex.Unlock()
+	detector.balancer = balancer
+}
+
+// retain forgets the state of backends no longer part of the route, it is called by the guard with its lock held
+func (detector *OutlierDetector) retain(backends map[string]Backend) {
+	detector.mutex.Lock()
+	defer detector.mutex.Unlock()
+
+	detector.total = len(backends)
+	for key, state := range detector.backends {
+		if _, exists := backends[key]; !exists {
+			if state.ejected {
+				detector.counters.EjectedBackends.WithLabelValues(detector.domain).Dec()
+			}
+			delete(detector.backends, key)
+		}
+	}
+}
+
+func (detector *OutlierDetector) record(u *url.URL, failed bool) {
+	detector.mutex.Lock()
+
+	key := u.String()
+	state, exists := detector.backends[key]
+	if !exists {
+		state = &outlierState{}
+		detector.backends[key] = state
+	}
+	if !failed {
+		state.consecutiveErrors = 0
+		detector.mutex.Unlock()
+		return
+	}
+
+	state.consecutiveErrors++
+	if state.consecutiveErrors < detector.detection.ConsecutiveErrors || state.ejected {
+		detector.mutex.Unlock()
+		return
+	}
+
+	ejected := 0
+	for _, s := range detector.backends {
+		if s.ejected {
+			ejected++
+		}
+	}
+	if detector.total == 0 || (ejected+1)*100 > detector.total*detector.detection.MaxEjectionPercent {
+		if state.consecutiveErrors > detector.detection.ConsecutiveErrors {
+			// only log once per failing streak, the backend is ejected with the next error once possible
+			detector.mutex.Unlock()
+			return
+		}
+		logging.GetInstance().Warn("Not ejecting failing backend, max ejection percentage reached",
+			zap.String("event", "backendEjectionSkipped"),
+			zap.String("domain", detector.domain),
+			zap.String("backend", key),
+			zap.Int("consecutiveErrors", state.consecutiveErrors),
+		)
+		detector.mutex.Unlock()
+		return
+	}
+
+	state.ejected = true
+	detector.counters.BackendEjections.WithLabelValues(detector.domain).Inc()
+	detector.counters.EjectedBackends.WithLabelValues(detector.domain).Inc()
+	logging.GetInstance().Warn("Ejecting failing backend",
+		zap.String("event", "backendEjected"),
+		zap.String("domain", detector.domain),
+		zap.String("backend", key),
+		zap.Int("consecutiveErrors", state.consecutiveErrors),
+		zap.String("ejectionTime", detector.detection.EjectionTime.String()),
+	)
+	balancer := detector.balancer
+	detector.mutex.Unlock()
+
+	time.AfterFunc(detector.detection.EjectionTime, func() {
+		detector.restore(key, state)
+	})
+	if balancer != nil {
+		balancer.sync()
+	}
+}
+
+// restore puts an ejected backend back in rotation when its ejection time has passed
+func (detector *OutlierDetector) restore(key string, ejected *outlierState) {
+	detector.mutex.Lock()
+	if state, exists := detector.backends[key]; !exists || state != ejected || !ejected.ejected {
+		detector.mutex.Unlock()
+		return
+	}
+	ejected.ejected = false
+	ejected.consecutiveErrors = 0
+	detector.counters.EjectedBackends.WithLabelValues(detector.domain).Dec()
+	logging.GetInstance().Info("Returning ejected backend to rotation",
+		zap.String("event", "backendRestored"),
+		zap.String("domain", detector.domain),
+		zap.String("backend", key),
+	)
+	balancer := detector.balancer
+	detector.mutex.Unlock()
+
+	if balancer != nil {
+		balancer.sync()
+	}
+}
@@ -0,0 +1,54 @@
+package util
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestOutlierDetection(t *testing.T) {
+	a, _ := url.Parse("http://10.0.0.1:8080")
+	b, _ := url.Parse("http://10.0.0.2:8080")
+	c, _ := url.Parse("http://10.0.0.3:8080")
+	failing := map[string]bool{b.Host: true, c.Host: true}
+	backends := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if failing[req.URL.Host] {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	})
+
+	counters := CreateCounters()
+	detector := NewOutlierDetector(OutlierDetection{ConsecutiveErrors: 2, EjectionTime: 100 * time.Millisecond, MaxEjectionPercent: 50}, "app.example.com", &counters)
+	all := []Backend{{Url: a}, {Url: b}, {Url: c}}
+	balancer := GuardBalancer(CreateBalancer(detector.Observe(backends), Balancing{}, append([]Backend{}, all...), nil), &Route{Backends: all}, nil, detector)
+
+	for n := 0; n < 12; n++ {
+		balancer.ServeHTTP(httptest.NewRecorder(), createRequest("/", http.Header{}))
+	}
+
+	if servers := balancer.Servers(); len(servers) != 2 {
+		t.Fatalf("Expected one failing backend to be ejected, got %v", servers)
+	}
+	if !detector.Ejected(b) && !detector.Ejected(c) {
+		t.Error("Expected a failing backend to be ejected")
+	}
+	if detector.Ejected(b) && detector.Ejected(c) {
+		t.Error("Expected max ejection percentage to keep the second failing backend")
+	}
+	if ejected := testutil.ToFloat64(counters.EjectedBackends.WithLabelValues("app.example.com")); ejected != 1 {
+		t.Errorf("Expected one ejected backend in metrics, got %v", ejected)
+	}
+
+	failing = map[string]bool{}
+	waitFor(t, func() bool { return len(balancer.Servers()) == 3 })
+	if ejected := testutil.ToFloat64(counters.EjectedBackends.WithLabelValues("app.example.com")); ejected != 0 {
+		t.Errorf("Expected ejected backend to be restored in metrics, got %v", ejected)
+	}
+	if ejections := testutil.ToFloat64(counters.BackendEjections.WithLabelValues("app.example.com")); ejections != 1 {
+		t.Errorf("Expected one ejection to be counted, got %v", ejections)
+	}
+}
@@ -0,0 +1,42 @@
+package util
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+)
+
+type protocolKey struct{}
+
+// WithProtocol wraps the handler forwarding the requests of a route, telling the transport which protocol to speak
+// to the backends of the route
+func WithProtocol(next http.Handler, protocol uint16) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), protocolKey{}, protocol)))
+	})
+}
+
+// BackendProtocol returns the protocol to speak to the backend of a request, HTTP/1.1 unless the route says otherwise
+func BackendProtocol(ctx context.Context) uint16 {
+	if protocol, ok := ctx.Value(protocolKey{}).(uint16); ok {
+		return protocol
+	}
+	return BACKEND_PROTOCOL_HTTP1
+}
+
+type tlsKey struct{}
+
+// WithBackendTLS wraps the handler forwarding the requests of a route, telling the transport which tls config to use
+// for the https backends of the route
+func WithBackendTLS(next http.Handler, backendTLS *BackendTLS) http.Handler {
+	config := backendTLS.Config()
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), tlsKey{}, config)))
+	})
+}
+
+// BackendTLSConfig returns the tls config of the route of a request, nil for routes using the default tls config
+func BackendTLSConfig(ctx context.Context) *tls.Config {
+	config, _ := ctx.Value(tlsKey{}).(*tls.Config)
+	return config
+}
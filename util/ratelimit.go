@@ -0,0 +1,143 @@
+package util
+
+import (
+	"encoding/json"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// interval of dropping the buckets of clients which have not been seen for long enough to have a full bucket again
+	RATE_LIMIT_SWEEP_INTERVAL = time.Minute
+	// number of buckets of a limiter, clients with new keys share the bucket of their ip, or a single overflow bucket,
+	// while all buckets are in use
+	RATE_LIMIT_MAX_BUCKETS = 10000
+)
+
+// RateLimiter keeps a token bucket per key of its rate limit
+type RateLimiter struct {
+	limit      RateLimit
+	maxBuckets int
+
+	mutex     sync.Mutex
+	buckets   map[string]*bucket
+	overflow  *bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	limiter *rate.Limiter
+	seen    time.Time
+}
+
+func NewRateLimiter(limit RateLimit) *RateLimiter {
+	return &RateLimiter{
+		limit:      limit,
+		maxBuckets: RATE_LIMIT_MAX_BUCKETS,
+		buckets:    make(map[string]*bucket),
+		overflow:   &bucket{limiter: rate.NewLimiter(rate.Limit(limit.Rate), limit.Burst)},
+		lastSweep:  time.Now(),
+	}
+}
+
+// Limit returns the rate limit enforced by the limiter
+func (l *RateLimiter) Limit() RateLimit {
+	return l.limit
+}
+
+// serialize the rate limit, the state of the buckets is left out
+func (l *RateLimiter) MarshalJSON() ([]byte, error) {
+	return json.Marshal(l.limit)
+}
+
+// Allow takes a token from the bucket of a request, or tells how long until a token is available. A nil limiter
+// allows all requests
+func (l *RateLimiter) Allow(req *http.Request) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	now := time.Now()
+	key := l.key(req)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if now.Sub(l.lastSweep) >= RATE_LIMIT_SWEEP_INTERVAL {
+		l.sweep(now)
+	}
+	b := l.bucket(key, req, now)
+	b.seen = now
+
+	reservation := b.limiter.ReserveN(now, 1)
+	if !reservation.OK() {
+		return false, time.Second
+	}
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
+
+// bucket returns the bucket of a key, created when there is room for it. Otherwise a request with a header key is
+// counted in the bucket of its client ip, and the overflow bucket is shared by the remaining requests. It is called
+// with the lock held
+func (l *RateLimiter) bucket(key string, req *http.Request, now time.Time) *bucket {
+	if b, exists := l.buckets[key]; exists {
+		return b
+	}
+	if len(l.buckets) >= l.maxBuckets && now.Sub(l.lastSweep) >= time.Second {
+		l.sweep(now)
+	}
+	if len(l.buckets) >= l.maxBuckets {
+		if b, exists := l.buckets[clientIPKey(req)]; exists {
+			return b
+		}
+		return l.overflow
+	}
+	b := &bucket{limiter: rate.NewLimiter(rate.Limit(l.limit.Rate), l.limit.Burst)}
+	l.buckets[key] = b
+	return b
+}
+
+// sweep drops the buckets which have filled up again, they behave like new ones. It is called with the lock held
+func (l *RateLimiter) sweep(now time.Time) {
+	full := time.Duration(float64(l.limit.Burst) / l.limit.Rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.seen) >= full {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// key returns the bucket of a request, requests without the header of a header keyed limit are keyed by client ip
+func (l *RateLimiter) key(req *http.Request) string {
+	switch l.limit.Key {
+	case RATE_LIMIT_KEY_GLOBAL:
+		return ""
+	case RATE_LIMIT_KEY_HEADER:
+		if value := req.Header.Get(l.limit.KeyName); value != "" {
+			return "header:" + value
+		}
+	}
+	return clientIPKey(req)
+}
+
+func clientIPKey(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return "ip:" + req.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// RetryAfter converts the time until a request is allowed to the seconds of a Retry-After header
+func RetryAfter(delay time.Duration) int {
+	return int(math.Max(1, math.Ceil(delay.Seconds())))
+}
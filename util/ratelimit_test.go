@@ -0,0 +1,74 @@
+package util
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(RateLimit{Rate: 1, Burst: 2, Key: RATE_LIMIT_KEY_CLIENT_IP})
+	a := &http.Request{RemoteAddr: "10.0.0.1:1234", Header: http.Header{}}
+	b := &http.Request{RemoteAddr: "10.0.0.2:1234", Header: http.Header{}}
+
+	for n := 0; n < 2; n++ {
+		if allowed, _ := limiter.Allow(a); !allowed {
+			t.Error("Expected requests within the burst to be allowed")
+		}
+	}
+	allowed, delay := limiter.Allow(a)
+	if allowed || delay <= 0 || delay > time.Second {
+		t.Errorf("Expected request above the burst to be limited for up to a second, got %v %v", allowed, delay)
+	}
+	if allowed, _ := limiter.Allow(b); !allowed {
+		t.Error("Expected other clients to have their own bucket")
+	}
+	if RetryAfter(delay) != 1 {
+		t.Errorf("Expected Retry-After of one second, got %d", RetryAfter(delay))
+	}
+
+	var unlimited *RateLimiter
+	if allowed, _ := unlimited.Allow(a); !allowed {
+		t.Error("Expected nil limiter to allow all requests")
+	}
+}
+
+func TestRateLimiterKeys(t *testing.T) {
+	global := NewRateLimiter(RateLimit{Rate: 1, Burst: 1, Key: RATE_LIMIT_KEY_GLOBAL})
+	header := NewRateLimiter(RateLimit{Rate: 1, Burst: 1, Key: RATE_LIMIT_KEY_HEADER, KeyName: "X-Api-Key"})
+	a := &http.Request{RemoteAddr: "10.0.0.1:1234", Header: http.Header{"X-Api-Key": {"a"}}}
+	b := &http.Request{RemoteAddr: "10.0.0.1:1234", Header: http.Header{"X-Api-Key": {"b"}}}
+
+	global.Allow(a)
+	if allowed, _ := global.Allow(b); allowed {
+		t.Error("Expected global limit to be shared by all requests")
+	}
+	header.Allow(a)
+	if allowed, _ := header.Allow(b); !allowed {
+		t.Error("Expected header limit to be counted per header value")
+	}
+	if allowed, _ := header.Allow(a); allowed {
+		t.Error("Expected header limit to limit requests with the same header value")
+	}
+}
+
+func TestRateLimiterMaxBuckets(t *testing.T) {
+	limiter := NewRateLimiter(RateLimit{Rate: 1, Burst: 1, Key: RATE_LIMIT_KEY_HEADER, KeyName: "X-Api-Key"})
+	limiter.maxBuckets = 2
+	request := func(ip string, key string) bool {
+		allowed, _ := limiter.Allow(&http.Request{RemoteAddr: ip + ":1234", Header: http.Header{"X-Api-Key": {key}}})
+		return allowed
+	}
+
+	request("10.0.0.1", "")
+	request("10.0.0.1", "a")
+	if request("10.0.0.1", "random") {
+		t.Error("Expected new header value to be counted in the bucket of its ip when all buckets are in use")
+	}
+	if !request("10.0.0.2", "random") || request("10.0.0.3", "random") {
+		t.Error("Expected other new keys to share the overflow bucket when all buckets are in use")
+	}
+	if len(limiter.buckets) != 2 {
+		t.Errorf("Expected number of buckets to be capped, got %d", len(limiter.buckets))
+	}
+}
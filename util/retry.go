@@ -0,0 +1,301 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/vulcand/oxy/forward"
+)
+
+const (
+	// window over which the retries of a route are weighed against its requests
+	RETRY_BUDGET_WINDOW = 10 * time.Second
+	// retries allowed in every window regardless of the budget, so routes with little traffic can still retry
+	RETRY_BUDGET_MIN = 10
+	// largest request body buffered to be replayed on a retry, requests with larger bodies are not retried
+	RETRY_BODY_LIMIT = 64 * 1024
+)
+
+// RetryBalancer wraps the balancer of a route with a retry policy. Failed requests are retried with another backend
+// of the route, as long as the retries of the route stay within the budget of the policy
+func RetryBalancer(balancer Balancer, policy RetryPolicy, domain string, counters *Counters) Balancer {
+	return &retryBalancer{
+		Balancer: balancer,
+		policy:   policy,
+		domain:   domain,
+		counters: counters,
+	}
+}
+
+type retryBalancer struct {
+	Balancer
+	policy   RetryPolicy
+	domain   string
+	counters *Counters
+
+	mutex    sync.Mutex
+	window   time.Time
+	requests int
+	retries  int
+}
+
+// attempt is passed to the balancer in the context of a request which may be retried. Balancers avoid the backends
+// already tried, and the backend of the attempt is recorded before the request is forwarded
+type attempt struct {
+	tried   []*url.URL
+	backend *url.URL
+	err     error
+}
+
+type attemptKey struct{}
+
+func (b *retryBalancer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !b.retryable(req) {
+		b.Balancer.ServeHTTP(w, req)
+		return
+	}
+	body, replayable := bufferBody(req)
+	if !replayable {
+		b.Balancer.ServeHTTP(w, req)
+		return
+	}
+	b.request()
+
+	state := &attempt{}
+	ctx := context.WithValue(req.Context(), attemptKey{}, state)
+	for n := 0; ; n++ {
+		state.backend, state.err = nil, nil
+		aw := &attemptWriter{ResponseWriter: w, header: make(http.Header), ctx: ctx, balancer: b, attempt: state, last: n >= b.policy.Attempts}
+		r := req.WithContext(ctx)
+		if body != nil {
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		b.Balancer.ServeHTTP(aw, r)
+		if !aw.discarded || ctx.Err() != nil {
+			if !aw.wroteHeader && ctx.Err() == nil {
+				aw.WriteHeader(http.StatusOK)
+			}
+			return
+		}
+		state.tried = append(state.tried, state.backend)
+	}
+}
+
+// retryable tells if the method of a request allows it to be retried, and leaves out upgraded connections and gRPC
+// calls, whose streams must not be buffered
+func (b *retryBalancer) retryable(req *http.Request) bool {
+	if forward.IsWebsocketRequest(req) || IsGrpc(req) {
+		return false
+	}
+	if b.policy.AllMethods {
+		return true
+	}
+	switch req.Method {
+	// an empty method means GET
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// retry decides if a response ends the request, or is discarded to retry with another backend
+func (b *retryBalancer) retry(state *attempt, code int) bool {
+	switch {
+	case state.backend == nil:
+		return false
+	case state.err != nil:
+		if !b.policy.ConnectFailure {
+			return false
+		}
+	case !(b.policy.ServerErrors && code >= http.StatusInternalServerError) && !slices.Contains(b.policy.StatusCodes, code):
+		return false
+	}
+
+	untried := false
+	for _, u := range b.Servers() {
+		if !sameURL(u, state.backend) && !containsURL(state.tried, u) {
+			untried = true
+			break
+		}
+	}
+	if !untried {
+		return false
+	}
+
+	if !b.spend() {
+		b.counters.Retries.WithLabelValues(b.domain, "budget_exhausted").Inc()
+		return false
+	}
+	b.counters.Retries.WithLabelValues(b.domain, "retried").Inc()
+	return true
+}
+
+func (b *retryBalancer) request() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.roll()
+	b.requests++
+}
+
+// spend takes a retry from the budget, which allows a percentage of the requests of the current window to be retried
+func (b *retryBalancer) spend() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.roll()
+	if b.retries >= RETRY_BUDGET_MIN+b.requests*b.policy.Budget/100 {
+		return false
+	}
+	b.retries++
+	return true
+}
+
+func (b *retryBalancer) roll() {
+	if now := time.Now(); now.Sub(b.window) >= RETRY_BUDGET_WINDOW {
+		b.window, b.requests, b.retries = now, 0, 0
+	}
+}
+
+// bufferBody reads the body of a request so it can be replayed, bodies larger than the limit are left to be streamed
+func bufferBody(req *http.Request) ([]byte, bool) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true
+	}
+	if req.ContentLength > RETRY_BODY_LIMIT {
+		return nil, false
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, RETRY_BODY_LIMIT+1))
+	if err != nil || len(body) > RETRY_BODY_LIMIT {
+		req.Body = readCloser{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+		return nil, false
+	}
+	req.Body.Close()
+	return body, true
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func containsURL(urls []*url.URL, u *url.URL) bool {
+	return slices.ContainsFunc(urls, func(v *url.URL) bool { return sameURL(u, v) })
+}
+
+// excludeTried leaves out the backends already tried by a retried request, unless that would leave none
+func excludeTried(req *http.Request, endpoints []*endpoint) []*endpoint {
+	state, ok := req.Context().Value(attemptKey{}).(*attempt)
+	if !ok || len(state.tried) == 0 {
+		return endpoints
+	}
+	out := make([]*endpoint, 0, len(endpoints))
+	for _, e := range endpoints {
+		if !containsURL(state.tried, e.url) {
+			out = append(out, e)
+		}
+	}
+	if len(out) == 0 {
+		return endpoints
+	}
+	return out
+}
+
+// recordAttempt remembers the backend chosen for a request which may be retried
+func recordAttempt(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if state, ok := req.Context().Value(attemptKey{}).(*attempt); ok {
+			state.backend = req.URL
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// attemptWriter holds back the headers of a response until its status is known, and discards the response when the
+// request is retried
+type attemptWriter struct {
+	http.ResponseWriter
+	header   http.Header
+	ctx      context.Context
+	balancer *retryBalancer
+	attempt  *attempt
+	last     bool
+
+	wroteHeader bool
+	discarded   bool
+}
+
+func (w *attemptWriter) Header() http.Header {
+	if w.wroteHeader && !w.discarded {
+		// trailers are announced in the header after the status has been written
+		return w.ResponseWriter.Header()
+	}
+	return w.header
+}
+
+func (w *attemptWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	if informational(code) {
+		// informational responses such as 103 Early Hints are passed on, the final status follows
+		if !w.discarded {
+			writeInformational(w.ResponseWriter, w.header, code)
+		}
+		return
+	}
+	w.wroteHeader = true
+	// a request canceled by the client or its timeouts is not retried
+	if !w.last && w.ctx.Err() == nil && w.balancer.retry(w.attempt, code) {
+		w.discarded = true
+		return
+	}
+	header := w.ResponseWriter.Header()
+	for key, values := range w.header {
+		header[key] = values
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *attemptWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.discarded {
+		return len(data), nil
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *attemptWriter) Flush() {
+	if w.discarded {
+		return
+	}
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// informational tells if a status is an informational response, which is followed by the final status of the response.
+// 101 Switching Protocols is final, the connection is taken over by the upgraded protocol
+func informational(code int) bool {
+	return code >= 100 && code < 200 && code != http.StatusSwitchingProtocols
+}
+
+// writeInformational writes an informational response with the given header, leaving the header of the final response
+// as it was
+func writeInformational(w http.ResponseWriter, header http.Header, code int) {
+	final := w.Header().Clone()
+	maps.Copy(w.Header(), header)
+	w.WriteHeader(code)
+	clear(w.Header())
+	maps.Copy(w.Header(), final)
+}
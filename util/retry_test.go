@@ -0,0 +1,157 @@
+package util
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRetryConnectFailure(t *testing.T) {
+	a, _ := url.Parse("http://10.0.0.1:8080")
+	b, _ := url.Parse("http://10.0.0.2:8080")
+	var bodies []string
+	backends := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Host == a.Host {
+			ForwardErrorHandler.ServeHTTP(w, req, io.EOF)
+			return
+		}
+		if req.Body != nil {
+			body, _ := io.ReadAll(req.Body)
+			bodies = append(bodies, string(body))
+		}
+	})
+
+	for _, balancing := range []Balancing{{Algorithm: BALANCER_ROUND_ROBIN}, {Algorithm: BALANCER_LEAST_REQUEST}} {
+		counters := CreateCounters()
+		policy := RetryPolicy{Attempts: 1, ConnectFailure: true, Budget: 20}
+		balancer := RetryBalancer(CreateBalancer(backends, balancing, []Backend{{Url: a}, {Url: b}}, nil), policy, "app.example.com", &counters)
+
+		for n := 0; n < 10; n++ {
+			w := httptest.NewRecorder()
+			balancer.ServeHTTP(w, createRequest("/", http.Header{}))
+			if w.Code != http.StatusOK {
+				t.Errorf("Expected request to be retried with the working backend, got %d", w.Code)
+			}
+		}
+
+		bodies = nil
+		for n := 0; n < 2; n++ {
+			balancer.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "http://app.example.com/", strings.NewReader("payload")))
+		}
+		if len(bodies) != 2 || bodies[0] != "payload" || bodies[1] != "payload" {
+			t.Errorf("Expected body to be replayed on retry, got %v", bodies)
+		}
+
+		failed := 0
+		for n := 0; n < 10; n++ {
+			w := httptest.NewRecorder()
+			balancer.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "http://app.example.com/", nil))
+			if w.Code == http.StatusBadGateway {
+				failed++
+			}
+		}
+		if failed == 0 {
+			t.Error("Expected non-idempotent requests not to be retried")
+		}
+		if retried := testutil.ToFloat64(counters.Retries.WithLabelValues("app.example.com", "retried")); retried == 0 {
+			t.Error("Expected retries to be counted")
+		}
+	}
+}
+
+func TestRetryStatusCodes(t *testing.T) {
+	a, _ := url.Parse("http://10.0.0.1:8080")
+	b, _ := url.Parse("http://10.0.0.2:8080")
+	backends := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Backend", req.URL.Host)
+		if req.URL.Host == a.Host {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("unavailable"))
+		}
+	})
+
+	counters := CreateCounters()
+	policy := RetryPolicy{Attempts: 2, StatusCodes: []int{http.StatusServiceUnavailable}, Budget: 20}
+	balancer := RetryBalancer(CreateBalancer(backends, Balancing{}, []Backend{{Url: a}, {Url: b}}, nil), policy, "app.example.com", &counters)
+
+	for n := 0; n < 4; n++ {
+		w := httptest.NewRecorder()
+		balancer.ServeHTTP(w, createRequest("/", http.Header{}))
+		if w.Code != http.StatusOK || w.Header().Get("X-Backend") != b.Host || w.Body.Len() != 0 {
+			t.Errorf("Expected only the response of the retry to be sent, got %d %v %q", w.Code, w.Header(), w.Body.String())
+		}
+	}
+}
+
+func TestRetryInformational(t *testing.T) {
+	a, _ := url.Parse("http://10.0.0.1:8080")
+	b, _ := url.Parse("http://10.0.0.2:8080")
+	backends := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Del("Link")
+		w.Header().Set("X-Backend", req.URL.Host)
+		if req.URL.Host == a.Host {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	counters := CreateCounters()
+	policy := RetryPolicy{Attempts: 2, StatusCodes: []int{http.StatusServiceUnavailable}, Budget: 20}
+	server := httptest.NewServer(RetryBalancer(CreateBalancer(backends, Balancing{}, []Backend{{Url: a}, {Url: b}}, nil), policy, "app.example.com", &counters))
+	defer server.Close()
+
+	for n := 0; n < 2; n++ {
+		hints := 0
+		trace := &httptrace.ClientTrace{Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			if code == http.StatusEarlyHints && header.Get("Link") != "" {
+				hints++
+			}
+			return nil
+		}}
+		req, _ := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), http.MethodGet, server.URL, nil)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusInternalServerError || res.Header.Get("X-Backend") != b.Host || res.Header.Get("Link") != "" {
+			t.Errorf("Expected final status of the retry to follow the early hints, got %d %v", res.StatusCode, res.Header)
+		}
+		if hints == 0 {
+			t.Error("Expected early hints to be passed on")
+		}
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	a, _ := url.Parse("http://10.0.0.1:8080")
+	b, _ := url.Parse("http://10.0.0.2:8080")
+	backends := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	counters := CreateCounters()
+	policy := RetryPolicy{Attempts: 1, ServerErrors: true, Budget: 10}
+	balancer := RetryBalancer(CreateBalancer(backends, Balancing{}, []Backend{{Url: a}, {Url: b}}, nil), policy, "app.example.com", &counters)
+
+	for n := 0; n < 50; n++ {
+		balancer.ServeHTTP(httptest.NewRecorder(), createRequest("/", http.Header{}))
+	}
+
+	retried := testutil.ToFloat64(counters.Retries.WithLabelValues("app.example.com", "retried"))
+	exhausted := testutil.ToFloat64(counters.Retries.WithLabelValues("app.example.com", "budget_exhausted"))
+	if retried != RETRY_BUDGET_MIN+5 || exhausted != 50-retried {
+		t.Errorf("Expected retries to be limited by the budget, got %v retried and %v exhausted", retried, exhausted)
+	}
+}
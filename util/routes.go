@@ -0,0 +1,116 @@
+package util
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// SortRoutes orders routes by match precedence: longest path first, exact matches before prefix matches of the
+// same path, and then routes with more request matches first, mirroring the precedence rules of Ingress and HTTPRoute
+func SortRoutes(routes []*Route) {
+	sort.SliceStable(routes, func(i, j int) bool {
+		a, b := routes[i], routes[j]
+		if len(a.Path) != len(b.Path) {
+			return len(a.Path) > len(b.Path)
+		}
+		if aExact, bExact := a.PathType == PATH_TYPE_EXACT, b.PathType == PATH_TYPE_EXACT; aExact != bExact {
+			return aExact
+		}
+		return len(a.Matches) > len(b.Matches)
+	})
+}
+
+// MatchRoute returns the first route matching the given request, routes are expected to be sorted by SortRoutes
+func (frontend Frontend) MatchRoute(req *http.Request) *Route {
+	path := req.URL.Path
+	if path == "" {
+		path = "/"
+	}
+	for _, route := range frontend.Routes {
+		if route.MatchesPath(path) && route.MatchesRequest(req) {
+			return route
+		}
+	}
+
+	return nil
+}
+
+func (route Route) MatchesPath(path string) bool {
+	switch route.PathType {
+	case PATH_TYPE_EXACT:
+		return path == route.Path
+	default:
+		// prefix matching is done element-wise on '/'-separated path elements, so /foo matches /foo/bar but not /foobar.
+		// ImplementationSpecific paths are treated as prefixes
+		prefix := strings.TrimSuffix(route.Path, "/")
+		return prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/")
+	}
+}
+
+// MatchesRequest checks the request matches of the route, all of them must match
+func (route Route) MatchesRequest(req *http.Request) bool {
+	for _, match := range route.Matches {
+		if !match.Matches(req) {
+			return false
+		}
+	}
+	return true
+}
+
+func (match RequestMatch) Matches(req *http.Request) bool {
+	var value string
+	var present bool
+	switch match.Source {
+	case MATCH_SOURCE_HEADER:
+		var values []string
+		values, present = req.Header[http.CanonicalHeaderKey(match.Name)]
+		if present && len(values) > 0 {
+			value = values[0]
+		}
+	case MATCH_SOURCE_COOKIE:
+		if cookie, err := req.Cookie(match.Name); err == nil {
+			value, present = cookie.Value, true
+		}
+	case MATCH_SOURCE_QUERY:
+		var values []string
+		values, present = req.URL.Query()[match.Name]
+		if present && len(values) > 0 {
+			value = values[0]
+		}
+	}
+
+	if !present {
+		return false
+	} else if match.Regexp != nil {
+		return match.Regexp.MatchString(value)
+	} else {
+		return value == match.Value
+	}
+}
+
+// matchKey tells apart the routes of a host with the same path, by whether the path is matched exactly and by the
+// request matches of the route. It is empty for prefix routes without request matches
+func (route *Route) matchKey() string {
+	parts := make([]string, 0, len(route.Matches)+1)
+	if route.PathType == PATH_TYPE_EXACT {
+		parts = append(parts, "exact")
+	}
+	for _, match := range route.Matches {
+		var source string
+		switch match.Source {
+		case MATCH_SOURCE_HEADER:
+			source = "header"
+		case MATCH_SOURCE_COOKIE:
+			source = "cookie"
+		case MATCH_SOURCE_QUERY:
+			source = "query"
+		}
+		operator := "="
+		if match.Regexp != nil {
+			operator = "~"
+		}
+		parts = append(parts, source+":"+match.Name+operator+match.Value)
+	}
+	return strings.Join(parts, " ")
+}
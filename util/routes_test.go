@@ -0,0 +1,135 @@
+package util
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func createRequest(path string, header http.Header) *http.Request {
+	return &http.Request{URL: &url.URL{Path: path}, Header: header}
+}
+
+func createFrontend(routes ...*Route) Frontend {
+	SortRoutes(routes)
+	return Frontend{
+		Action: BACKEND_ACTION_PROXY_RR,
+		Routes: routes,
+	}
+}
+
+func TestMatchRoute(t *testing.T) {
+	root := &Route{Path: "/", PathType: PATH_TYPE_PREFIX}
+	api := &Route{Path: "/api", PathType: PATH_TYPE_PREFIX}
+	apiExact := &Route{Path: "/api", PathType: PATH_TYPE_EXACT}
+	apiV2 := &Route{Path: "/api/v2/", PathType: PATH_TYPE_IMPLEMENTATION_SPECIFIC}
+
+	frontend := createFrontend(root, api, apiExact, apiV2)
+
+	cases := map[string]*Route{
+		"":              root,
+		"/":             root,
+		"/apis":         root,
+		"/api":          apiExact,
+		"/api/":         api,
+		"/api/v1/users": api,
+		"/api/v2":       apiV2,
+		"/api/v2/users": apiV2,
+	}
+	for path, expected := range cases {
+		if actual := frontend.MatchRoute(createRequest(path, nil)); actual != expected {
+			t.Errorf("Expected path '%s' to match route %v, got %v", path, expected, actual)
+		}
+	}
+
+	if route := createFrontend(apiExact).MatchRoute(createRequest("/api/", nil)); route != nil {
+		t.Error("Expected exact route not to match path with trailing slash")
+	}
+
+	if route := createFrontend(api).MatchRoute(createRequest("/", nil)); route != nil {
+		t.Error("Expected no route to match path outside prefix")
+	}
+}
+
+func TestMatchRouteRequestMatches(t *testing.T) {
+	root := &Route{Path: "/", PathType: PATH_TYPE_PREFIX}
+	canary := &Route{Path: "/", PathType: PATH_TYPE_PREFIX, Matches: []RequestMatch{
+		{Source: MATCH_SOURCE_HEADER, Name: "x-canary", Value: "always"},
+	}}
+	beta := &Route{Path: "/", PathType: PATH_TYPE_PREFIX, Matches: []RequestMatch{
+		{Source: MATCH_SOURCE_HEADER, Name: "X-Canary", Value: "always"},
+		{Source: MATCH_SOURCE_HEADER, Name: "X-Version", Regexp: regexp.MustCompile("^beta-[0-9]+$")},
+	}}
+
+	frontend := createFrontend(root, canary, beta)
+
+	if route := frontend.MatchRoute(createRequest("/", http.Header{})); route != root {
+		t.Errorf("Expected request without headers to match the plain route, got %v", route)
+	}
+	if route := frontend.MatchRoute(createRequest("/", http.Header{"X-Canary": {"always"}})); route != canary {
+		t.Errorf("Expected request with canary header to match the canary route, got %v", route)
+	}
+	if route := frontend.MatchRoute(createRequest("/", http.Header{"X-Canary": {"always"}, "X-Version": {"beta-2"}})); route != beta {
+		t.Errorf("Expected request matching most conditions to match the beta route, got %v", route)
+	}
+	if route := frontend.MatchRoute(createRequest("/", http.Header{"X-Canary": {"never"}})); route != root {
+		t.Errorf("Expected request with non-matching header to match the plain route, got %v", route)
+	}
+}
+
+func TestRequestMatchSources(t *testing.T) {
+	req := createRequest("/", http.Header{"Cookie": {"beta=1; session=abc"}})
+	req.URL.RawQuery = "preview=v2&debug"
+
+	cases := map[*RequestMatch]bool{
+		{Source: MATCH_SOURCE_COOKIE, Name: "beta", Value: "1"}:                               true,
+		{Source: MATCH_SOURCE_COOKIE, Name: "beta", Value: "2"}:                               false,
+		{Source: MATCH_SOURCE_COOKIE, Name: "missing", Value: ""}:                             false,
+		{Source: MATCH_SOURCE_QUERY, Name: "preview", Regexp: regexp.MustCompile("^v[0-9]$")}: true,
+		{Source: MATCH_SOURCE_QUERY, Name: "debug", Value: ""}:                                true,
+		{Source: MATCH_SOURCE_QUERY, Name: "missing", Value: ""}:                              false,
+	}
+	for match, expected := range cases {
+		if actual := match.Matches(req); actual != expected {
+			t.Errorf("Expected match %v to be %t, got %t", *match, expected, actual)
+		}
+	}
+}
+
+func TestRouteJSON(t *testing.T) {
+	u, _ := url.Parse("http://10.0.0.1:8080")
+	backends := []Backend{{Url: u, Weight: 1}}
+	route := &Route{
+		Path:     "/",
+		Backends: backends,
+		Affinity: &Affinity{CookieName: "sticky", TTL: time.Hour},
+		Timeouts: Timeouts{ResponseHeader: 5 * time.Second, Total: time.Minute},
+		Balancer: GuardBalancer(CreateBalancer(nil, Balancing{}, backends, nil), &Route{Backends: backends}, nil, nil),
+	}
+	sticky, err := route.StickySession([]byte("0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	route.Sticky = sticky
+
+	out, err := json.Marshal(route)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(out, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := fields["Balancer"]; exists {
+		t.Errorf("Expected the balancer of the route to be left out, got %s", out)
+	}
+	if _, exists := fields["Sticky"]; exists {
+		t.Errorf("Expected the sticky session of the route to be left out, got %s", out)
+	}
+	if timeouts := string(fields["Timeouts"]); timeouts != `{"connect":"0s","responseHeader":"5s","idle":"0s","total":"1m0s"}` {
+		t.Errorf("Expected timeouts to be serialized as durations, got %s", timeouts)
+	}
+}
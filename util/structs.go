@@ -4,61 +4,101 @@ import (
 	"encoding/json"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/vulcand/oxy/forward"
-	"github.com/vulcand/oxy/roundrobin"
 	"k8s.io/client-go/rest"
 	"net/url"
+	"regexp"
+	"sync/atomic"
 	"time"
 )
 
 type Config struct {
-	HttpPort            int
-	HttpsPort           int
-	MetricsPort         int
-	ReuseHttpPort       bool
-	IgnoreSSLErrors     bool
-	InstanceName        string
-	Domain              string
-	ShutdownDelay       int
-	ReloadEvery         int
-	ReloadRollup        int
-	AcceptableUpdateLag int
-	Frontends           map[string]*Frontend
-	Forwarder           *forward.Forwarder
-	Logging             Logging
-	State               State
-	Counters            Counters
-	LastUpdate          time.Time
-	HasBeenUpdated      bool
-	Kubeconfig          *rest.Config
-	DisableWatch        bool
-	IgnoreNamespaces    map[string]bool
-	CertFilePairMap     map[string]KeyPairPaths
-	CertNamespace       string
-	WildcardCertPrefix  string
+	HttpPort              int
+	HttpsPort             int
+	MetricsPort           int
+	ReuseHttpPort         bool
+	IgnoreSSLErrors       bool
+	BackendTLSSources     bool
+	InstanceName          string
+	Domain                string
+	ShutdownDelay         int
+	ReloadEvery           int
+	ReloadRollup          int
+	AcceptableUpdateLag   int
+	routingTable          atomic.Pointer[RoutingTable]
+	updateFailure         atomic.Pointer[UpdateFailure]
+	Forwarder             *forward.Forwarder
+	Logging               Logging
+	Limits                Limits
+	State                 State
+	Counters              Counters
+	Kubeconfig            *rest.Config
+	DisableWatch          bool
+	IgnoreNamespaces      map[string]bool
+	CertFilePairMap       map[string]KeyPairPaths
+	ClientCAFileMap       map[string]ClientCAFile
+	CertNamespace         string
+	WildcardCertPrefix    string
+	IngressClass          string
+	GatewayControllerName string
+	AffinityKey           []byte
+	EnableHttp2           bool
+	EnableH2c             bool
+	HealthChecker         *HealthChecker
 }
 
 type Logging struct {
 	AccessLog bool
 }
 
+// Limits protect the proxy listeners from slow and greedy clients (0=no limit)
+type Limits struct {
+	ReadHeaderTimeout   time.Duration
+	ReadTimeout         time.Duration
+	WriteTimeout        time.Duration
+	IdleTimeout         time.Duration
+	MaxHeaderBytes      int
+	MaxConnections      int
+	MaxConnectionsPerIP int
+}
+
 type State struct {
 	ShutdownInProgress bool
 	ShutdownChan       chan bool
 }
 
 type Counters struct {
-	Requests   prometheus.CounterVec
-	Reloads    prometheus.Counter
-	LastUpdate prometheus.Gauge
+	Requests         prometheus.CounterVec
+	Reloads          prometheus.Counter
+	ReloadErrors     prometheus.Counter
+	LastUpdate       prometheus.Gauge
+	HealthChecks     prometheus.CounterVec
+	BackendHealth    prometheus.GaugeVec
+	BackendEjections prometheus.CounterVec
+	EjectedBackends  prometheus.GaugeVec
+	Retries          prometheus.CounterVec
+	BreakerState     prometheus.GaugeVec
+	Connections      prometheus.GaugeVec
+	RejectedConns    prometheus.CounterVec
+	PassthroughConns prometheus.CounterVec
 }
 
 type ShelobStatus struct {
-	Name       string    `json:"name"`
-	Ok         bool      `json:"ok"`
-	Up         bool      `json:"up"`
-	Stale      bool      `json:"stale"`
-	LastUpdate time.Time `json:"lastUpdate"`
-	UpdateLag  float64   `json:"updateLag"`
+	Name              string    `json:"name"`
+	Ok                bool      `json:"ok"`
+	Up                bool      `json:"up"`
+	Stale             bool      `json:"stale"`
+	LastUpdate        time.Time `json:"lastUpdate"`
+	UpdateLag         float64   `json:"updateLag"`
+	RoutingVersion    uint64    `json:"routingVersion"`
+	ConsecutiveErrors int       `json:"consecutiveErrors"`
+	LastError         string    `json:"lastError,omitempty"`
+}
+
+// UpdateFailure describes the failure of the most recent backend reload
+type UpdateFailure struct {
+	ConsecutiveErrors int
+	Error             string
+	Time              time.Time
 }
 
 const (
@@ -66,6 +106,7 @@ const (
 	BACKEND_ACTION_PROXY_RR
 	BACKEND_ACTION_REDIRECT
 	BACKEND_ACTION_RESPOND
+	BACKEND_ACTION_PASSTHROUGH
 )
 
 const (
@@ -74,16 +115,191 @@ const (
 	PLAIN_HTTP_REJECT
 )
 
+const (
+	PATH_TYPE_PREFIX = iota
+	PATH_TYPE_EXACT
+	PATH_TYPE_IMPLEMENTATION_SPECIFIC
+)
+
+// RoutingTable is an immutable snapshot of all frontends, published as a whole so requests always see a consistent table
+type RoutingTable struct {
+	Version   uint64
+	Built     time.Time
+	Frontends map[string]*Frontend
+}
+
 type Frontend struct {
 	Action          uint16
 	PlainHTTPPolicy uint16
 	Intercept       *Intercept
 	Backends        []Backend
-	RR              *roundrobin.RoundRobin
+	Routes          []*Route
+	RateLimiter     *RateLimiter
+}
+
+const (
+	BACKEND_PROTOCOL_HTTP1 = iota
+	BACKEND_PROTOCOL_HTTP2
+)
+
+const (
+	CLIENT_AUTH_OFF = iota
+	CLIENT_AUTH_OPTIONAL
+	CLIENT_AUTH_REQUIRED
+)
+
+const (
+	RATE_LIMIT_KEY_CLIENT_IP = iota
+	RATE_LIMIT_KEY_HEADER
+	RATE_LIMIT_KEY_GLOBAL
+)
+
+// RateLimit allows Rate requests per second with bursts of up to Burst requests, counted per client ip, per value of
+// the header KeyName or for all requests together
+type RateLimit struct {
+	Rate    float64
+	Burst   int
+	Key     uint16
+	KeyName string
+}
+
+const (
+	MATCH_SOURCE_HEADER = iota
+	MATCH_SOURCE_COOKIE
+	MATCH_SOURCE_QUERY
+)
+
+type Route struct {
+	Path             string
+	PathType         uint16
+	Matches          []RequestMatch
+	Backends         []Backend
+	Affinity         *Affinity
+	Sticky           *StickySession `json:"-"`
+	Balancing        Balancing
+	HealthCheck      *HealthCheck
+	OutlierDetection *OutlierDetection
+	Retry            *RetryPolicy
+	CircuitBreaker   *CircuitBreaker
+	Timeouts         Timeouts
+	Protocol         uint16
+	TLS              *BackendTLS
+	Balancer         Balancer `json:"-"`
+
+	applied *appliedBackends
+}
+
+// HealthCheck probes the backends of a route with a GET request of Path. A backend is taken out of rotation after
+// UnhealthyThreshold consecutive failures, and put back after HealthyThreshold consecutive successes
+type HealthCheck struct {
+	Path               string
+	Interval           time.Duration
+	Timeout            time.Duration
+	HealthyThreshold   int
+	UnhealthyThreshold int
+}
+
+// OutlierDetection ejects a backend of a route for EjectionTime after ConsecutiveErrors 5xx responses or connection
+// errors in a row, as long as no more than MaxEjectionPercent of the backends of the route are ejected
+type OutlierDetection struct {
+	ConsecutiveErrors  int
+	EjectionTime       time.Duration
+	MaxEjectionPercent int
+}
+
+// RetryPolicy retries a failed request up to Attempts times, each time with a backend not tried before. Requests are
+// retried on connection errors when ConnectFailure is set, and on any 5xx status with ServerErrors or on the listed
+// StatusCodes. Only idempotent methods are retried unless AllMethods is set, and retries are limited to Budget percent
+// of the requests of the route
+type RetryPolicy struct {
+	Attempts       int
+	ConnectFailure bool
+	ServerErrors   bool
+	StatusCodes    []int
+	AllMethods     bool
+	Budget         int
+}
+
+// CircuitBreaker opens when at least MinRequests requests within Window have failed by ErrorPercent or more, or
+// their average latency is above Latency (0=disabled). While open requests are answered by Fallback, or with a 503
+// when it is nil. After OpenTime the breaker lets Probes requests through, and closes when all of them succeed
+type CircuitBreaker struct {
+	ErrorPercent int
+	Latency      time.Duration
+	MinRequests  int
+	Window       time.Duration
+	OpenTime     time.Duration
+	Probes       int
+	Fallback     *Intercept
+}
+
+// Timeouts limit the time to connect to a backend, to receive the response headers, between two reads of the
+// response body and of the request as a whole (0=no limit, except for the default connect timeout)
+type Timeouts struct {
+	Connect        time.Duration
+	ResponseHeader time.Duration
+	Idle           time.Duration
+	Total          time.Duration
+}
+
+// BackendHealth is the state of a backend as seen by the active health checks
+type BackendHealth struct {
+	Url                  string    `json:"url"`
+	Path                 string    `json:"path"`
+	Healthy              bool      `json:"healthy"`
+	ConsecutiveSuccesses int       `json:"consecutiveSuccesses"`
+	ConsecutiveFailures  int       `json:"consecutiveFailures"`
+	LastCheck            time.Time `json:"lastCheck"`
+	LastError            string    `json:"lastError,omitempty"`
+}
+
+const (
+	BALANCER_ROUND_ROBIN = iota
+	BALANCER_LEAST_REQUEST
+	BALANCER_PEAK_EWMA
+	BALANCER_HASH
+	// round robin of routes splitting traffic between services by weight, picked instead of the plain round robin
+	BALANCER_WEIGHTED_ROUND_ROBIN
+)
+
+const (
+	HASH_KEY_CLIENT_IP = iota
+	HASH_KEY_HEADER
+	HASH_KEY_COOKIE
+	HASH_KEY_PATH
+)
+
+// Balancing selects the algorithm balancing a route, HashKeyName is the header or cookie hashed by consistent hashing
+type Balancing struct {
+	Algorithm   uint16
+	HashKey     uint16
+	HashKeyName string
+}
+
+const (
+	AFFINITY_FALLBACK_REBALANCE = iota
+	AFFINITY_FALLBACK_REJECT
+)
+
+// Affinity pins clients to a backend with a signed cookie, Fallback decides what happens when that backend is gone
+type Affinity struct {
+	CookieName string
+	TTL        time.Duration
+	Fallback   uint16
+}
+
+// RequestMatch matches a named value of the request, either exactly or by regular expression when Regexp is set
+type RequestMatch struct {
+	Source uint16
+	Name   string
+	Value  string
+	Regexp *regexp.Regexp
 }
 
+// Backend is a single endpoint, Weight is relative to the other backends of a route (0=unweighted)
 type Backend struct {
-	Url *url.URL
+	Url    *url.URL
+	Weight int
 }
 
 type Intercept struct {
@@ -103,6 +319,12 @@ type KeyPairPaths struct {
 	PrivateKey string
 }
 
+// ClientCAFile is the CA bundle verifying the client certificates of a host, and the client auth mode of the host
+type ClientCAFile struct {
+	Mode string
+	Path string
+}
+
 func NewReload(reason string) Reload {
 	return Reload{
 		Time:   time.Now(),
@@ -113,8 +335,125 @@ func NewReload(reason string) Reload {
 // convert url to string when serializing
 func (backend Backend) MarshalJSON() ([]byte, error) {
 	return json.Marshal(struct {
-		Url string `json:"url"`
+		Url    string `json:"url"`
+		Weight int    `json:"weight,omitempty"`
+	}{
+		Url:    backend.Url.String(),
+		Weight: backend.Weight,
+	})
+}
+
+// convert algorithm and hash key to their names when serializing
+func (balancing Balancing) MarshalJSON() ([]byte, error) {
+	var algorithm, hashKey string
+	switch balancing.Algorithm {
+	case BALANCER_ROUND_ROBIN:
+		algorithm = "round-robin"
+	case BALANCER_WEIGHTED_ROUND_ROBIN:
+		algorithm = "weighted-round-robin"
+	case BALANCER_LEAST_REQUEST:
+		algorithm = "least-request"
+	case BALANCER_PEAK_EWMA:
+		algorithm = "peak-ewma"
+	case BALANCER_HASH:
+		algorithm = "hash"
+		switch balancing.HashKey {
+		case HASH_KEY_CLIENT_IP:
+			hashKey = "ip"
+		case HASH_KEY_HEADER:
+			hashKey = "header:" + balancing.HashKeyName
+		case HASH_KEY_COOKIE:
+			hashKey = "cookie:" + balancing.HashKeyName
+		case HASH_KEY_PATH:
+			hashKey = "path"
+		}
+	}
+	return json.Marshal(struct {
+		Algorithm string `json:"algorithm"`
+		HashKey   string `json:"hashKey,omitempty"`
+	}{
+		Algorithm: algorithm,
+		HashKey:   hashKey,
+	})
+}
+
+// convert fallback to its name when serializing
+func (affinity Affinity) MarshalJSON() ([]byte, error) {
+	var fallback string
+	switch affinity.Fallback {
+	case AFFINITY_FALLBACK_REBALANCE:
+		fallback = "rebalance"
+	case AFFINITY_FALLBACK_REJECT:
+		fallback = "reject"
+	}
+	return json.Marshal(struct {
+		CookieName string `json:"cookieName"`
+		TTL        string `json:"ttl"`
+		Fallback   string `json:"fallback"`
+	}{
+		CookieName: affinity.CookieName,
+		TTL:        affinity.TTL.String(),
+		Fallback:   fallback,
+	})
+}
+
+// convert source to its name when serializing
+func (match RequestMatch) MarshalJSON() ([]byte, error) {
+	var source string
+	switch match.Source {
+	case MATCH_SOURCE_HEADER:
+		source = "header"
+	case MATCH_SOURCE_COOKIE:
+		source = "cookie"
+	case MATCH_SOURCE_QUERY:
+		source = "query"
+	}
+	return json.Marshal(struct {
+		Source string `json:"source"`
+		Name   string `json:"name"`
+		Value  string `json:"value"`
+		Regexp bool   `json:"regexp,omitempty"`
+	}{
+		Source: source,
+		Name:   match.Name,
+		Value:  match.Value,
+		Regexp: match.Regexp != nil,
+	})
+}
+
+// convert durations to strings when serializing
+func (timeouts Timeouts) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Connect        string `json:"connect"`
+		ResponseHeader string `json:"responseHeader"`
+		Idle           string `json:"idle"`
+		Total          string `json:"total"`
+	}{
+		Connect:        timeouts.Connect.String(),
+		ResponseHeader: timeouts.ResponseHeader.String(),
+		Idle:           timeouts.Idle.String(),
+		Total:          timeouts.Total.String(),
+	})
+}
+
+// convert key to its name when serializing
+func (limit RateLimit) MarshalJSON() ([]byte, error) {
+	var key string
+	switch limit.Key {
+	case RATE_LIMIT_KEY_CLIENT_IP:
+		key = "ip"
+	case RATE_LIMIT_KEY_HEADER:
+		key = "header:" + limit.KeyName
+	case RATE_LIMIT_KEY_GLOBAL:
+		key = "global"
+	}
+	return json.Marshal(struct {
+		Rate  float64 `json:"rate"`
+		Burst int     `json:"burst"`
+		Key   string  `json:"key"`
 	}{
-		Url: backend.Url.String(),
+		Rate:  limit.Rate,
+		Burst: limit.Burst,
+		Key:   key,
 	})
 }
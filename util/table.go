@@ -0,0 +1,68 @@
+package util
+
+import "time"
+
+var emptyRoutingTable = &RoutingTable{
+	Frontends: make(map[string]*Frontend),
+}
+
+// RoutingTable returns the currently published routing table, the table and its frontends must not be modified
+func (config *Config) RoutingTable() *RoutingTable {
+	if table := config.routingTable.Load(); table != nil {
+		return table
+	}
+	return emptyRoutingTable
+}
+
+// PublishFrontends atomically replaces the routing table with a new snapshot of the given frontends, updates the
+// balancers kept from previous tables and drops the metrics of the circuit breakers no longer in use. The map is owned by the table afterwards and must not be modified by the caller
+func (config *Config) PublishFrontends(frontends map[string]*Frontend) *RoutingTable {
+	for {
+		current := config.routingTable.Load()
+		table := &RoutingTable{
+			Version:   1,
+			Built:     time.Now(),
+			Frontends: frontends,
+		}
+		if current != nil {
+			table.Version = current.Version + 1
+		}
+		if config.routingTable.CompareAndSwap(current, table) {
+			table.updateBalancers()
+			if current != nil {
+				dropBreakers(current, table)
+			}
+			return table
+		}
+	}
+}
+
+// updateBalancers updates the balancers kept from previous routing tables to the backends of their routes, diffing
+// against the backends the balancers were last updated with
+func (table *RoutingTable) updateBalancers() {
+	for _, frontend := range table.Frontends {
+		for _, route := range frontend.Routes {
+			if route.applied != nil {
+				UpdateBalancer(route.Balancer, route.applied.backends, route.Backends)
+				route.applied.backends = route.Backends
+			}
+		}
+	}
+}
+
+// UpdateFailure returns the failure of the most recent reload, or nil if it succeeded
+func (config *Config) UpdateFailure() *UpdateFailure {
+	return config.updateFailure.Load()
+}
+
+func (config *Config) SetUpdateFailure(err error, consecutiveErrors int) {
+	config.updateFailure.Store(&UpdateFailure{
+		ConsecutiveErrors: consecutiveErrors,
+		Error:             err.Error(),
+		Time:              time.Now(),
+	})
+}
+
+func (config *Config) ClearUpdateFailure() {
+	config.updateFailure.Store(nil)
+}
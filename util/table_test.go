@@ -0,0 +1,24 @@
+package util
+
+import "testing"
+
+func TestPublishFrontends(t *testing.T) {
+	config := &Config{}
+
+	if table := config.RoutingTable(); table.Version != 0 || len(table.Frontends) != 0 {
+		t.Error("Expected empty routing table before first publish")
+	}
+
+	first := config.PublishFrontends(map[string]*Frontend{"a.example.com": {}})
+	second := config.PublishFrontends(map[string]*Frontend{"b.example.com": {}})
+
+	if first.Version != 1 || second.Version != 2 {
+		t.Errorf("Expected versions to increase with every publish, got %d and %d", first.Version, second.Version)
+	}
+	if config.RoutingTable() != second {
+		t.Error("Expected latest published table to be current")
+	}
+	if _, exists := first.Frontends["a.example.com"]; !exists || len(first.Frontends) != 1 {
+		t.Error("Expected earlier snapshot to be left unmodified")
+	}
+}
@@ -0,0 +1,151 @@
+package util
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/utils"
+)
+
+// default timeout of connecting to a backend, for routes without a connect timeout
+const DEFAULT_CONNECT_TIMEOUT = 1 * time.Second
+
+// ErrUpstreamTimeout is the cause of requests canceled by the timeouts of their route
+var ErrUpstreamTimeout = errors.New("upstream timeout")
+
+// ForwardErrorHandler is the error handler of the forwarder. Errors of requests which may be retried are remembered,
+// so the retry can tell a failed connection apart from a 502 sent by the backend, and requests canceled by the
+// timeouts of their route are answered with a 504. Errors of gRPC calls are answered with a gRPC status, and backends
+// failing certificate verification with a 502
+var ForwardErrorHandler = utils.ErrorHandlerFunc(func(w http.ResponseWriter, req *http.Request, err error) {
+	if attempt, ok := req.Context().Value(attemptKey{}).(*attempt); ok {
+		attempt.err = err
+	}
+	if state, ok := req.Context().Value(timeoutKey{}).(*timeoutState); ok && timedOut(req, err) {
+		state.timedOut = true
+	}
+	if errors.Is(context.Cause(req.Context()), ErrUpstreamTimeout) {
+		status := http.StatusGatewayTimeout
+		Error(w, req, http.StatusText(status), status)
+		return
+	}
+	var verification *tls.CertificateVerificationError
+	if IsGrpc(req) || errors.As(err, &verification) {
+		status := http.StatusBadGateway
+		if timedOut(req, err) {
+			status = http.StatusGatewayTimeout
+		}
+		Error(w, req, http.StatusText(status), status)
+		return
+	}
+	utils.DefaultHandler.ServeHTTP(w, req, err)
+})
+
+type timeoutKey struct{}
+
+// timeoutState is passed in the context of a request with timeouts, the forwarder tells when the request timed out
+type timeoutState struct {
+	connect  time.Duration
+	timedOut bool
+}
+
+// ConnectTimeout returns the connect timeout of the route of a request, the context is the one passed to the dialer
+func ConnectTimeout(ctx context.Context) time.Duration {
+	if state, ok := ctx.Value(timeoutKey{}).(*timeoutState); ok && state.connect > 0 {
+		return state.connect
+	}
+	return DEFAULT_CONNECT_TIMEOUT
+}
+
+// ServeWithTimeouts passes a request on to the balancer of a route, canceling it when the response headers or the
+// next part of the body are not received in time, or the request takes longer than its total timeout. It tells if
+// the request was answered with a 504, or the gRPC status of a 504, because a timeout expired
+func ServeWithTimeouts(handler http.Handler, timeouts Timeouts, w http.ResponseWriter, req *http.Request) bool {
+	state := &timeoutState{connect: timeouts.Connect}
+	ctx, cancel := context.WithCancelCause(context.WithValue(req.Context(), timeoutKey{}, state))
+	defer cancel(nil)
+	expire := func() { cancel(ErrUpstreamTimeout) }
+
+	if forward.IsWebsocketRequest(req) {
+		// upgraded connections live as long as both ends want them to, only the connect timeout applies
+		handler.ServeHTTP(w, req.WithContext(ctx))
+		return false
+	}
+
+	if timeouts.Total > 0 {
+		total := time.AfterFunc(timeouts.Total, expire)
+		defer total.Stop()
+	}
+	tw := &timeoutWriter{ResponseWriter: w, idle: timeouts.Idle, expire: expire}
+	if timeouts.ResponseHeader > 0 {
+		tw.timer = time.AfterFunc(timeouts.ResponseHeader, expire)
+	}
+	handler.ServeHTTP(tw, req.WithContext(ctx))
+	if tw.timer != nil {
+		tw.timer.Stop()
+	}
+
+	return state.timedOut && ResponseStatus(req, w.Header(), tw.status) == http.StatusGatewayTimeout
+}
+
+// timedOut tells if a request failed by running into a timeout, either a timeout of its route or the connect timeout
+func timedOut(req *http.Request, err error) bool {
+	if errors.Is(context.Cause(req.Context()), ErrUpstreamTimeout) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// timeoutWriter stops the response header timer when the headers are written, and then restarts the idle timer
+// with every write of the body. Informational responses are passed on without stopping the response header timer
+type timeoutWriter struct {
+	http.ResponseWriter
+	idle   time.Duration
+	expire func()
+	timer  *time.Timer
+	status int
+}
+
+func (w *timeoutWriter) WriteHeader(code int) {
+	if w.status != 0 {
+		return
+	}
+	if informational(code) {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.status = code
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	if w.idle > 0 {
+		w.timer = time.AfterFunc(w.idle, w.expire)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *timeoutWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.timer != nil {
+		w.timer.Reset(w.idle)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *timeoutWriter) Flush() {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,83 @@
+package util
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/vulcand/oxy/forward"
+)
+
+func TestServeWithTimeouts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Has("hints") {
+			w.WriteHeader(http.StatusEarlyHints)
+		}
+		if delay, err := time.ParseDuration(req.URL.Query().Get("header")); err == nil {
+			<-time.After(delay)
+		}
+		w.WriteHeader(http.StatusOK)
+		for n := 0; n < 3; n++ {
+			w.(http.Flusher).Flush()
+			if delay, err := time.ParseDuration(req.URL.Query().Get("body")); err == nil {
+				<-time.After(delay)
+			}
+			w.Write([]byte("chunk"))
+		}
+	}))
+	defer server.Close()
+
+	forwarder, err := forward.New(forward.ErrorHandler(ForwardErrorHandler))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(server.URL)
+	balancer := CreateBalancer(forwarder, Balancing{}, []Backend{{Url: u}}, nil)
+
+	tests := []struct {
+		query    string
+		timeouts Timeouts
+		timedOut bool
+		code     int
+	}{
+		{"header=100ms", Timeouts{ResponseHeader: 20 * time.Millisecond}, true, http.StatusGatewayTimeout},
+		{"header=10ms", Timeouts{ResponseHeader: time.Second}, false, http.StatusOK},
+		{"header=100ms", Timeouts{Total: 20 * time.Millisecond}, true, http.StatusGatewayTimeout},
+		{"body=30ms", Timeouts{Idle: 50 * time.Millisecond, Total: time.Second}, false, http.StatusOK},
+		{"body=100ms", Timeouts{Idle: 20 * time.Millisecond}, false, http.StatusOK},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/?"+test.query, nil)
+		if timedOut := ServeWithTimeouts(balancer, test.timeouts, w, req); timedOut != test.timedOut || w.Code != test.code {
+			t.Errorf("Expected %s with %+v to give %d (timed out %v), got %d (timed out %v)", test.query, test.timeouts, test.code, test.timedOut, w.Code, timedOut)
+		}
+		if test.query == "body=100ms" && w.Body.Len() >= 15 {
+			t.Errorf("Expected idle timeout to cut off the response body, got %q", w.Body.String())
+		}
+	}
+
+	// the recorder takes informational responses as the status, a server sends the status which follows them
+	timedOut := make(chan bool, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		timedOut <- ServeWithTimeouts(balancer, Timeouts{ResponseHeader: 20 * time.Millisecond}, w, req)
+	}))
+	defer proxy.Close()
+	res, err := http.Get(proxy.URL + "/?hints&header=100ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if !<-timedOut || res.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("Expected early hints not to stop the response header timeout, got %d", res.StatusCode)
+	}
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/?header=100ms", nil)
+	req.Header.Set("Content-Type", "application/grpc")
+	if timedOut := ServeWithTimeouts(balancer, Timeouts{ResponseHeader: 20 * time.Millisecond}, w, req); !timedOut || w.Header().Get("Grpc-Status") != "4" {
+		t.Errorf("Expected gRPC call to time out with status 4, got %v (timed out %v)", w.Header(), timedOut)
+	}
+}
@@ -0,0 +1,106 @@
+package util
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+)
+
+// BackendTLS is the tls config of the connections to the https backends of a route. The backends are verified against
+// the CA bundle when given and the system roots otherwise, with ServerName overriding the pod ip as server name, and a
+// client certificate is presented for mTLS. CA and ClientCert name where these were read from
+type BackendTLS struct {
+	ServerName string
+	CA         string
+	ClientCert string
+
+	config      *tls.Config
+	fingerprint [sha256.Size]byte
+}
+
+// NewBackendTLS builds the tls config of a route from PEM encoded CA bundle and client key pair, which may be empty.
+// Backends are not verified at all when insecure is set and no CA bundle is given
+func NewBackendTLS(serverName string, caName string, ca []byte, certName string, cert []byte, key []byte, insecure bool) (*BackendTLS, error) {
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         serverName,
+		InsecureSkipVerify: insecure && len(ca) == 0,
+	}
+	if len(ca) > 0 {
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, errors.New("no certificates found in CA bundle")
+		}
+	}
+	if len(cert) > 0 || len(key) > 0 {
+		pair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+
+	return &BackendTLS{
+		ServerName:  serverName,
+		CA:          caName,
+		ClientCert:  certName,
+		config:      config,
+		fingerprint: sha256.Sum256(bytes.Join([][]byte{ca, cert, key}, []byte{0})),
+	}, nil
+}
+
+// Config returns the tls config of the route, the same for the lifetime of the BackendTLS so transports can be shared
+func (b *BackendTLS) Config() *tls.Config {
+	return b.config
+}
+
+// Equal tells if two routes speak tls to their backends with the same certificates
+func (b *BackendTLS) Equal(other *BackendTLS) bool {
+	if b == nil || other == nil {
+		return b == other
+	}
+	return b.ServerName == other.ServerName && b.CA == other.CA && b.ClientCert == other.ClientCert &&
+		b.config.InsecureSkipVerify == other.config.InsecureSkipVerify && b.fingerprint == other.fingerprint
+}
+
+// ClientAuth verifies the client certificates of a host against CAs, Mode tells whether clients must present one
+type ClientAuth struct {
+	Mode uint16
+	CAs  *x509.CertPool
+}
+
+// NewClientAuth parses the client auth mode of a host, 'off', 'optional' or 'required' (empty=required), and its PEM
+// encoded CA bundle. A host with an invalid mode or CA bundle fails closed, its client auth rejects every client
+// certificate and is returned along with the error
+func NewClientAuth(mode string, ca []byte) (*ClientAuth, error) {
+	closed := &ClientAuth{Mode: CLIENT_AUTH_REQUIRED, CAs: x509.NewCertPool()}
+	auth := &ClientAuth{CAs: x509.NewCertPool()}
+	switch mode {
+	case "off":
+		auth.Mode = CLIENT_AUTH_OFF
+	case "optional":
+		auth.Mode = CLIENT_AUTH_OPTIONAL
+	case "", "required":
+		auth.Mode = CLIENT_AUTH_REQUIRED
+	default:
+		return closed, fmt.Errorf("unknown client auth mode '%s'", mode)
+	}
+	if auth.Mode != CLIENT_AUTH_OFF && !auth.CAs.AppendCertsFromPEM(ca) {
+		return closed, errors.New("no certificates found in client CA bundle")
+	}
+	return auth, nil
+}
+
+// TLSClientAuth returns the client auth type of the tls config of a host
+func (a *ClientAuth) TLSClientAuth() tls.ClientAuthType {
+	switch a.Mode {
+	case CLIENT_AUTH_OPTIONAL:
+		return tls.VerifyClientCertIfGiven
+	case CLIENT_AUTH_REQUIRED:
+		return tls.RequireAndVerifyClientCert
+	}
+	return tls.NoClientCert
+}
@@ -0,0 +1,18 @@
+package util
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+func TestNewClientAuth(t *testing.T) {
+	if auth, err := NewClientAuth("off", nil); err != nil || auth.TLSClientAuth() != tls.NoClientCert {
+		t.Errorf("Expected client auth to be off without CA bundle, got %v %v", auth, err)
+	}
+	if auth, err := NewClientAuth("optional", []byte("not a certificate")); err == nil || auth.TLSClientAuth() != tls.RequireAndVerifyClientCert {
+		t.Errorf("Expected invalid CA bundle to fail closed, got %v %v", auth, err)
+	}
+	if auth, err := NewClientAuth("sometimes", nil); err == nil || auth.TLSClientAuth() != tls.RequireAndVerifyClientCert {
+		t.Errorf("Expected unknown mode to fail closed, got %v %v", auth, err)
+	}
+}
@@ -2,7 +2,6 @@ package util
 
 import (
 	"crypto/tls"
-	"github.com/vulcand/oxy/forward"
 	"github.com/vulcand/oxy/roundrobin"
 	"math/rand"
 	"net/http"
@@ -42,14 +41,18 @@ func UrlClone(req *http.Request) *url.URL {
 	}
 }
 
-func CreateRR(forwarder *forward.Forwarder, backends []Backend) *roundrobin.RoundRobin {
+func CreateRR(next http.Handler, backends []Backend) *roundrobin.RoundRobin {
 	// randomize the list of backends to try to circumvent slightly biased load towards the beginning of the backend list (at high backend reconcile rates)
 	rand.Seed(time.Now().UnixNano())
 	rand.Shuffle(len(backends), func(i, j int) { backends[i], backends[j] = backends[j], backends[i] })
 
-	rr, _ := roundrobin.New(forwarder)
+	rr, _ := roundrobin.New(next)
 	for _, backend := range backends {
-		rr.UpsertServer(backend.Url)
+		if backend.Weight > 0 {
+			rr.UpsertServer(backend.Url, roundrobin.Weight(backend.Weight))
+		} else {
+			rr.UpsertServer(backend.Url)
+		}
 	}
 
 	return rr